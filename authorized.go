@@ -0,0 +1,117 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Authorization describes the outcome of SPF policy over the whole address
+// space, see Checker.AuthorizedNetworks.
+type Authorization struct {
+	Domain string
+
+	// Disjoint networks with the given result. Together they cover all the
+	// addresses. Terms listed in Dependent are considered not matching.
+	Pass     []*net.IPNet
+	Fail     []*net.IPNet
+	Softfail []*net.IPNet
+	Neutral  []*net.IPNet
+
+	// Dependent lists the terms whose match depends on the client IP or
+	// sender, that is "ptr" and terms with macros, including those of
+	// included records.
+	Dependent []*UnflattenedTerm
+	// Undetermined are the networks, which result may be changed by the
+	// terms listed in Dependent, as they are not matched by any term
+	// preceding the first of them.
+	Undetermined []*net.IPNet
+}
+
+// Result returns the result of the evaluation for ip. It returns false if
+// the result may be changed by the terms depending on the client.
+func (a *Authorization) Result(ip net.IP) (Result, bool) {
+	determined := !containsIP(a.Undetermined, ip)
+	for _, s := range []struct {
+		r    Result
+		nets []*net.IPNet
+	}{{Pass, a.Pass}, {Fail, a.Fail}, {Softfail, a.Softfail}} {
+		if containsIP(s.nets, ip) {
+			return s.r, determined
+		}
+	}
+	return Neutral, determined
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizedNetworks returns the outcome of SPF policy of domain over the
+// whole address space, see Checker.AuthorizedNetworks.
+func AuthorizedNetworks(domain string, opts ...Option) (*Authorization, error) {
+	return NewChecker(opts...).AuthorizedNetworks(context.Background(), domain)
+}
+
+// AuthorizedNetworks evaluates SPF policy of domain symbolically for all
+// IPv4 and IPv6 addresses at once and returns networks of each result, e.g.
+// the networks which can send mail as domain with Pass result. The
+// mechanisms are resolved like Flatten does, so the same errors are
+// returned. In particular, ErrDNSLimitExceeded or
+// ErrDNSVoidLookupLimitExceeded is returned if the policy exceeds the limits
+// of the evaluation, as it results in "permerror" then.
+//
+// Terms which depend on the client IP or sender can't be evaluated. They are
+// listed in Dependent, the results are computed as if they didn't match and
+// the addresses they may affect are returned in Undetermined.
+func (c *Checker) AuthorizedNetworks(ctx context.Context, domain string) (*Authorization, error) {
+	f := c.flattener(ctx)
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	rules, _, err := f.record(domain, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		all          = []*net.IPNet{allIPv4, allIPv6}
+		covered      []*net.IPNet
+		undetermined []*net.IPNet
+		dependent    bool
+		results      = make(map[Qualifier][]*net.IPNet)
+	)
+	for _, r := range rules {
+		if r.term != nil {
+			if !dependent {
+				undetermined, dependent = subtractNets(all, covered), true
+			}
+			continue
+		}
+		nets := r.nets
+		if r.all {
+			nets = all
+		}
+		nets = subtractNets(aggregateNets(nets), covered)
+		results[r.qualifier] = append(results[r.qualifier], nets...)
+		covered = append(covered, nets...)
+		if r.all {
+			break
+		}
+	}
+	// the result is Neutral if nothing matches
+	results[QualifierNeutral] = append(results[QualifierNeutral], subtractNets(all, covered)...)
+
+	return &Authorization{
+		Domain:       domain,
+		Pass:         aggregateNets(results[QualifierPass]),
+		Fail:         aggregateNets(results[QualifierFail]),
+		Softfail:     aggregateNets(results[QualifierSoftfail]),
+		Neutral:      aggregateNets(results[QualifierNeutral]),
+		Dependent:    f.unflattened,
+		Undetermined: aggregateNets(undetermined),
+	}, nil
+}
@@ -0,0 +1,113 @@
+package spf
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAuthorizedNetworks(t *testing.T) {
+	dns.HandleFunc("auth.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`auth.test. 0 IN TXT "v=spf1 -ip4:10.0.0.0/25 a include:inc.auth.test ~ip4:10.0.0.0/8 ?ip6:2001:db8::/32 -all"`,
+			`inc.auth.test. 0 IN TXT "v=spf1 ip4:10.0.0.0/24 ip6:2001:db8::/48 ~all"`,
+		},
+		dns.TypeA: {
+			"auth.test. 0 IN A 192.0.2.1",
+		},
+	}))
+	defer dns.HandleRemove("auth.test.")
+
+	a, err := AuthorizedNetworks("auth.test", WithResolver(testResolver))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sets := map[string][]string{
+		"pass":         netStrings(a.Pass),
+		"fail":         netStrings(a.Fail),
+		"softfail":     netStrings(a.Softfail),
+		"neutral":      netStrings(a.Neutral),
+		"undetermined": netStrings(a.Undetermined),
+	}
+	expected := map[string][]string{
+		"pass":         {"10.0.0.128/25", "192.0.2.1/32", "2001:db8::/48"},
+		"fail":         netStrings(subtractNets(parseNets(t, "0.0.0.0/0", "::/0"), parseNets(t, "10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32"))),
+		"softfail":     netStrings(subtractNets(parseNets(t, "10.0.0.0/8"), parseNets(t, "10.0.0.0/24"))),
+		"neutral":      netStrings(subtractNets(parseNets(t, "2001:db8::/32"), parseNets(t, "2001:db8::/48"))),
+		"undetermined": {},
+	}
+	expected["fail"] = append([]string{"10.0.0.0/25"}, expected["fail"]...)
+	expected["fail"] = netStrings(aggregateNets(parseNets(t, expected["fail"]...)))
+	if !reflect.DeepEqual(sets, expected) {
+		t.Errorf("expected %q,\ngot %q", expected, sets)
+	}
+	if len(a.Dependent) != 0 {
+		t.Errorf("unexpected dependent terms: %v", a.Dependent)
+	}
+
+	for _, test := range []struct {
+		ip     net.IP
+		result Result
+	}{
+		{net.IP{10, 0, 0, 1}, Fail},
+		{net.IP{10, 0, 0, 200}, Pass},
+		{net.IP{10, 0, 1, 1}, Softfail},
+		{net.IP{192, 0, 2, 1}, Pass},
+		{net.ParseIP("2001:db8:1::1"), Neutral},
+		{net.ParseIP("2001:db9::1"), Fail},
+	} {
+		if r, determined := a.Result(test.ip); r != test.result || !determined {
+			t.Errorf("%s: expected %v, got %v (%v)", test.ip, test.result, r, determined)
+		}
+	}
+}
+
+func TestAuthorizedNetworksDependent(t *testing.T) {
+	dns.HandleFunc("auth-macro.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`auth-macro.test. 0 IN TXT "v=spf1 ip4:192.0.2.0/24 exists:%{i}.auth-macro.test ip4:198.51.100.0/24 -all"`,
+		},
+	}))
+	defer dns.HandleRemove("auth-macro.test.")
+
+	a, err := AuthorizedNetworks("auth-macro.test", WithResolver(testResolver))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s := netStrings(a.Pass); !reflect.DeepEqual(s, []string{"192.0.2.0/24", "198.51.100.0/24"}) {
+		t.Errorf("unexpected pass networks: %q", s)
+	}
+	expected := []*UnflattenedTerm{{"auth-macro.test", "exists:%{i}.auth-macro.test", "depends on macros"}}
+	if !reflect.DeepEqual(a.Dependent, expected) {
+		t.Errorf("unexpected dependent terms: %v", a.Dependent)
+	}
+
+	if r, determined := a.Result(net.IP{192, 0, 2, 1}); r != Pass || !determined {
+		t.Errorf("expected determined Pass, got %v (%v)", r, determined)
+	}
+	if r, determined := a.Result(net.IP{198, 51, 100, 1}); r != Pass || determined {
+		t.Errorf("expected undetermined Pass, got %v (%v)", r, determined)
+	}
+	if r, determined := a.Result(net.IP{203, 0, 113, 1}); r != Fail || determined {
+		t.Errorf("expected undetermined Fail, got %v (%v)", r, determined)
+	}
+}
+
+func TestAuthorizedNetworksLimits(t *testing.T) {
+	includes := strings.Repeat(" include:inc.auth-limit.test", 11)
+	dns.HandleFunc("auth-limit.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`auth-limit.test. 0 IN TXT "v=spf1` + includes + ` -all"`,
+			`inc.auth-limit.test. 0 IN TXT "v=spf1 ip4:10.0.0.1 -all"`,
+		},
+	}))
+	defer dns.HandleRemove("auth-limit.test.")
+
+	if _, err := AuthorizedNetworks("auth-limit.test", WithResolver(testResolver)); err != ErrDNSLimitExceeded {
+		t.Errorf("expected %v, got %v", ErrDNSLimitExceeded, err)
+	}
+}
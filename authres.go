@@ -0,0 +1,296 @@
+package spf
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// AuthResult represents "spf" method clause of Authentication-Results header
+// field as defined by RFC 8601, section 2.7.2, e.g.
+//
+//	spf=pass (domain of user@example.com designates 192.0.2.1 as permitted sender) smtp.mailfrom=user@example.com
+type AuthResult struct {
+	Result   Result
+	Comment  string // comment following the result
+	Reason   string // value of "reason" clause
+	MailFrom string // smtp.mailfrom property
+	HELO     string // smtp.helo property
+}
+
+// NewAuthResult returns the clause describing the evaluation e of sender
+// identity, or of the HELO identity if sender is empty. e and err are the
+// values returned by Evaluate or EvaluateWithResolver, receiver is the host
+// which performed the check, it's used in the comment only. The reason of
+// "permerror" and "temperror" results is err, or the mechanism which
+// produced the result if err is nil.
+func NewAuthResult(e *Evaluation, err error, ip net.IP, helo, sender, receiver string) *AuthResult {
+	identity := sender
+	if identity == "" {
+		identity = helo
+	}
+	a := &AuthResult{
+		Result:   e.Result,
+		Comment:  resultComment(e.Result, ip, identity, receiver),
+		MailFrom: sender,
+		HELO:     helo,
+	}
+	if e.Result == Temperror || e.Result == Permerror {
+		switch {
+		case err != nil:
+			a.Reason = err.Error()
+		case e.Mechanism != "":
+			a.Reason = e.Mechanism
+		}
+	}
+	return a
+}
+
+// String renders the clause, which could be added to Authentication-Results
+// header field following the authserv-id and ";".
+func (a *AuthResult) String() string {
+	var b bytes.Buffer
+	b.WriteString("spf=")
+	b.WriteString(a.Result.String())
+	if a.Comment != "" {
+		b.WriteString(" (")
+		b.WriteString(escapeComment(a.Comment))
+		b.WriteString(")")
+	}
+	if a.Reason != "" {
+		b.WriteString(" reason=")
+		b.WriteString(quoteAuthValue(a.Reason))
+	}
+	if a.MailFrom != "" {
+		b.WriteString(" smtp.mailfrom=")
+		b.WriteString(quoteAuthValue(a.MailFrom))
+	}
+	if a.HELO != "" {
+		b.WriteString(" smtp.helo=")
+		b.WriteString(quoteAuthValue(a.HELO))
+	}
+	return b.String()
+}
+
+// quoteAuthValue returns s as it is if it's a token or an address, otherwise
+// as quoted-string, see RFC 8601, section 2.2.
+func quoteAuthValue(s string) string {
+	local, domain := "", s
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		local, domain = s[:i], s[i+1:]
+	}
+	if (local == "" || isToken(local)) && isToken(domain) {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", " ", "\n", " ")
+	return `"` + r.Replace(s) + `"`
+}
+
+// isToken reports whether s is a token as defined by RFC 2045, section 5.1.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?=`, s[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseAuthResults parses Authentication-Results header field and returns its
+// authserv-id and all "spf" method clauses. The field name is optional and
+// the field may be folded.
+//
+// Note, that only header fields added by trusted hosts should be used, see
+// RFC 8601, section 5.
+func ParseAuthResults(field string) (string, []*AuthResult, error) {
+	if i := strings.IndexByte(field, ':'); i >= 0 &&
+		strings.EqualFold(strings.TrimSpace(field[:i]), "Authentication-Results") {
+		field = field[i+1:]
+	}
+
+	tokens, err := lexAuthResults(field)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// split tokens into authserv-id and resinfo sections
+	var sections [][]authToken
+	start := 0
+	for i, t := range tokens {
+		if t.kind == ';' {
+			sections = append(sections, tokens[start:i])
+			start = i + 1
+		}
+	}
+	sections = append(sections, tokens[start:])
+
+	id := withoutComments(sections[0])
+	if len(id) == 0 || len(id) > 2 || !id[0].isValue() {
+		return "", nil, ErrInvalidAuthResults
+	}
+
+	var results []*AuthResult
+	for _, s := range sections[1:] {
+		a, err := parseResinfo(s)
+		if err != nil {
+			return "", nil, err
+		}
+		if a != nil {
+			results = append(results, a)
+		}
+	}
+	return id[0].value, results, nil
+}
+
+// parseResinfo parses a single method clause. It returns nil for methods
+// other than "spf" and for "none".
+func parseResinfo(tokens []authToken) (*AuthResult, error) {
+	var comment string
+	if len(tokens) > 3 && tokens[3].kind == '(' {
+		comment = tokens[3].value
+	}
+
+	tokens = withoutComments(tokens)
+	switch {
+	case len(tokens) == 0:
+		return nil, nil // trailing ";"
+	case len(tokens) == 1 && strings.EqualFold(tokens[0].value, "none"):
+		return nil, nil
+	case len(tokens)%3 != 0:
+		return nil, ErrInvalidAuthResults
+	}
+
+	var (
+		a     = &AuthResult{Comment: comment}
+		isSPF bool
+	)
+	for i := 0; i < len(tokens); i += 3 {
+		key, eq, value := tokens[i], tokens[i+1], tokens[i+2]
+		if key.kind != 'w' || eq.kind != '=' || !value.isValue() {
+			return nil, ErrInvalidAuthResults
+		}
+		name := strings.ToLower(key.value)
+
+		if i == 0 {
+			// method [ "/" version ] "=" result
+			isSPF = strings.SplitN(name, "/", 2)[0] == "spf"
+			if isSPF {
+				if err := a.Result.UnmarshalText([]byte(strings.ToLower(value.value))); err != nil {
+					return nil, ErrInvalidAuthResults
+				}
+			}
+			continue
+		}
+
+		switch name {
+		case "reason":
+			a.Reason = value.value
+		case "smtp.mailfrom":
+			a.MailFrom = value.value
+		case "smtp.helo":
+			a.HELO = value.value
+		}
+	}
+
+	if !isSPF {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// authToken is a lexical token of Authentication-Results header field.
+type authToken struct {
+	kind  byte // 'w' for word, '"' for quoted-string, '(' for comment, ';' and '='
+	value string
+}
+
+func (t authToken) isValue() bool { return t.kind == 'w' || t.kind == '"' }
+
+func withoutComments(tokens []authToken) []authToken {
+	var r []authToken
+	for _, t := range tokens {
+		if t.kind != '(' {
+			r = append(r, t)
+		}
+	}
+	return r
+}
+
+// lexAuthResults splits s into tokens. Quoted strings and comments are
+// unescaped, nested comments are kept as a part of the enclosing comment.
+func lexAuthResults(s string) ([]authToken, error) {
+	var tokens []authToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == ';' || c == '=':
+			tokens = append(tokens, authToken{c, string(c)})
+			i++
+		case c == '"' || c == '(':
+			value, n, err := lexDelimited(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			if c == '"' && i+n < len(s) && s[i+n] == '@' {
+				// quoted local-part of an address is kept as it is
+				j := wordEnd(s, i+n)
+				tokens = append(tokens, authToken{'w', s[i:j]})
+				i = j
+				continue
+			}
+			tokens = append(tokens, authToken{c, value})
+			i += n
+		default:
+			j := wordEnd(s, i)
+			tokens = append(tokens, authToken{'w', s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// wordEnd returns index of the end of the word starting at s[i].
+func wordEnd(s string, i int) int {
+	for i < len(s) && strings.IndexByte(" \t\r\n;=\"(", s[i]) < 0 {
+		i++
+	}
+	return i
+}
+
+// lexDelimited reads quoted-string or comment from the beginning of s and
+// returns its unescaped content and the length read.
+func lexDelimited(s string) (string, int, error) {
+	var (
+		b     bytes.Buffer
+		depth int
+	)
+	open, end := s[0], byte('"')
+	if open == '(' {
+		end = ')'
+	}
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case c == '\r' || c == '\n':
+			// unfolding
+		case c == '(' && open == '(':
+			depth++
+			b.WriteByte(c)
+		case c == end && depth > 0:
+			depth--
+			b.WriteByte(c)
+		case c == end:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, ErrInvalidAuthResults
+}
@@ -0,0 +1,95 @@
+package spf
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAuthResultString(t *testing.T) {
+	samples := []struct {
+		a    AuthResult
+		want string
+	}{
+		{AuthResult{Result: None}, "spf=none"},
+		{AuthResult{Result: Pass, MailFrom: "user@example.com"},
+			"spf=pass smtp.mailfrom=user@example.com"},
+		{AuthResult{Result: Fail, Comment: "not (really) allowed", Reason: "matched -all",
+			MailFrom: `"john doe"@example.com`, HELO: "mail.example.com"},
+			`spf=fail (not \(really\) allowed) reason="matched -all" smtp.mailfrom="\"john doe\"@example.com" smtp.helo=mail.example.com`},
+	}
+
+	for i, s := range samples {
+		if got := s.a.String(); got != s.want {
+			t.Errorf("#%d want %q, got %q", i, s.want, got)
+		}
+	}
+}
+
+func TestNewAuthResult(t *testing.T) {
+	a := NewAuthResult(&Evaluation{Result: Pass}, nil, net.IP{192, 0, 2, 1}, "mail.example.com", "user@example.com", "mx.example.org")
+	want := "spf=pass (mx.example.org: domain of user@example.com designates 192.0.2.1 as permitted sender) " +
+		"smtp.mailfrom=user@example.com smtp.helo=mail.example.com"
+	if got := a.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// the reason is the error, or the mechanism if there's none
+	for _, s := range []struct {
+		e      Evaluation
+		err    error
+		reason string
+	}{
+		{Evaluation{Result: Permerror}, ErrDNSLimitExceeded, "limit exceeded"},
+		{Evaluation{Result: Temperror, Mechanism: "a:example.com"}, ErrDNSTemperror, "temporary DNS error"},
+		{Evaluation{Result: Permerror, Mechanism: "include:example.com"}, nil, "include:example.com"},
+		{Evaluation{Result: Fail, Mechanism: "-all"}, ErrDNSTemperror, ""},
+	} {
+		a := NewAuthResult(&s.e, s.err, net.IP{192, 0, 2, 1}, "mail.example.com", "user@example.com", "")
+		if a.Reason != s.reason {
+			t.Errorf("%v, %v: want reason %q, got %q", s.e.Result, s.err, s.reason, a.Reason)
+		}
+	}
+}
+
+func TestParseAuthResults(t *testing.T) {
+	samples := []struct {
+		field   string
+		id      string
+		results []*AuthResult
+		err     error
+	}{
+		{"example.org; none", "example.org", nil, nil},
+		{"Authentication-Results: example.org 1; spf=pass smtp.mailfrom=user@example.com",
+			"example.org", []*AuthResult{{Result: Pass, MailFrom: "user@example.com"}}, nil},
+		{"example.org;\r\n\tdkim=pass header.d=example.com;\r\n\tspf=fail (sender not\r\n\tauthorized) reason=\"bad; ip\" smtp.mailfrom=\"john doe\"@example.com",
+			"example.org", []*AuthResult{{Result: Fail, Comment: "sender not\tauthorized", Reason: "bad; ip", MailFrom: `"john doe"@example.com`}}, nil},
+		{"example.org; SPF/1=SoftFail (a (nested) comment) smtp.helo=mail.example.com (helo); spf=neutral;",
+			"example.org", []*AuthResult{
+				{Result: Softfail, Comment: "a (nested) comment", HELO: "mail.example.com"},
+				{Result: Neutral},
+			}, nil},
+		{"(comment) example.org (more); arc=none", "example.org", nil, nil},
+		{"", "", nil, ErrInvalidAuthResults},
+		{"example.org; spf=hardfail", "", nil, ErrInvalidAuthResults},
+		{"example.org; spf=pass smtp.mailfrom", "", nil, ErrInvalidAuthResults},
+		{"example.org; spf=pass (unterminated", "", nil, ErrInvalidAuthResults},
+		{`example.org; spf=pass smtp.mailfrom="unterminated`, "", nil, ErrInvalidAuthResults},
+	}
+
+	for i, s := range samples {
+		id, results, err := ParseAuthResults(s.field)
+		if id != s.id || !reflect.DeepEqual(results, s.results) || err != s.err {
+			t.Errorf("#%d want [%q %+v %v], got [%q %+v %v]", i, s.id, s.results, s.err, id, results, err)
+		}
+	}
+}
+
+func TestAuthResultRoundTrip(t *testing.T) {
+	a := &AuthResult{Result: Temperror, Comment: "lookup (timeout)", Reason: "DNS \"error\"",
+		MailFrom: `"a b"@example.com`, HELO: "mail.example.com"}
+	_, results, err := ParseAuthResults("example.org; " + a.String())
+	if err != nil || len(results) != 1 || !reflect.DeepEqual(results[0], a) {
+		t.Errorf("want %+v, got %+v, %v", a, results, err)
+	}
+}
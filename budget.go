@@ -0,0 +1,286 @@
+package spf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Budget is the worst-case DNS lookup budget of SPF policy, that is the
+// number of lookups done by the evaluation if no mechanism matches and
+// therefore every reachable term is evaluated. See AnalyzeLookups.
+// Budget can be marshaled by encoding/json.
+type Budget struct {
+	// Lookups is the total number of terms causing DNS lookups, the
+	// initial lookup of the SPF record is not counted.
+	Lookups int `json:"lookups"`
+	// VoidLookups is the total number of lookups returning no address or
+	// NXDOMAIN, as counted by LimitedResolver.
+	VoidLookups int `json:"void_lookups"`
+
+	LookupLimit     int `json:"lookup_limit"`
+	VoidLookupLimit int `json:"void_lookup_limit"`
+	MXQueriesLimit  int `json:"mx_queries_limit"`
+
+	Root *BudgetNode `json:"root"` // the analyzed domain
+}
+
+// Exceeded reports whether the evaluation may exceed any of the limits, that
+// is the number of lookups or void lookups, the number of addresses of an
+// "mx" mechanism, or there's an "include" or "redirect" loop.
+func (b *Budget) Exceeded() bool {
+	return b.Lookups > b.LookupLimit || b.VoidLookups > b.VoidLookupLimit || b.Root.exceeded(b.MXQueriesLimit)
+}
+
+// String renders the tree of lookups followed by the totals.
+func (b *Budget) String() string {
+	return fmt.Sprintf("%slookups: %d/%d, void lookups: %d/%d\n",
+		b.Root, b.Lookups, b.LookupLimit, b.VoidLookups, b.VoidLookupLimit)
+}
+
+// BudgetNode is a term causing a DNS lookup. "include" and "redirect" terms
+// have children, which are the terms of the referenced record.
+type BudgetNode struct {
+	Domain string `json:"domain"`         // domain of the record the term belongs to
+	Term   string `json:"term,omitempty"` // empty for the root
+	// Record is SPF record of the root, "include" and "redirect" nodes
+	Record string `json:"record,omitempty"`
+	// Lookups and VoidLookups are the numbers of lookups of the term and
+	// its children
+	Lookups     int `json:"lookups"`
+	VoidLookups int `json:"void_lookups"`
+	// Addresses is the number of addresses of "a" and "mx" mechanisms
+	Addresses int `json:"addresses,omitempty"`
+	// Note tells why the term was not resolved, e.g. it contains macros,
+	// which depend on the client IP or the sender
+	Note     string        `json:"note,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Children []*BudgetNode `json:"children,omitempty"`
+
+	loop bool
+	mx   bool
+}
+
+func (n *BudgetNode) exceeded(mxQueriesLimit int) bool {
+	if n.loop || n.mx && n.Addresses > mxQueriesLimit {
+		return true
+	}
+	for _, c := range n.Children {
+		if c.exceeded(mxQueriesLimit) {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders the node and its children as an indented tree.
+func (n *BudgetNode) String() string {
+	var b bytes.Buffer
+	n.write(&b, 0)
+	return b.String()
+}
+
+func (n *BudgetNode) write(b *bytes.Buffer, depth int) {
+	b.WriteString(strings.Repeat("  ", depth))
+	if n.Term == "" {
+		b.WriteString(n.Domain)
+	} else {
+		b.WriteString(n.Term)
+	}
+	details := []string{plural(n.Lookups, "lookup")}
+	if n.VoidLookups > 0 {
+		details = append(details, fmt.Sprintf("%d void", n.VoidLookups))
+	}
+	if n.Addresses > 0 {
+		details = append(details, plural(n.Addresses, "address"))
+	}
+	if n.Note != "" {
+		details = append(details, n.Note)
+	}
+	if n.Error != "" {
+		details = append(details, "error: "+n.Error)
+	}
+	fmt.Fprintf(b, " (%s)\n", strings.Join(details, ", "))
+	for _, c := range n.Children {
+		c.write(b, depth+1)
+	}
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	if strings.HasSuffix(noun, "s") {
+		return fmt.Sprintf("%d %ses", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// AnalyzeLookups returns the worst-case DNS lookup budget of SPF policy of
+// domain, see Checker.AnalyzeLookups.
+func AnalyzeLookups(domain string, opts ...Option) (*Budget, error) {
+	return NewChecker(opts...).AnalyzeLookups(context.Background(), domain)
+}
+
+// AnalyzeLookups resolves SPF record of domain and every term causing a DNS
+// lookup reachable from it, that is "include", "a", "mx", "ptr" and "exists"
+// mechanisms and "redirect" modifier, and returns the budget of the lookups
+// along with the configured limits. No client IP is needed, as every branch
+// is explored. The configured resolver is used with no limits.
+//
+// Terms with macros and "ptr" depend on the evaluated client IP or sender,
+// they are counted as a single lookup each, but not resolved. Records which
+// are referenced multiple times are looked up once.
+//
+// The returned error is not nil if the record of domain itself could not be
+// looked up.
+func (c *Checker) AnalyzeLookups(ctx context.Context, domain string) (*Budget, error) {
+	a := &analyzer{
+		resolver: &boundResolver{ctx: ctx, resolver: AdaptResolver(c.cfg.resolver)},
+		nodes:    make(map[string]*BudgetNode),
+		path:     make(map[string]bool),
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	record, err := lookupSPF(a.resolver, domain)
+	if err != nil {
+		return nil, err
+	}
+	root := &BudgetNode{Domain: domain, Record: record}
+	a.walk(root, domain, record)
+	return &Budget{
+		Lookups:         root.Lookups,
+		VoidLookups:     root.VoidLookups,
+		LookupLimit:     int(c.cfg.lookupLimit),
+		VoidLookupLimit: int(c.cfg.voidLookupLimit),
+		MXQueriesLimit:  int(c.cfg.mxQueriesLimit),
+		Root:            root,
+	}, nil
+}
+
+type analyzer struct {
+	resolver Resolver
+	nodes    map[string]*BudgetNode // "include" and "redirect" targets walked
+	path     map[string]bool        // domains being walked
+}
+
+// walk adds terms of the record of domain as children of n.
+func (a *analyzer) walk(n *BudgetNode, domain, record string) {
+	a.path[domain] = true
+	defer delete(a.path, domain)
+
+	r, err := Parse(record)
+	if err != nil {
+		n.Error = err.Error()
+		return
+	}
+
+	var terms []Term
+	for _, m := range r.Mechanisms() {
+		terms = append(terms, m)
+	}
+	if m := r.Redirect(); m != nil && !r.hasAll() {
+		terms = append(terms, m)
+	}
+
+	for _, t := range terms {
+		var child *BudgetNode
+		switch t := t.(type) {
+		case *Mechanism:
+			if !isLookupMechanism(t.Name) {
+				continue
+			}
+			child = a.mechanism(domain, t)
+		case *Modifier:
+			child = a.record(domain, t.String(), t.Value)
+		}
+		n.Lookups += child.Lookups
+		n.VoidLookups += child.VoidLookups
+		n.Children = append(n.Children, child)
+	}
+}
+
+// mechanism returns node of the mechanism m of domain's record.
+func (a *analyzer) mechanism(domain string, m *Mechanism) *BudgetNode {
+	if m.Name == "include" {
+		return a.record(domain, m.String(), m.Domain)
+	}
+
+	n := &BudgetNode{Domain: domain, Term: m.String(), Lookups: 1}
+	target := m.Domain
+	if target == "" {
+		target = domain
+	}
+	if m.Name == "ptr" {
+		n.Note = "depends on client IP"
+		return n
+	}
+	if strings.Contains(target, "%") {
+		n.Note = "depends on macros"
+		return n
+	}
+
+	// the matcher may be called concurrently, e.g. for each MX host
+	var addresses int32
+	counter := func(net.IP) (bool, error) {
+		atomic.AddInt32(&addresses, 1)
+		return false, nil
+	}
+	var (
+		found bool
+		err   error
+	)
+	switch m.Name {
+	case "a":
+		_, err = a.resolver.MatchIP(NormalizeFQDN(target), counter)
+		n.Addresses = int(atomic.LoadInt32(&addresses))
+		found = n.Addresses > 0
+	case "mx":
+		n.mx = true
+		_, err = a.resolver.MatchMX(NormalizeFQDN(target), counter)
+		n.Addresses = int(atomic.LoadInt32(&addresses))
+		found = n.Addresses > 0
+	case "exists":
+		found, err = a.resolver.Exists(NormalizeFQDN(target))
+	}
+	switch {
+	case err == ErrDNSPermerror, err == nil && !found:
+		n.VoidLookups = 1
+	case err != nil:
+		n.Error = err.Error()
+	}
+	return n
+}
+
+// record returns node of "include" or "redirect" term of domain's record,
+// which references the record of target.
+func (a *analyzer) record(domain, term, target string) *BudgetNode {
+	n := &BudgetNode{Domain: domain, Term: term, Lookups: 1}
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	if strings.Contains(target, "%") {
+		n.Note = "depends on macros"
+		return n
+	}
+	if a.path[target] {
+		n.Error, n.loop = "loop", true
+		return n
+	}
+	if walked, ok := a.nodes[target]; ok {
+		n.Record, n.Children = walked.Record, walked.Children
+		n.Lookups, n.VoidLookups, n.Error = walked.Lookups, walked.VoidLookups, walked.Error
+		n.loop = walked.loop
+		return n
+	}
+
+	record, err := lookupSPF(a.resolver, target)
+	if err != nil {
+		n.Error = err.Error()
+	} else {
+		n.Record = record
+		a.walk(n, target, record)
+	}
+	a.nodes[target] = n
+	return n
+}
@@ -0,0 +1,106 @@
+package spf
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnalyzeLookups(t *testing.T) {
+	dns.HandleFunc("budget.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`budget.test. 0 IN TXT "v=spf1 ip4:10.0.0.1 a mx include:inc.budget.test exists:%{i}.budget.test redirect=red.budget.test"`,
+			`inc.budget.test. 0 IN TXT "v=spf1 a:void.budget.test include:shared.budget.test ptr ~all"`,
+			`red.budget.test. 0 IN TXT "v=spf1 include:shared.budget.test exists:host.budget.test -all redirect=ignored.budget.test"`,
+			`shared.budget.test. 0 IN TXT "v=spf1 mx:mail.budget.test ?all"`,
+		},
+		dns.TypeA: {
+			"budget.test. 0 IN A 10.0.0.2",
+			"mx1.budget.test. 0 IN A 10.0.1.1",
+			"mx1.budget.test. 0 IN A 10.0.1.2",
+			"mx2.budget.test. 0 IN A 10.0.2.1",
+			"host.budget.test. 0 IN A 127.0.0.2",
+		},
+		dns.TypeMX: {
+			"budget.test. 0 IN MX 10 mx1.budget.test.",
+			"mail.budget.test. 0 IN MX 10 mx1.budget.test.",
+			"mail.budget.test. 0 IN MX 20 mx2.budget.test.",
+		},
+	}))
+	defer dns.HandleRemove("budget.test.")
+
+	b, err := NewChecker(WithResolver(testResolver)).AnalyzeLookups(context.Background(), "budget.test.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `budget.test (12 lookups, 1 void)
+  a (1 lookup, 1 address)
+  mx (1 lookup, 2 addresses)
+  include:inc.budget.test (5 lookups, 1 void)
+    a:void.budget.test (1 lookup, 1 void)
+    include:shared.budget.test (2 lookups)
+      mx:mail.budget.test (1 lookup, 3 addresses)
+    ptr (1 lookup, depends on client IP)
+  exists:%{i}.budget.test (1 lookup, depends on macros)
+  redirect=red.budget.test (4 lookups)
+    include:shared.budget.test (2 lookups)
+      mx:mail.budget.test (1 lookup, 3 addresses)
+    exists:host.budget.test (1 lookup)
+lookups: 12/10, void lookups: 1/2
+`
+	if s := b.String(); s != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, s)
+	}
+	if !b.Exceeded() {
+		t.Error("expected lookup limit to be exceeded")
+	}
+
+	// MX address limit
+	b, err = NewChecker(WithResolver(testResolver), WithLookupLimit(20), WithMXQueriesLimit(2)).AnalyzeLookups(context.Background(), "shared.budget.test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Lookups != 1 || !b.Exceeded() {
+		t.Errorf("expected MX queries limit to be exceeded: %s", b)
+	}
+
+	if _, err := json.Marshal(b); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAnalyzeLookupsErrors(t *testing.T) {
+	dns.HandleFunc("budget-err.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`budget-err.test. 0 IN TXT "v=spf1 include:loop.budget-err.test include:missing.budget-err.test include:bad.budget-err.test -all"`,
+			`loop.budget-err.test. 0 IN TXT "v=spf1 include:budget-err.test -all"`,
+			`bad.budget-err.test. 0 IN TXT "v=spf1 foo -all"`,
+		},
+	}))
+	defer dns.HandleRemove("budget-err.test.")
+
+	b, err := AnalyzeLookups("budget-err.test", WithResolver(testResolver))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `budget-err.test (4 lookups)
+  include:loop.budget-err.test (2 lookups)
+    include:budget-err.test (1 lookup, error: loop)
+  include:missing.budget-err.test (1 lookup, error: SPF record not found)
+  include:bad.budget-err.test (1 lookup, error: syntax error at offset 7 ("foo"): unknown mechanism "foo")
+lookups: 4/10, void lookups: 0/2
+`
+	if s := b.String(); s != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, s)
+	}
+	if !b.Exceeded() {
+		t.Error("expected loop to exceed the limits")
+	}
+
+	if _, err := AnalyzeLookups("missing.budget-err.test", WithResolver(testResolver)); err != ErrSPFNotFound {
+		t.Errorf("expected %v, got %v", ErrSPFNotFound, err)
+	}
+}
@@ -0,0 +1,231 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// txtStringLength is the maximum length of a single character-string of TXT
+// record, see RFC 7208, section 3.3.
+const txtStringLength = 255
+
+// Builder builds SPF records term by term, e.g.
+//
+//	r, err := spf.NewBuilder().
+//		MX(spf.QualifierPass, "", -1, -1).
+//		IP(spf.QualifierPass, network).
+//		Include(spf.QualifierPass, "_spf.example.net").
+//		All(spf.QualifierFail).
+//		Build()
+//
+// Zero Qualifier is the same as QualifierPass. Terms are validated by Build.
+type Builder struct {
+	terms []Term
+}
+
+// NewBuilder returns Builder of an empty record.
+func NewBuilder() *Builder { return &Builder{} }
+
+// All adds "all" mechanism.
+func (b *Builder) All(q Qualifier) *Builder {
+	return b.mechanism(q, "all", "", nil, -1, -1)
+}
+
+// Include adds "include" mechanism.
+func (b *Builder) Include(q Qualifier, domain string) *Builder {
+	return b.mechanism(q, "include", domain, nil, -1, -1)
+}
+
+// A adds "a" mechanism. Empty domain stands for the evaluated domain,
+// negative lengths are omitted.
+func (b *Builder) A(q Qualifier, domain string, cidr4, cidr6 int) *Builder {
+	return b.mechanism(q, "a", domain, nil, cidr4, cidr6)
+}
+
+// MX adds "mx" mechanism. Empty domain stands for the evaluated domain,
+// negative lengths are omitted.
+func (b *Builder) MX(q Qualifier, domain string, cidr4, cidr6 int) *Builder {
+	return b.mechanism(q, "mx", domain, nil, cidr4, cidr6)
+}
+
+// PTR adds "ptr" mechanism. Note, that its use is discouraged by RFC 7208,
+// section 5.5.
+func (b *Builder) PTR(q Qualifier, domain string) *Builder {
+	return b.mechanism(q, "ptr", domain, nil, -1, -1)
+}
+
+// IP adds "ip4" or "ip6" mechanism, depending on the address family of n.
+// IPv4-mapped IPv6 networks with 128-bit masks of at least 96 ones are added
+// as "ip4" ones. Nil mask of n stands for a single address.
+func (b *Builder) IP(q Qualifier, n *net.IPNet) *Builder {
+	ones, bits := n.Mask.Size()
+	if n.Mask == nil {
+		ones = -1
+	}
+	if ip := n.IP.To4(); ip != nil {
+		switch {
+		case n.Mask == nil, bits == 8*net.IPv4len:
+			return b.mechanism(q, "ip4", "", ip, ones, -1)
+		case bits == 8*net.IPv6len && ones >= 8*(net.IPv6len-net.IPv4len):
+			return b.mechanism(q, "ip4", "", ip, ones-8*(net.IPv6len-net.IPv4len), -1)
+		}
+	}
+	return b.mechanism(q, "ip6", "", n.IP, -1, ones)
+}
+
+// Exists adds "exists" mechanism.
+func (b *Builder) Exists(q Qualifier, domain string) *Builder {
+	return b.mechanism(q, "exists", domain, nil, -1, -1)
+}
+
+// Redirect adds "redirect" modifier.
+func (b *Builder) Redirect(domain string) *Builder { return b.Modifier("redirect", domain) }
+
+// Exp adds "exp" modifier.
+func (b *Builder) Exp(domain string) *Builder { return b.Modifier("exp", domain) }
+
+// Modifier adds a modifier, "redirect", "exp" or an unknown one.
+func (b *Builder) Modifier(name, value string) *Builder {
+	return b.Add(&Modifier{Name: name, Value: value})
+}
+
+// Add adds terms, e.g. terms of a parsed record.
+func (b *Builder) Add(terms ...Term) *Builder {
+	b.terms = append(b.terms, terms...)
+	return b
+}
+
+func (b *Builder) mechanism(q Qualifier, name, domain string, ip net.IP, cidr4, cidr6 int) *Builder {
+	return b.Add(&Mechanism{Qualifier: q, Name: name, Domain: domain, IP: ip, CIDR4: cidr4, CIDR6: cidr6})
+}
+
+// Build returns the record of the added terms in the canonical form:
+//
+//   - "+" qualifiers are omitted
+//   - host bits of "ip4" and "ip6" networks are cleared
+//   - default CIDR lengths (32 and 128) are omitted
+//
+// The record is checked as it would be by Parse. Moreover, no mechanism may
+// follow "all" and "redirect" may not be used along with "all", since such
+// terms are never evaluated. Errors are reported as *ParseError, with offsets
+// relative to the canonical text of the record.
+func (b *Builder) Build() (*Record, error) {
+	r := &Record{}
+	for _, t := range b.terms {
+		r.Terms = append(r.Terms, canonicalTerm(t))
+	}
+
+	text := r.String()
+	// whitespace would split the term into several ones
+	offset := len("v=spf1 ")
+	for _, t := range r.Terms {
+		s := t.String()
+		if i := strings.IndexAny(s, " \t\r\n"); i >= 0 {
+			return nil, &ParseError{offset + i, s, "unexpected whitespace"}
+		}
+		offset += len(s) + 1
+	}
+
+	parsed, err := Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var all *Mechanism
+	for _, t := range parsed.Terms {
+		switch t := t.(type) {
+		case *Mechanism:
+			if all != nil {
+				return nil, &ParseError{t.pos, t.String(), `mechanism following "all" is never evaluated`}
+			}
+			if t.Name == "all" {
+				all = t
+			}
+		case *Modifier:
+			// RFC 7208, section 6.1:
+			// If all mechanisms fail to match, and a "redirect" modifier is
+			// present, then processing proceeds as follows. [...] Any
+			// "redirect" modifier MUST be ignored if there is an "all"
+			// mechanism anywhere in the record.
+			if t.Name == "redirect" && parsed.hasAll() {
+				return nil, &ParseError{t.pos, t.String(), `"redirect" is ignored along with "all"`}
+			}
+		}
+	}
+	return parsed, nil
+}
+
+func (r *Record) hasAll() bool {
+	for _, m := range r.Mechanisms() {
+		if m.Name == "all" {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalTerm returns a copy of t in the canonical form, see Builder.Build.
+func canonicalTerm(t Term) Term {
+	switch t := t.(type) {
+	case *Mechanism:
+		m := *t
+		m.Name = strings.ToLower(m.Name)
+		if m.Qualifier == 0 {
+			m.Qualifier = QualifierPass
+		}
+		switch m.Name {
+		case "ip4":
+			if n := m.Network(); n != nil && m.IP.To4() != nil {
+				m.IP = n.IP.To4()
+			}
+		case "ip6":
+			if n := m.Network(); n != nil && len(m.IP) == net.IPv6len {
+				m.IP = n.IP
+			}
+		}
+		if m.CIDR4 == 8*net.IPv4len || m.CIDR4 < 0 {
+			m.CIDR4 = -1
+		}
+		if m.CIDR6 == 8*net.IPv6len || m.CIDR6 < 0 {
+			m.CIDR6 = -1
+		}
+		return &m
+	case *Modifier:
+		m := *t
+		m.Name = strings.ToLower(m.Name)
+		return &m
+	default:
+		return t
+	}
+}
+
+// TXT returns the record split into character-strings of TXT record, none of
+// them longer than 255 bytes. Strings are split after a space where
+// possible. Note, that the strings are concatenated with no spaces by the
+// evaluation, see RFC 7208, section 3.3.
+func (r *Record) TXT() []string { return splitTXT(r.String(), txtStringLength) }
+
+func splitTXT(s string, length int) []string {
+	var strs []string
+	for len(s) > length {
+		i := strings.LastIndexByte(s[:length], ' ') + 1
+		if i == 0 {
+			i = length
+		}
+		strs = append(strs, s[:i])
+		s = s[i:]
+	}
+	return append(strs, s)
+}
+
+// Zone returns the record in the presentation format of TXT record data,
+// that is quoted character-strings separated by spaces, e.g.
+// "v=spf1 mx -all".
+func (r *Record) Zone() string {
+	strs := r.TXT()
+	for i, s := range strs {
+		strs[i] = fmt.Sprintf("%q", s)
+	}
+	return strings.Join(strs, " ")
+}
@@ -0,0 +1,149 @@
+package spf
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	_, n4, _ := net.ParseCIDR("192.0.2.0/24")
+	_, n6, _ := net.ParseCIDR("2001:db8::/32")
+
+	r, err := NewBuilder().
+		MX(0, "", -1, -1).
+		A(QualifierPass, "mail.example.com", 32, 64).
+		IP(QualifierPass, n4).
+		IP(QualifierSoftfail, n6).
+		IP(QualifierPass, &net.IPNet{IP: net.IP{192, 0, 2, 10}, Mask: net.CIDRMask(32, 32)}).
+		IP(QualifierPass, &net.IPNet{IP: net.ParseIP("2001:db8::1")}).
+		IP(QualifierPass, &net.IPNet{IP: net.ParseIP("198.51.100.7"), Mask: net.CIDRMask(16, 32)}).
+		Include(QualifierNeutral, "_spf.example.net").
+		Exists(QualifierPass, "%{i}._spf.%{d}").
+		Exp("exp.example.com").
+		Modifier("X-Vendor", "1").
+		All(QualifierFail).
+		Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "v=spf1 mx a:mail.example.com//64 ip4:192.0.2.0/24 ~ip6:2001:db8::/32 ip4:192.0.2.10 ip6:2001:db8::1 ip4:198.51.0.0/16 ?include:_spf.example.net exists:%{i}._spf.%{d} exp=exp.example.com x-vendor=1 -all"
+	if s := r.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+
+	// built record is the same as the parsed one
+	parsed, err := Parse(expected)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(r, parsed) {
+		t.Errorf("expected %v, got %v", parsed, r)
+	}
+}
+
+func TestBuilderIPv4Mapped(t *testing.T) {
+	_, mapped, _ := net.ParseCIDR("::ffff:192.0.2.0/120")
+	r, err := NewBuilder().
+		IP(QualifierPass, mapped).
+		IP(QualifierPass, &net.IPNet{IP: net.ParseIP("198.51.100.7"), Mask: net.CIDRMask(128, 128)}).
+		Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.7"
+	if s := r.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+}
+
+func TestBuilderCanonical(t *testing.T) {
+	// parsed terms are normalized too
+	parsed, err := Parse("v=spf1 +a/32//128 ip4:192.0.2.1/24 ip6:2001:db8::1/64 +mx:example.com/24 ?all")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := NewBuilder().Add(parsed.Terms...).Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "v=spf1 a ip4:192.0.2.0/24 ip6:2001:db8::/64 mx:example.com/24 ?all"
+	if s := r.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+	// the parsed record is not modified
+	if s := parsed.Terms[1].String(); s != "ip4:192.0.2.1/24" {
+		t.Errorf("parsed record was modified: %q", s)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	tests := []struct {
+		builder *Builder
+		offset  int
+		term    string
+	}{
+		{NewBuilder().Include(QualifierPass, ""), 14, "include"},
+		{NewBuilder().Include(QualifierPass, "%{z}"), 15, "include:%{z}"},
+		{NewBuilder().A(QualifierPass, "", 33, -1), 9, "a/33"},
+		{NewBuilder().A(QualifierPass, "example.com ip4:0.0.0.0/0", -1, -1), 20, "a:example.com ip4:0.0.0.0/0"},
+		{NewBuilder().Redirect("a.example.com").Redirect("b.example.com"), 30, "redirect=b.example.com"},
+		{NewBuilder().Exp("a.example.com").Exp("b.example.com"), 25, "exp=b.example.com"},
+		{NewBuilder().Modifier("1x", "y"), 7, "1x=y"},
+		{NewBuilder().All(QualifierFail).MX(QualifierPass, "", -1, -1), 12, "mx"},
+		{NewBuilder().All(QualifierFail).All(QualifierPass), 12, "all"},
+		{NewBuilder().Redirect("_spf.example.com").All(QualifierFail), 7, "redirect=_spf.example.com"},
+		{NewBuilder().Add(&Mechanism{Qualifier: QualifierPass, Name: "ip6", IP: net.IP{192, 0, 2, 1}, CIDR4: -1, CIDR6: -1}), 11, "ip6:192.0.2.1"},
+	}
+	for _, test := range tests {
+		_, err := test.builder.Build()
+		e, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%v: expected *ParseError, got %v", test.term, err)
+			continue
+		}
+		if e.Offset != test.offset || e.Term != test.term {
+			t.Errorf("expected error at %d (%q), got %v", test.offset, test.term, e)
+		}
+	}
+}
+
+func TestRecordTXT(t *testing.T) {
+	b := NewBuilder()
+	for i := 0; i < 40; i++ {
+		b.Include(QualifierPass, "_spf"+strings.Repeat("x", i%3)+".example.com")
+	}
+	r, err := b.All(QualifierFail).Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	strs := r.TXT()
+	if len(strs) < 2 {
+		t.Fatalf("expected record to be split, got %q", strs)
+	}
+	for _, s := range strs {
+		if len(s) > 255 {
+			t.Errorf("string is longer than 255 bytes: %q", s)
+		}
+	}
+	for _, s := range strs[:len(strs)-1] {
+		if !strings.HasSuffix(s, " ") {
+			t.Errorf("expected the string to be split after a space: %q", s)
+		}
+	}
+	if s := strings.Join(strs, ""); s != r.String() {
+		t.Errorf("expected %q, got %q", r.String(), s)
+	}
+
+	if s := splitTXT(strings.Repeat("x", 300), 255); len(s) != 2 || len(s[0]) != 255 || len(s[1]) != 45 {
+		t.Errorf("unexpected split of a long term: %q", s)
+	}
+
+	r, _ = Parse("v=spf1 mx -all")
+	if s := r.Zone(); s != `"v=spf1 mx -all"` {
+		t.Errorf("unexpected zone format: %s", s)
+	}
+}
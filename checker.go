@@ -0,0 +1,67 @@
+package spf
+
+import (
+	"context"
+	"net"
+)
+
+// Checker evaluates SPF policies with parameters set once by options.
+// Each check gets its own fresh accounting of DNS lookup limits, so a single
+// Checker is safe for concurrent use by multiple goroutines.
+type Checker struct {
+	cfg *config
+}
+
+// NewChecker returns a Checker configured by opts.
+// See Option for available parameters and their defaults.
+func NewChecker(opts ...Option) *Checker {
+	return &Checker{cfg: newConfig(opts)}
+}
+
+// CheckHost evaluates SPF policy of the domain for the given client IP and
+// sender, see CheckHost function for the details.
+func (c *Checker) CheckHost(ip net.IP, domain, sender string) (Result, string, error) {
+	return c.CheckHostContext(context.Background(), ip, domain, sender)
+}
+
+// CheckHostContext is CheckHost, which stops the evaluation with Temperror
+// result once ctx is done. In such case the returned error is ctx.Err().
+func (c *Checker) CheckHostContext(ctx context.Context, ip net.IP, domain, sender string) (Result, string, error) {
+	e, err := c.Evaluate(ctx, ip, domain, sender)
+	return e.Result, e.Explanation, err
+}
+
+// Evaluate works like CheckHostContext but returns the detailed result.
+func (c *Checker) Evaluate(ctx context.Context, ip net.IP, domain, sender string) (*Evaluation, error) {
+	return evaluate(ctx, ip, domain, sender, c.resolver(), c.cfg, nil)
+}
+
+// Trace evaluates SPF policy like CheckHostContext does and records each
+// evaluated term, DNS lookup and recursive evaluation into the returned
+// Trace, which also holds the result and explanation. The returned error is
+// the one CheckHostContext would return.
+// Tracing has its overhead, so it's meant for debugging of SPF policies
+// rather than for processing of each message.
+func (c *Checker) Trace(ctx context.Context, ip net.IP, domain, sender string) (*Trace, error) {
+	trace := &Trace{Domain: domain, tracer: &tracer{}}
+	_, err := evaluate(ctx, ip, domain, sender, c.resolver(), c.cfg, trace)
+	return trace, err
+}
+
+// evaluate evaluates SPF policy with helo used as the value of "h" macro.
+func (c *Checker) evaluate(ctx context.Context, ip net.IP, domain, sender, helo string) (*Evaluation, error) {
+	cfg := *c.cfg
+	cfg.helo = helo
+	return evaluate(ctx, ip, domain, sender, c.resolver(), &cfg, nil)
+}
+
+// resolver returns a new LimitedResolver wrapping configured resolver, so
+// limits are accounted separately for each evaluation.
+func (c *Checker) resolver() ResolverContext {
+	return c.limitedResolver()
+}
+
+func (c *Checker) limitedResolver() *LimitedResolver {
+	return NewLimitedResolverWithVoidLimit(c.cfg.resolver,
+		c.cfg.lookupLimit, c.cfg.mxQueriesLimit, c.cfg.voidLookupLimit).(*LimitedResolver)
+}
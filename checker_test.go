@@ -0,0 +1,89 @@
+package spf
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestChecker(t *testing.T) {
+	dns.HandleFunc("checker.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`checker.test. 0 IN TXT "v=spf1 a:a.checker.test a:void.checker.test ip4:10.0.0.1 -all exp=exp.checker.test"`,
+			`exp.checker.test. 0 IN TXT "%{c} rejected by %{r} at %{t}"`,
+		},
+		dns.TypeA: {
+			"a.checker.test. 0 IN A 10.0.0.10",
+		},
+	}))
+	defer dns.HandleRemove("checker.test.")
+
+	clock := func() time.Time { return time.Unix(1500000000, 0) }
+
+	samples := []struct {
+		opts []Option
+		ip   net.IP
+		r    Result
+		exp  string
+	}{
+		{nil, net.IP{10, 0, 0, 1}, Pass, ""},
+		{nil, net.IP{10, 0, 0, 10}, Pass, ""},
+		{nil, net.IP{10, 0, 0, 2}, Fail, "10.0.0.2 rejected by unknown at 1500000000"},
+		{[]Option{WithReceivingFQDN("mx.example.org")}, net.IP{10, 0, 0, 2}, Fail,
+			"10.0.0.2 rejected by mx.example.org at 1500000000"},
+		{[]Option{WithExplanation(false)}, net.IP{10, 0, 0, 2}, Fail, ""},
+		// TXT, "a", "a" and "exp" lookups
+		{[]Option{WithLookupLimit(5)}, net.IP{10, 0, 0, 2}, Fail,
+			"10.0.0.2 rejected by unknown at 1500000000"},
+		{[]Option{WithLookupLimit(4)}, net.IP{10, 0, 0, 2}, Fail, ""},
+		{[]Option{WithLookupLimit(3)}, net.IP{10, 0, 0, 1}, Permerror, ""},
+		{[]Option{WithVoidLookupLimit(0)}, net.IP{10, 0, 0, 1}, Permerror, ""},
+		{[]Option{WithMXQueriesLimit(0)}, net.IP{10, 0, 0, 1}, Pass, ""},
+	}
+
+	for i, s := range samples {
+		opts := append([]Option{WithResolver(testResolver), WithClock(clock)}, s.opts...)
+		r, exp, _ := NewChecker(opts...).CheckHost(s.ip, "checker.test", "checker.test")
+		if r != s.r || exp != s.exp {
+			t.Errorf("#%d want [`%v` %q], got [`%v` %q]", i, s.r, s.exp, r, exp)
+		}
+	}
+}
+
+func TestCheckerConcurrentUse(t *testing.T) {
+	dns.HandleFunc("checker.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`checker.test. 0 IN TXT "v=spf1 a:a.checker.test ip4:10.0.0.1 -all"`,
+		},
+		dns.TypeA: {
+			"a.checker.test. 0 IN A 10.0.0.10",
+		},
+	}))
+	defer dns.HandleRemove("checker.test.")
+
+	// Each check needs 2 lookups, so a shared limit would be exceeded
+	// after the first one.
+	c := NewChecker(WithResolver(testResolver), WithLookupLimit(3))
+
+	var wg sync.WaitGroup
+	results := make(chan Result, 20)
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, _, _ := c.CheckHost(net.IP{10, 0, 0, 1}, "checker.test", "checker.test")
+			results <- r
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	for r := range results {
+		if r != Pass {
+			t.Errorf("want `pass`, got `%v`", r)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package spf
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// Networks of all IPv4 and IPv6 addresses
+var (
+	allIPv4 = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)}
+	allIPv6 = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+)
+
+// normalizeNet returns n with host bits cleared, IPv4 network is returned
+// with 4-byte address and mask.
+func normalizeNet(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	if ip := n.IP.To4(); ip != nil && bits == 8*net.IPv4len {
+		mask := net.CIDRMask(ones, bits)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(ones, 8*net.IPv6len)
+	return &net.IPNet{IP: n.IP.To16().Mask(mask), Mask: mask}
+}
+
+// hostNet returns network of a single address, masked to cidr4 or cidr6
+// length depending on the family of ip. Negative length stands for the full
+// one.
+func hostNet(ip net.IP, cidr4, cidr6 int) *net.IPNet {
+	bits, ones := 8*net.IPv6len, cidr6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, ones = ip4, 8*net.IPv4len, cidr4
+	}
+	if ones < 0 {
+		ones = bits
+	}
+	mask := net.CIDRMask(ones, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// netContains reports whether network a contains network b. Both of them
+// need to be normalized.
+func netContains(a, b *net.IPNet) bool {
+	onesA, bitsA := a.Mask.Size()
+	onesB, bitsB := b.Mask.Size()
+	return bitsA == bitsB && onesA <= onesB && a.Contains(b.IP)
+}
+
+// splitNet returns both halves of normalized network n, which must not be
+// a single address.
+func splitNet(n *net.IPNet) (*net.IPNet, *net.IPNet) {
+	ones, bits := n.Mask.Size()
+	mask := net.CIDRMask(ones+1, bits)
+	hi := &net.IPNet{IP: make(net.IP, len(n.IP)), Mask: mask}
+	copy(hi.IP, n.IP)
+	hi.IP[ones/8] |= 0x80 >> uint(ones%8)
+	return &net.IPNet{IP: n.IP, Mask: mask}, hi
+}
+
+// subtractNets returns normalized networks covering addresses of a, which
+// are not in b.
+func subtractNets(a, b []*net.IPNet) []*net.IPNet {
+	result := a
+	for _, y := range b {
+		var r []*net.IPNet
+		for _, x := range result {
+			r = append(r, subtractNet(x, y)...)
+		}
+		result = r
+	}
+	return result
+}
+
+func subtractNet(x, y *net.IPNet) []*net.IPNet {
+	switch {
+	case netContains(y, x):
+		return nil
+	case !netContains(x, y):
+		return []*net.IPNet{x}
+	}
+	lo, hi := splitNet(x)
+	return append(subtractNet(lo, y), subtractNet(hi, y)...)
+}
+
+// aggregateNets returns the smallest sorted list of normalized networks
+// covering the same addresses as nets.
+func aggregateNets(nets []*net.IPNet) []*net.IPNet {
+	sorted := make([]*net.IPNet, 0, len(nets))
+	for _, n := range nets {
+		sorted = append(sorted, normalizeNet(n))
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if len(a.IP) != len(b.IP) {
+			return len(a.IP) < len(b.IP)
+		}
+		if c := bytes.Compare(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(a.Mask, b.Mask) < 0
+	})
+
+	// merge sibling networks into their parent until there's nothing to
+	// merge, sorting is kept
+	for merged := true; merged; {
+		merged = false
+		var r []*net.IPNet
+		for _, n := range sorted {
+			if len(r) > 0 && netContains(r[len(r)-1], n) {
+				continue
+			}
+			if len(r) > 0 && isSibling(r[len(r)-1], n) {
+				ones, bits := n.Mask.Size()
+				parent := normalizeNet(&net.IPNet{IP: n.IP, Mask: net.CIDRMask(ones-1, bits)})
+				r[len(r)-1] = parent
+				merged = true
+				continue
+			}
+			r = append(r, n)
+		}
+		sorted = r
+	}
+	return sorted
+}
+
+// isSibling reports whether networks lo and hi are halves of the same
+// network.
+func isSibling(lo, hi *net.IPNet) bool {
+	onesLo, bitsLo := lo.Mask.Size()
+	onesHi, bitsHi := hi.Mask.Size()
+	if onesLo != onesHi || bitsLo != bitsHi || onesLo == 0 {
+		return false
+	}
+	l, h := splitNet(normalizeNet(&net.IPNet{IP: lo.IP, Mask: net.CIDRMask(onesLo-1, bitsLo)}))
+	return l.IP.Equal(lo.IP) && h.IP.Equal(hi.IP)
+}
@@ -0,0 +1,64 @@
+package spf
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func parseNets(t *testing.T, cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, normalizeNet(n))
+	}
+	return nets
+}
+
+func netStrings(nets []*net.IPNet) []string {
+	s := []string{}
+	for _, n := range nets {
+		s = append(s, n.String())
+	}
+	return s
+}
+
+func TestAggregateNets(t *testing.T) {
+	tests := []struct {
+		in, out []string
+	}{
+		{[]string{}, []string{}},
+		{[]string{"10.0.0.1/32", "10.0.0.0/32"}, []string{"10.0.0.0/31"}},
+		{[]string{"10.0.0.0/25", "10.0.0.128/25", "10.0.1.0/24"}, []string{"10.0.0.0/23"}},
+		{[]string{"10.0.1.0/24", "10.0.2.0/24"}, []string{"10.0.1.0/24", "10.0.2.0/24"}},
+		{[]string{"10.0.0.0/8", "10.1.2.3/32", "2001:db8::1/128", "2001:db8::/127"}, []string{"10.0.0.0/8", "2001:db8::/127"}},
+		{[]string{"2001:db8:8000::/33", "2001:db8::/33", "10.0.0.0/32"}, []string{"10.0.0.0/32", "2001:db8::/32"}},
+	}
+	for _, test := range tests {
+		out := netStrings(aggregateNets(parseNets(t, test.in...)))
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, out)
+		}
+	}
+}
+
+func TestSubtractNets(t *testing.T) {
+	tests := []struct {
+		a, b, out []string
+	}{
+		{[]string{"10.0.0.0/24"}, []string{"10.0.0.0/8"}, []string{}},
+		{[]string{"10.0.0.0/24"}, []string{"10.0.1.0/24"}, []string{"10.0.0.0/24"}},
+		{[]string{"10.0.0.0/24"}, []string{"10.0.0.128/25"}, []string{"10.0.0.0/25"}},
+		{[]string{"10.0.0.0/30"}, []string{"10.0.0.1/32"}, []string{"10.0.0.0/32", "10.0.0.2/31"}},
+		{[]string{"10.0.0.0/24", "2001:db8::/32"}, []string{"::/0"}, []string{"10.0.0.0/24"}},
+	}
+	for _, test := range tests {
+		out := netStrings(subtractNets(parseNets(t, test.a...), parseNets(t, test.b...)))
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%q - %q: expected %q, got %q", test.a, test.b, test.out, out)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// Evaluation is a detailed result of SPF evaluation. Besides the result and
+// explanation it keeps the information needed by Received-SPF and
+// Authentication-Results header fields.
+type Evaluation struct {
+	Result      Result
+	Explanation string
+
+	// Mechanism is the term of Domain's SPF record which determined the
+	// result, e.g. "include:_spf.example.com" or "-all". It's empty if no
+	// term matched and the result is the default one or an error.
+	Mechanism string
+	// Domain is the domain whose SPF record holds Mechanism. It differs
+	// from the checked domain if the record was reached by "redirect".
+	Domain string
+	// Redirect is true if Domain was reached by "redirect" modifier.
+	Redirect bool
+	// Chain is the path of matched terms from the checked domain's record
+	// down through "include" and "redirect" terms to the innermost matched
+	// term.
+	Chain []MatchedTerm
+
+	// Lookups is the number of DNS lookups made, including the lookup of
+	// the checked domain's SPF record.
+	Lookups int
+	// VoidLookups is the number of lookups which returned no answers.
+	VoidLookups int
+}
+
+// MatchedTerm is a term which matched while evaluating the SPF record of
+// Domain.
+type MatchedTerm struct {
+	Domain string
+	Term   string
+}
+
+// Evaluate works like CheckHostContext but returns the detailed result.
+func Evaluate(ctx context.Context, ip net.IP, domain, sender string, opts ...Option) (*Evaluation, error) {
+	return NewChecker(opts...).Evaluate(ctx, ip, domain, sender)
+}
+
+// EvaluateWithResolver works like CheckHostWithResolverContext but returns
+// the detailed result. If resolver doesn't implement ResolverContext, ctx
+// is checked before each lookup only.
+// Note, that DNS lookup limits need to be enforced by provided Resolver.
+func EvaluateWithResolver(ctx context.Context, ip net.IP, domain, sender string, resolver Resolver, opts ...Option) (*Evaluation, error) {
+	return evaluate(ctx, ip, domain, sender, AdaptResolver(resolver), newConfig(opts), nil)
+}
+
+// evaluate runs check_host() for the domain and collects details of the
+// evaluation. Unless trace is nil, the evaluation is recorded into it.
+func evaluate(ctx context.Context, ip net.IP, domain, sender string, resolver ResolverContext, cfg *config, trace *Trace) (*Evaluation, error) {
+	bound := &boundResolver{ctx: ctx, resolver: resolver}
+	var r Resolver = bound
+	if trace != nil {
+		r = &tracingResolver{bound, trace.tracer}
+	}
+	m := &match{domain: domain}
+	result, explanation, err := checkHost(ip, domain, sender, r, cfg, m, trace)
+
+	e := &Evaluation{
+		Result:      result,
+		Explanation: explanation,
+		Domain:      domain,
+		Lookups:     int(atomic.LoadInt32(&bound.lookups)),
+		VoidLookups: int(atomic.LoadInt32(&bound.voidLookups)),
+	}
+	for ; m != nil && m.term != nil; m = m.next {
+		term := m.String()
+		e.Chain = append(e.Chain, MatchedTerm{m.domain, term})
+		if e.Mechanism != "" {
+			continue
+		}
+		if m.term.mechanism == tRedirect {
+			e.Redirect = true
+			if m.next != nil {
+				e.Domain = m.next.domain
+			}
+		} else {
+			e.Mechanism = term
+		}
+	}
+	return e, err
+}
+
+// match records the term which determined the result of check_host() for
+// domain. The evaluation done by matched "include" mechanism or "redirect"
+// modifier is recorded in next.
+type match struct {
+	domain string
+	term   *token
+	next   *match
+}
+
+// matched records t as the term which determined the result, next is the
+// evaluation done by t. It's no-op for nil match.
+func (m *match) matched(t *token, next *match) {
+	if m == nil {
+		return
+	}
+	m.term = t
+	m.next = next
+}
+
+// nest returns match for recursive evaluation of domain, or nil if m is nil.
+func (m *match) nest(domain string) *match {
+	if m == nil {
+		return nil
+	}
+	return &match{domain: domain}
+}
+
+// String returns the matched term as it's written in the SPF record.
+func (m *match) String() string {
+	var qualifier string
+	if m.term.mechanism.isMechanism() {
+		qualifier = m.term.qualifier.String()
+	}
+	return termString(qualifier, m.term.mechanism.String(), m.term.value)
+}
@@ -0,0 +1,84 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEvaluate(t *testing.T) {
+	dns.HandleFunc("eval.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`eval.test. 0 IN TXT "v=spf1 ip4:10.0.0.1 redirect=red.eval.test"`,
+			`red.eval.test. 0 IN TXT "v=spf1 a:void.eval.test include:inc.eval.test -all exp=exp.eval.test"`,
+			`inc.eval.test. 0 IN TXT "v=spf1 ip4:10.0.0.2 ?all"`,
+			`exp.eval.test. 0 IN TXT "%{i} is not allowed"`,
+		},
+	}))
+	defer dns.HandleRemove("eval.test.")
+
+	samples := []struct {
+		ip  net.IP
+		err error
+		e   Evaluation
+	}{
+		{net.IP{10, 0, 0, 1}, nil, Evaluation{
+			Result:    Pass,
+			Mechanism: "ip4:10.0.0.1",
+			Domain:    "eval.test",
+			Chain:     []MatchedTerm{{"eval.test", "ip4:10.0.0.1"}},
+			Lookups:   1,
+		}},
+		{net.IP{10, 0, 0, 2}, nil, Evaluation{
+			Result:    Pass,
+			Mechanism: "include:inc.eval.test",
+			Domain:    "red.eval.test",
+			Redirect:  true,
+			Chain: []MatchedTerm{
+				{"eval.test", "redirect=red.eval.test"},
+				{"red.eval.test", "include:inc.eval.test"},
+				{"inc.eval.test", "ip4:10.0.0.2"},
+			},
+			Lookups:     4,
+			VoidLookups: 1,
+		}},
+		{net.IP{10, 0, 0, 3}, nil, Evaluation{
+			Result:      Fail,
+			Explanation: "10.0.0.3 is not allowed",
+			Mechanism:   "-all",
+			Domain:      "red.eval.test",
+			Redirect:    true,
+			Chain: []MatchedTerm{
+				{"eval.test", "redirect=red.eval.test"},
+				{"red.eval.test", "-all"},
+			},
+			Lookups:     5,
+			VoidLookups: 1,
+		}},
+	}
+
+	for i, s := range samples {
+		e, err := EvaluateWithResolver(context.Background(), s.ip, "eval.test", "eval.test", testResolver)
+		if err != s.err {
+			t.Errorf("#%d want error %v, got %v", i, s.err, err)
+		}
+		if !reflect.DeepEqual(*e, s.e) {
+			t.Errorf("#%d want %+v, got %+v", i, s.e, *e)
+		}
+	}
+}
+
+func TestEvaluateNoRecord(t *testing.T) {
+	e, err := Evaluate(context.Background(), net.IP{10, 0, 0, 1}, "noexist.eval.test", "noexist.eval.test",
+		WithResolver(testResolver))
+	if err != ErrDNSPermerror {
+		t.Errorf("want error %v, got %v", ErrDNSPermerror, err)
+	}
+	want := Evaluation{Result: None, Domain: "noexist.eval.test", Lookups: 1}
+	if !reflect.DeepEqual(*e, want) {
+		t.Errorf("want %+v, got %+v", want, *e)
+	}
+}
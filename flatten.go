@@ -0,0 +1,467 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Flattened is SPF policy flattened to "ip4" and "ip6" mechanisms, see
+// Checker.Flatten.
+type Flattened struct {
+	Domain string
+	// Record is the flattened record. It keeps the terms which could not be
+	// flattened in place.
+	Record *Record
+	// Unflattened lists the terms which could not be flattened, including
+	// those of included records.
+	Unflattened []*UnflattenedTerm
+}
+
+// UnflattenedTerm is a term, which could not be flattened.
+type UnflattenedTerm struct {
+	Domain string // domain of the record the term belongs to
+	Term   string
+	Reason string
+}
+
+// Flatten returns SPF policy of domain flattened to "ip4" and "ip6"
+// mechanisms, see Checker.Flatten.
+func Flatten(domain string, opts ...Option) (*Flattened, error) {
+	return NewChecker(opts...).Flatten(context.Background(), domain)
+}
+
+// Flatten resolves SPF record of domain along with its includes and returns
+// an equivalent record made of "ip4" and "ip6" mechanisms, so its evaluation
+// needs no DNS lookups. "a", "mx" and "exists" mechanisms are resolved too.
+//
+// The lookups are limited like those of the evaluation, counting the terms
+// of all the branches, as well as the kept terms which need a lookup.
+// ErrDNSLimitExceeded or ErrDNSVoidLookupLimitExceeded is returned if a limit
+// is exceeded, as the evaluation of the record would result in "permerror"
+// then.
+//
+// The first matching mechanism determines the result of the evaluation, so
+// the networks are made disjoint first. Networks of mechanisms with the same
+// qualifier are merged then and aggregated to the smallest number of CIDRs.
+// An "include" contributes the networks its record passes.
+//
+// Terms depending on the client IP or sender, that is "ptr" and terms with
+// macros, cannot be flattened. They are kept in the record as they are, as
+// well as "include" and "redirect" terms referencing records with such
+// terms. All of them are listed in Unflattened.
+//
+// The "exp" modifier of the top record is kept. If there's none, the first
+// one of the chain of flattened "redirect" targets is used. The other ones
+// differing from the used one are listed in Unflattened, as well as those
+// using the "d" macro, which would expand to another domain.
+//
+// The flattened record is the snapshot of the current DNS data, so it needs
+// to be updated once the data changes. Lookup errors and errors which would
+// result in "permerror" are returned.
+func (c *Checker) Flatten(ctx context.Context, domain string) (*Flattened, error) {
+	f := c.flattener(ctx)
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	f.chain = []string{domain}
+	rules, _, err := f.record(domain, true)
+	if err != nil {
+		return nil, err
+	}
+	f.chainExp()
+
+	b := NewBuilder()
+	for _, r := range mergeRules(rules) {
+		switch {
+		case r.term != nil:
+			b.Add(r.term)
+		case r.all:
+			b.All(r.qualifier)
+		default:
+			for _, n := range r.nets {
+				b.IP(r.qualifier, n)
+			}
+		}
+	}
+	if f.exp != nil {
+		b.Add(f.exp)
+	}
+	record, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &Flattened{Domain: domain, Record: record, Unflattened: f.unflattened}, nil
+}
+
+// rule is a flattened term, the first matching rule determines the result.
+type rule struct {
+	qualifier Qualifier
+	nets      []*net.IPNet // networks of the rule, unless all is set
+	all       bool         // rule matches any address
+	term      Term         // kept unflattenable term
+}
+
+type flattener struct {
+	resolver    Resolver
+	limits      *LimitedResolver
+	path        map[string]bool      // domains being flattened
+	chain       []string             // top domain and its "redirect" targets
+	exp         *Modifier            // "exp" of the top record
+	exps        map[string]*Modifier // "exp" of the flattened records
+	unflattened []*UnflattenedTerm
+}
+
+// flattener returns flattener using configured resolver with the limits of
+// the evaluation.
+func (c *Checker) flattener(ctx context.Context) *flattener {
+	limits := c.limitedResolver()
+	return &flattener{
+		resolver: &boundResolver{ctx: ctx, resolver: limits},
+		limits:   limits,
+		path:     make(map[string]bool),
+		exps:     make(map[string]*Modifier),
+	}
+}
+
+// keep lists t as unflattened. If t needs a lookup, it's counted, as the
+// evaluation of the flattened record does it.
+func (f *flattener) keep(domain string, t Term, reason string, lookup bool) error {
+	f.unflattened = append(f.unflattened, &UnflattenedTerm{domain, t.String(), reason})
+	if lookup && !f.limits.canLookup() {
+		return ErrDNSLimitExceeded
+	}
+	return nil
+}
+
+// lookupError returns err annotated with where it happened, but for exceeded
+// limits.
+func lookupError(err error, format string, args ...interface{}) error {
+	switch err {
+	case ErrDNSLimitExceeded, ErrDNSVoidLookupLimitExceeded:
+		return err
+	}
+	return fmt.Errorf(format+": %v", append(args, err)...)
+}
+
+// record returns rules of the record of domain. Unless top is true, it
+// returns false if there are terms which could not be flattened.
+func (f *flattener) record(domain string, top bool) ([]rule, bool, error) {
+	if f.path[domain] {
+		return nil, false, fmt.Errorf("%s: include loop", domain)
+	}
+	f.path[domain] = true
+	defer delete(f.path, domain)
+
+	text, err := lookupSPF(f.resolver, domain)
+	if err != nil {
+		return nil, false, lookupError(err, "%s", domain)
+	}
+	r, err := Parse(text)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", domain, err)
+	}
+
+	f.exps[domain] = r.Explanation()
+	if top {
+		f.exp = r.Explanation()
+	}
+
+	var (
+		rules []rule
+		ok    = true
+	)
+	for _, m := range r.Mechanisms() {
+		rs, flattened, err := f.mechanism(domain, m)
+		if err != nil {
+			return nil, false, err
+		}
+		if !flattened {
+			if !top {
+				ok = false
+				continue
+			}
+			rs = []rule{{term: m}}
+		}
+		rules = append(rules, rs...)
+		if m.Name == "all" {
+			return rules, ok, nil
+		}
+	}
+
+	if m := r.Redirect(); m != nil {
+		target := strings.ToLower(strings.TrimSuffix(m.Value, "."))
+		if strings.Contains(target, "%") {
+			if err := f.keep(domain, m, "depends on macros", true); err != nil {
+				return nil, false, err
+			}
+			return append(rules, rule{term: m}), top, nil
+		}
+		// targets of the redirect chain of the top record are flattened
+		// into it, so their "exp" is carried over
+		chained := len(f.chain) > 0 && f.chain[len(f.chain)-1] == domain
+		if chained {
+			f.chain = append(f.chain, target)
+		}
+		rs, flattened, err := f.record(target, false)
+		switch {
+		case err != nil:
+			return nil, false, err
+		case !flattened:
+			if chained {
+				f.chain = f.chain[:len(f.chain)-1]
+			}
+			f.keep(domain, m, "target record cannot be flattened", false)
+			return append(rules, rule{term: m}), top, nil
+		}
+		rules = append(rules, rs...)
+	}
+	return rules, ok, nil
+}
+
+// chainExp sets "exp" of the top record to the first "exp" of the flattened
+// redirect chain, unless the top record has its own.
+//
+// From RFC 7208, section 6.2:
+// when executing a "redirect" modifier, an exp= modifier from the original
+// domain MUST NOT be used.
+func (f *flattener) chainExp() {
+	for _, target := range f.chain[1:] {
+		exp := f.exps[target]
+		switch {
+		case exp == nil:
+			// nothing to carry over
+		case hasDomainMacro(exp.Value):
+			f.keep(target, exp, "explanation depends on domain", false)
+		case f.exp == nil:
+			f.exp = exp
+		case f.exp.String() != exp.String():
+			f.keep(target, exp, "top record has another explanation", false)
+		}
+	}
+}
+
+// hasDomainMacro returns true if s uses the "d" macro, the current domain.
+func hasDomainMacro(s string) bool {
+	return strings.Contains(strings.ToLower(s), "%{d")
+}
+
+// mechanism returns rules of mechanism m of domain's record. It returns false
+// if m cannot be flattened.
+func (f *flattener) mechanism(domain string, m *Mechanism) ([]rule, bool, error) {
+	target := m.Domain
+	if target == "" {
+		target = domain
+	}
+	if m.Name == "ptr" {
+		return nil, false, f.keep(domain, m, "depends on client IP", true)
+	}
+	if strings.Contains(target, "%") {
+		return nil, false, f.keep(domain, m, "depends on macros", true)
+	}
+
+	var (
+		nets []*net.IPNet
+		mu   sync.Mutex
+	)
+	collect := func(ip net.IP) (bool, error) {
+		mu.Lock()
+		nets = append(nets, hostNet(ip, m.CIDR4, m.CIDR6))
+		mu.Unlock()
+		return false, nil
+	}
+	var err error
+	switch m.Name {
+	case "all":
+		return []rule{{qualifier: m.Qualifier, all: true}}, true, nil
+	case "ip4", "ip6":
+		nets = append(nets, m.Network())
+	case "a":
+		_, err = f.resolver.MatchIP(NormalizeFQDN(target), collect)
+	case "mx":
+		_, err = f.resolver.MatchMX(NormalizeFQDN(target), collect)
+	case "exists":
+		var found bool
+		if found, err = f.resolver.Exists(NormalizeFQDN(target)); found {
+			return []rule{{qualifier: m.Qualifier, all: true}}, true, nil
+		}
+	case "include":
+		return f.include(domain, m, target)
+	}
+	if err != nil && err != ErrDNSPermerror {
+		return nil, false, lookupError(err, "%s: %q", domain, m)
+	}
+	return []rule{{qualifier: m.Qualifier, nets: nets}}, true, nil
+}
+
+// include returns the rule of "include" mechanism m, which matches the
+// networks the included record passes.
+func (f *flattener) include(domain string, m *Mechanism, target string) ([]rule, bool, error) {
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	rules, ok, err := f.record(target, false)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		f.keep(domain, m, "included record cannot be flattened", false)
+		return nil, false, nil
+	}
+
+	var covered, passed []*net.IPNet
+	for _, r := range rules {
+		nets := r.nets
+		if r.all {
+			nets = []*net.IPNet{allIPv4, allIPv6}
+		}
+		nets = subtractNets(nets, covered)
+		if r.qualifier == QualifierPass {
+			passed = append(passed, nets...)
+		}
+		covered = append(covered, nets...)
+		if r.all {
+			break
+		}
+	}
+	return []rule{{qualifier: m.Qualifier, nets: aggregateNets(passed)}}, true, nil
+}
+
+// mergeRules makes networks of the rules disjoint and merges rules with the
+// same qualifier. Rules are not moved across kept terms, as their networks
+// are not known.
+func mergeRules(rules []rule) []rule {
+	var (
+		merged  []rule
+		covered []*net.IPNet
+		segment = make(map[Qualifier]int) // index of the rule in merged
+	)
+	for _, r := range rules {
+		switch {
+		case r.term != nil:
+			merged = append(merged, r)
+			segment = make(map[Qualifier]int)
+			continue
+		case r.all:
+			merged = append(merged, r)
+			return merged
+		}
+
+		nets := subtractNets(aggregateNets(r.nets), covered)
+		covered = append(covered, nets...)
+		if len(nets) == 0 {
+			continue
+		}
+		if i, ok := segment[r.qualifier]; ok {
+			merged[i].nets = aggregateNets(append(merged[i].nets, nets...))
+			continue
+		}
+		segment[r.qualifier] = len(merged)
+		merged = append(merged, rule{qualifier: r.qualifier, nets: aggregateNets(nets)})
+	}
+	return merged
+}
+
+// ChainedRecord is a record of the chain returned by Flattened.Chain.
+type ChainedRecord struct {
+	Name   string
+	Record *Record
+}
+
+// Chain splits the flattened record into records no longer than maxLength
+// bytes, which should be published under the returned names. The first
+// record is the one of the flattened domain. If the record is too long, each
+// run of "ip4" and "ip6" mechanisms with the same qualifier is moved into a
+// chain of records linked by "include", which is referenced by the first
+// record. name returns the name of i-th chained record, i starts at 1.
+// If name is nil, "_spf<i>.<domain>" is used.
+//
+// Note, that each chained record costs one DNS lookup of the evaluation.
+func (f *Flattened) Chain(maxLength int, name func(i int) string) ([]*ChainedRecord, error) {
+	if name == nil {
+		name = func(i int) string { return fmt.Sprintf("_spf%d.%s", i, f.Domain) }
+	}
+	if len(f.Record.String()) <= maxLength {
+		return []*ChainedRecord{{f.Domain, f.Record}}, nil
+	}
+
+	var (
+		chain = []*ChainedRecord{nil}
+		top   = NewBuilder()
+		run   []*Mechanism
+	)
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		top.Include(run[0].Qualifier, name(len(chain)))
+		records, err := chainRecords(run, maxLength, name, len(chain))
+		chain = append(chain, records...)
+		run = nil
+		return err
+	}
+	for _, t := range f.Record.Terms {
+		m, ok := t.(*Mechanism)
+		if ok && (m.Name == "ip4" || m.Name == "ip6") {
+			if len(run) > 0 && run[0].Qualifier != m.Qualifier {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			run = append(run, m)
+			continue
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		top.Add(t)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	r, err := top.Build()
+	if err != nil {
+		return nil, err
+	}
+	if len(r.String()) > maxLength {
+		return nil, fmt.Errorf("record of %s is %d bytes long even with %d chained records", f.Domain, len(r.String()), len(chain)-1)
+	}
+	chain[0] = &ChainedRecord{f.Domain, r}
+	return chain, nil
+}
+
+// chainRecords returns the records of mechanisms run, the first one is named
+// name(i). Each record, but the last one, includes the next one.
+func chainRecords(run []*Mechanism, maxLength int, name func(int) string, i int) ([]*ChainedRecord, error) {
+	var (
+		records []*ChainedRecord
+		b       = NewBuilder()
+		length  = len("v=spf1")
+	)
+	// terms are passed in the chain, the qualifier is applied by the
+	// including record
+	reserve := len(" include:" + name(i+1))
+	for _, m := range run {
+		term := *m
+		term.Qualifier = QualifierPass
+		l := 1 + len(term.String())
+		if length+l+reserve > maxLength && length > len("v=spf1") {
+			r, err := b.Include(QualifierPass, name(i+1)).Build()
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, &ChainedRecord{name(i), r})
+			b, length, i = NewBuilder(), len("v=spf1"), i+1
+			reserve = len(" include:" + name(i+1))
+		}
+		if length+l+reserve > maxLength {
+			return nil, fmt.Errorf("%q doesn't fit into a record of %d bytes", term.String(), maxLength)
+		}
+		b.Add(&term)
+		length += l
+	}
+	r, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return append(records, &ChainedRecord{name(i), r}), nil
+}
@@ -0,0 +1,235 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFlatten(t *testing.T) {
+	dns.HandleFunc("flat.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`flat.test. 0 IN TXT "v=spf1 ip4:10.0.0.1 a mx/24 include:inc.flat.test -ip4:10.0.3.0/24 ip4:10.0.3.7 exists:%{i}.flat.test ptr include:macro.flat.test ip6:2001:db8::/33 ip6:2001:db8:8000::/33 redirect=red.flat.test exp=exp.flat.test"`,
+			`inc.flat.test. 0 IN TXT "v=spf1 -ip4:10.0.2.128/25 ip4:10.0.2.0/24 ?ip4:10.0.4.0/24 -all"`,
+			`macro.flat.test. 0 IN TXT "v=spf1 a:%{d}.other.test -all"`,
+			`red.flat.test. 0 IN TXT "v=spf1 exists:host.flat.test ip4:10.0.5.0/24 -all exp=red-exp.flat.test"`,
+			`noexp.flat.test. 0 IN TXT "v=spf1 ip4:10.0.0.1 redirect=red.flat.test"`,
+			`chain.flat.test. 0 IN TXT "v=spf1 ip4:10.0.0.2 redirect=noexp.flat.test"`,
+			`dexp.flat.test. 0 IN TXT "v=spf1 redirect=dred.flat.test"`,
+			`dred.flat.test. 0 IN TXT "v=spf1 -all exp=%{d}.exp.flat.test"`,
+		},
+		dns.TypeA: {
+			"flat.test. 0 IN A 10.0.0.0",
+			"mx.flat.test. 0 IN A 10.0.1.1",
+			"host.flat.test. 0 IN A 127.0.0.2",
+		},
+		dns.TypeMX: {
+			"flat.test. 0 IN MX 10 mx.flat.test.",
+		},
+	}))
+	defer dns.HandleRemove("flat.test.")
+
+	// the lookups of all the terms, including kept ones, are counted, which
+	// takes 10 lookups
+	f, err := Flatten("flat.test", WithResolver(testResolver), WithLookupLimit(11))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 10.0.0.0 and 10.0.0.1 are aggregated, as well as both ip6 networks,
+	// include contributes 10.0.2.0/25 only, 10.0.3.7 is never matched,
+	// exists:host.flat.test of the redirect target matches any address
+	expected := "v=spf1 ip4:10.0.0.0/31 ip4:10.0.1.0/24 ip4:10.0.2.0/25 -ip4:10.0.3.0/24 exists:%{i}.flat.test ptr include:macro.flat.test ip6:2001:db8::/32 all exp=exp.flat.test"
+	if s := f.Record.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+
+	unflattened := []*UnflattenedTerm{
+		{"flat.test", "exists:%{i}.flat.test", "depends on macros"},
+		{"flat.test", "ptr", "depends on client IP"},
+		{"macro.flat.test", "a:%{d}.other.test", "depends on macros"},
+		{"flat.test", "include:macro.flat.test", "included record cannot be flattened"},
+		{"red.flat.test", "exp=red-exp.flat.test", "top record has another explanation"},
+	}
+	if !reflect.DeepEqual(f.Unflattened, unflattened) {
+		for _, u := range f.Unflattened {
+			t.Logf("%+v", u)
+		}
+		t.Errorf("unexpected unflattened terms")
+	}
+
+	// "exp" of the redirect target is carried over
+	f, err = Flatten("noexp.flat.test", WithResolver(testResolver))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = "v=spf1 ip4:10.0.0.1 all exp=red-exp.flat.test"
+	if s := f.Record.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+	if len(f.Unflattened) != 0 {
+		t.Errorf("unexpected unflattened terms: %v", f.Unflattened)
+	}
+
+	// "exp" is carried over along the whole redirect chain
+	f, err = Flatten("chain.flat.test", WithResolver(testResolver))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = "v=spf1 ip4:10.0.0.1 ip4:10.0.0.2 all exp=red-exp.flat.test"
+	if s := f.Record.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+
+	// "exp" expanding "d" macro to the target domain is not carried over
+	f, err = Flatten("dexp.flat.test", WithResolver(testResolver))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = "v=spf1 -all"
+	if s := f.Record.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+	unflattened = []*UnflattenedTerm{
+		{"dred.flat.test", "exp=%{d}.exp.flat.test", "explanation depends on domain"},
+	}
+	if !reflect.DeepEqual(f.Unflattened, unflattened) {
+		t.Errorf("expected %v, got %v", unflattened, f.Unflattened)
+	}
+}
+
+func TestFlattenLimits(t *testing.T) {
+	includes := strings.Repeat(" include:inc.flat-limit.test", 11)
+	mx := []string{"mx.flat-limit.test. 0 IN MX 10 mx.flat-limit.test."}
+	for i := 0; i < 10; i++ {
+		mx = append(mx, fmt.Sprintf("mx.flat-limit.test. 0 IN MX 10 mx%d.flat-limit.test.", i))
+	}
+	dns.HandleFunc("flat-limit.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`flat-limit.test. 0 IN TXT "v=spf1` + includes + ` -all"`,
+			`inc.flat-limit.test. 0 IN TXT "v=spf1 ip4:10.0.0.1 -all"`,
+			`ptr.flat-limit.test. 0 IN TXT "v=spf1 ptr ptr ptr ptr ptr ptr ptr ptr ptr ptr -all"`,
+			`void.flat-limit.test. 0 IN TXT "v=spf1 a:none1.flat-limit.test a:none2.flat-limit.test a:none3.flat-limit.test -all"`,
+			`mx.flat-limit.test. 0 IN TXT "v=spf1 mx -all"`,
+		},
+		dns.TypeMX: mx,
+		dns.TypeA: {
+			"mx.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx0.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx1.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx2.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx3.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx4.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx5.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx6.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx7.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx8.flat-limit.test. 0 IN A 10.0.0.1",
+			"mx9.flat-limit.test. 0 IN A 10.0.0.1",
+		},
+	}))
+	defer dns.HandleRemove("flat-limit.test.")
+
+	c := NewChecker(WithResolver(testResolver))
+	for _, test := range []struct {
+		domain string
+		err    error
+	}{
+		{"flat-limit.test", ErrDNSLimitExceeded},
+		{"ptr.flat-limit.test", ErrDNSLimitExceeded},
+		{"void.flat-limit.test", ErrDNSVoidLookupLimitExceeded},
+		{"mx.flat-limit.test", ErrDNSLimitExceeded},
+	} {
+		if _, err := c.Flatten(context.Background(), test.domain); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.domain, test.err, err)
+		}
+	}
+}
+
+func TestFlattenErrors(t *testing.T) {
+	dns.HandleFunc("flat-err.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`flat-err.test. 0 IN TXT "v=spf1 include:loop.flat-err.test -all"`,
+			`loop.flat-err.test. 0 IN TXT "v=spf1 include:flat-err.test -all"`,
+			`missing.flat-err.test. 0 IN TXT "v=spf1 include:none.flat-err.test -all"`,
+		},
+	}))
+	defer dns.HandleRemove("flat-err.test.")
+
+	c := NewChecker(WithResolver(testResolver))
+	for _, domain := range []string{"flat-err.test", "missing.flat-err.test", "none.flat-err.test"} {
+		if _, err := c.Flatten(context.Background(), domain); err == nil {
+			t.Errorf("%s: expected error", domain)
+		}
+	}
+}
+
+func TestFlattenedChain(t *testing.T) {
+	b := NewBuilder().MX(QualifierPass, "", -1, -1)
+	for i := 0; i < 60; i++ {
+		b.IP(QualifierPass, &net.IPNet{IP: net.IP{10, byte(i), 0, 1}})
+	}
+	for i := 0; i < 5; i++ {
+		b.IP(QualifierFail, &net.IPNet{IP: net.IP{192, 168, byte(i), 1}})
+	}
+	r, err := b.All(QualifierSoftfail).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Flattened{Domain: "example.com", Record: r}
+
+	chain, err := f.Chain(450, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, c := range chain {
+		names = append(names, c.Name)
+		if l := len(c.Record.String()); l > 450 {
+			t.Errorf("%s: record is %d bytes long", c.Name, l)
+		}
+	}
+	expected := []string{"example.com", "_spf1.example.com", "_spf2.example.com", "_spf3.example.com", "_spf4.example.com"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %q, got %q", expected, names)
+	}
+	if s := chain[0].Record.String(); s != "v=spf1 mx include:_spf1.example.com -include:_spf4.example.com ~all" {
+		t.Errorf("unexpected top record: %s", s)
+	}
+	if s := chain[1].Record.String(); !strings.HasSuffix(s, " include:_spf2.example.com") {
+		t.Errorf("expected the record to include the next one: %s", s)
+	}
+	if s := chain[3].Record.String(); strings.Contains(s, "include") {
+		t.Errorf("unexpected last record of the chain: %s", s)
+	}
+
+	// all the addresses are kept
+	var terms []string
+	for _, c := range chain[1:4] {
+		for _, t := range c.Record.Terms {
+			if m := t.(*Mechanism); m.Name == "ip4" {
+				terms = append(terms, m.String())
+			}
+		}
+	}
+	if len(terms) != 60 {
+		t.Errorf("expected 60 terms, got %d", len(terms))
+	}
+
+	// short record is not split
+	r, _ = Parse("v=spf1 ip4:10.0.0.1 -all")
+	chain, err = (&Flattened{Domain: "example.com", Record: r}).Chain(450, func(i int) string {
+		return fmt.Sprintf("s%d.example.com", i)
+	})
+	if err != nil || len(chain) != 1 || chain[0].Record != r {
+		t.Errorf("unexpected chain: %v, %v", chain, err)
+	}
+
+	if _, err = f.Chain(30, nil); err == nil {
+		t.Error("expected error")
+	}
+}
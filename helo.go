@@ -0,0 +1,64 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// heloIdentity returns the domain and the sender used to check HELO identity
+// as described in RFC 7208, section 2.3. It returns ErrInvalidDomain for
+// address literals and names which are not fully qualified.
+func heloIdentity(helo string) (string, string, error) {
+	domain := strings.TrimSuffix(helo, ".")
+	if isAddressLiteral(domain) || !strings.Contains(domain, ".") || !isDomainName(domain) {
+		return "", "", ErrInvalidDomain
+	}
+	return domain, "postmaster@" + domain, nil
+}
+
+// isAddressLiteral reports whether s is an address literal as defined by
+// RFC 5321, section 4.1.3, e.g. "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+// Bare IP addresses are reported too, as some clients send them.
+func isAddressLiteral(s string) bool {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return true
+	}
+	return net.ParseIP(s) != nil
+}
+
+// CheckHELO evaluates SPF policy of the HELO identity for the given client
+// IP as recommended by RFC 7208, section 2.3. The sender is synthesized as
+// "postmaster@<helo>" and helo is used as the value of the "h" macro.
+// Address literals and names which are not fully qualified have no SPF
+// policy, so CheckHELO returns None and ErrInvalidDomain for them.
+func CheckHELO(ip net.IP, helo string, opts ...Option) (Result, string, error) {
+	return NewChecker(opts...).CheckHELO(ip, helo)
+}
+
+// CheckHELOWithResolver is CheckHELO, which uses custom Resolver.
+// Note, that DNS lookup limits need to be enforced by provided Resolver.
+func CheckHELOWithResolver(ip net.IP, helo string, resolver Resolver, opts ...Option) (Result, string, error) {
+	domain, sender, err := heloIdentity(helo)
+	if err != nil {
+		return None, "", err
+	}
+	return CheckHostWithResolver(ip, domain, sender, resolver, append(append([]Option(nil), opts...), WithHELO(domain))...)
+}
+
+// CheckHELO evaluates SPF policy of the HELO identity for the given client
+// IP, see CheckHELO function for the details.
+func (c *Checker) CheckHELO(ip net.IP, helo string) (Result, string, error) {
+	return c.CheckHELOContext(context.Background(), ip, helo)
+}
+
+// CheckHELOContext is CheckHELO, which stops the evaluation with Temperror
+// result once ctx is done. In such case the returned error is ctx.Err().
+func (c *Checker) CheckHELOContext(ctx context.Context, ip net.IP, helo string) (Result, string, error) {
+	domain, sender, err := heloIdentity(helo)
+	if err != nil {
+		return None, "", err
+	}
+	e, err := c.evaluate(ctx, ip, domain, sender, domain)
+	return e.Result, e.Explanation, err
+}
@@ -0,0 +1,65 @@
+package spf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckHELO(t *testing.T) {
+	dns.HandleFunc("helo.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`mx.helo.test. 0 IN TXT "v=spf1 exists:%{l}.%{h}.allowed.helo.test -all"`,
+		},
+		dns.TypeA: {
+			"postmaster.mx.helo.test.allowed.helo.test. 0 IN A 127.0.0.2",
+		},
+	}))
+	defer dns.HandleRemove("helo.test.")
+
+	samples := []struct {
+		helo string
+		r    Result
+		err  error
+	}{
+		{"mx.helo.test", Pass, nil},
+		{"mx.helo.test.", Pass, nil},
+		{"localhost", None, ErrInvalidDomain},
+		{"[10.0.0.1]", None, ErrInvalidDomain},
+		{"[IPv6:2001:db8::1]", None, ErrInvalidDomain},
+		{"10.0.0.1", None, ErrInvalidDomain},
+		{"", None, ErrInvalidDomain},
+	}
+
+	for _, s := range samples {
+		r, _, err := CheckHELOWithResolver(net.IP{10, 0, 0, 1}, s.helo, testResolver)
+		if r != s.r || err != s.err {
+			t.Errorf("CheckHELOWithResolver(%q) want [%v %v], got [%v %v]", s.helo, s.r, s.err, r, err)
+		}
+		r, _, err = NewChecker(WithResolver(testResolver)).CheckHELO(net.IP{10, 0, 0, 1}, s.helo)
+		if r != s.r || err != s.err {
+			t.Errorf("Checker.CheckHELO(%q) want [%v %v], got [%v %v]", s.helo, s.r, s.err, r, err)
+		}
+	}
+
+	// "h" macro is not the checked domain for MAIL FROM identity
+	r, _, _ := CheckHostWithResolver(net.IP{10, 0, 0, 1}, "mx.helo.test", "postmaster@mx.helo.test", testResolver)
+	if r != Fail {
+		t.Errorf("CheckHostWithResolver want %v, got %v", Fail, r)
+	}
+	r, _, _ = CheckHostWithResolver(net.IP{10, 0, 0, 1}, "mx.helo.test", "postmaster@mx.helo.test", testResolver,
+		WithHELO("mx.helo.test"))
+	if r != Pass {
+		t.Errorf("CheckHostWithResolver with HELO want %v, got %v", Pass, r)
+	}
+
+	// the options of the caller are not modified
+	opts := make([]Option, 1, 2)
+	opts[0] = WithReceivingFQDN("mx.example.org")
+	spare := opts[:2]
+	_, _, _ = CheckHELOWithResolver(net.IP{10, 0, 0, 1}, "mx.helo.test", testResolver, opts...)
+	if spare[1] != nil {
+		t.Error("CheckHELOWithResolver modified the array of opts")
+	}
+}
@@ -19,15 +19,35 @@ type lexer struct {
 // relevant actions
 func lex(input string) []*token {
 	var tokens []*token
+	for _, lx := range lexTerms(input) {
+		tokens = append(tokens, lx.token)
+	}
+	return tokens
+}
+
+// lexeme is a token along with the text of the term and its byte offset in
+// the lexed record
+type lexeme struct {
+	token *token
+	text  string
+	pos   int
+}
+
+// lexTerms works like lex, but it keeps the position and the text of each
+// token, so errors could be reported precisely.
+func lexTerms(input string) []lexeme {
+	var lexemes []lexeme
 	l := &lexer{0, 0, 0, len(input), input}
 	for {
+		pos := l.start
 		token := l.scan()
 		if token.mechanism == tEOF {
 			break
 		}
-		tokens = append(tokens, token)
+		text := strings.TrimRight(input[pos:l.pos], " \t\n")
+		lexemes = append(lexemes, lexeme{token, text, pos})
 	}
-	return tokens
+	return lexemes
 }
 
 // scan scans input and returns a Token structure
@@ -89,18 +109,36 @@ func (l *lexer) scanWhitespaces() {
 // The default token has `mechanism` set to tErr, that is, error state.
 func (l *lexer) scanIdent() *token {
 	t := &token{tErr, qPlus, ""}
+	begin := l.start
 	cursor := l.start
 	for cursor < l.pos {
 		ch, size := utf8.DecodeRuneInString(l.input[cursor:])
 		cursor += size
 
-		if isQualifier(ch) {
+		// qualifier may only be the first character of a term, otherwise
+		// it's a part of the name (e.g. unknown modifier "x-name=value")
+		if cursor-size == begin && isQualifier(ch) {
 			t.qualifier, _ = qualifiers[ch]
 			l.start = cursor
 			continue
-		} else if isDelimiter(ch) { // add error handling
-			t.mechanism = tokenTypeFromString(l.input[l.start : cursor-size])
+		} else if isDelimiter(ch) || ch == '/' && isCIDRMechanism(l.input[l.start:cursor-size]) {
+			name := l.input[l.start : cursor-size]
+			t.mechanism = tokenTypeFromString(name)
 			t.value = strings.TrimSpace(l.input[cursor:l.pos])
+			if ch == '/' {
+				// "a" and "mx" may be followed by dual-cidr-length
+				// directly, keep it in the value, e.g. "a/24"
+				t.value = strings.TrimSpace(l.input[cursor-size : l.pos])
+			}
+
+			// RFC 7208, section 6:
+			// Unrecognized modifiers MUST be ignored.
+			// Keep the name along with the value, so such modifiers can
+			// still be inspected.
+			if t.mechanism.isErr() && ch == '=' && isModifierName(name) {
+				t.mechanism = tUnknownModifier
+				t.value = name + "=" + t.value
+			}
 
 			if t.value == "" || !checkTokenSyntax(t, ch) {
 				t.qualifier = qErr
@@ -125,6 +163,13 @@ func (l *lexer) scanIdent() *token {
 // isWhitespace returns true if the rune is a space, tab, or newline.
 func isWhitespace(ch rune) bool { return ch == ' ' || ch == '\t' || ch == '\n' }
 
+// isCIDRMechanism returns true if name is a name of mechanism which allows
+// dual-cidr-length, that is "a" or "mx".
+func isCIDRMechanism(name string) bool {
+	name = strings.ToLower(name)
+	return name == "a" || name == "mx"
+}
+
 // isDelimiter returns true if rune equals to ':' or '=', false otherwise
 func isDelimiter(ch rune) bool { return ch == ':' || ch == '=' }
 
@@ -133,3 +178,19 @@ func isQualifier(ch rune) bool { return ch == '+' || ch == '-' || ch == '~' || c
 
 // isDigit returns true if rune is a numer (between '0' and '9'), false otherwise
 func isDigit(ch rune) bool { return ch >= '0' && ch <= '9' }
+
+// isModifierName returns true if s is a valid name of a modifier as defined
+// by RFC 7208, section 12:
+// name = ALPHA *( ALPHA / DIGIT / "-" / "_" / "." )
+func isModifierName(s string) bool {
+	isAlpha := func(ch rune) bool { return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' }
+	for i, ch := range s {
+		if isAlpha(ch) {
+			continue
+		}
+		if i == 0 || !isDigit(ch) && !strings.ContainsRune("-_.", ch) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -55,12 +55,25 @@ func TestLexerScanIdent(t *testing.T) {
 		{"~all", &token{tAll, qTilde, ""}},
 		{"-mx:localhost", &token{tMX, qMinus, "localhost"}},
 		{"mx", &token{tMX, qPlus, ""}},
+		{"a/24", &token{tA, qPlus, "/24"}},
+		{"-mx/24//64", &token{tMX, qMinus, "/24//64"}},
+		{"-MX/24", &token{tMX, qMinus, "/24"}},
+		{"Include:example.com", &token{tInclude, qPlus, "example.com"}},
+		{"REDIRECT=example.com", &token{tRedirect, qPlus, "example.com"}},
+		{"Exp=example.com", &token{tExp, qPlus, "example.com"}},
 		{"a:", &token{tErr, qErr, ""}},
 		{"?mx:localhost", &token{tMX, qQuestionMark, "localhost"}},
 		{"?random:localhost", &token{tErr, qErr, ""}},
 		{"-:localhost", &token{tErr, qErr, ""}},
 		{"", &token{tErr, qErr, ""}},
 		{"qowie", &token{tErr, qErr, ""}},
+		{"ra=postmaster", &token{tUnknownModifier, qPlus, "ra=postmaster"}},
+		{"rp=100 ", &token{tUnknownModifier, qPlus, "rp=100"}},
+		{"x-vendor.1_a=%{d}", &token{tUnknownModifier, qPlus, "x-vendor.1_a=%{d}"}},
+		{"1ra=postmaster", &token{tErr, qErr, ""}},
+		{"r*a=postmaster", &token{tErr, qErr, ""}},
+		{"ra:postmaster", &token{tErr, qErr, ""}},
+		{"=postmaster", &token{tErr, qErr, ""}},
 	}
 
 	for _, testpair := range testpairs {
@@ -121,6 +134,13 @@ func TestLexFunc(t *testing.T) {
 			[]*token{
 				versionToken,
 				{tRedirect, qPlus, "_spf.example.org"}}},
+		{"v=spf1 mx ra=postmaster rr=all -all",
+			[]*token{
+				versionToken,
+				{tMX, qPlus, ""},
+				{tUnknownModifier, qPlus, "ra=postmaster"},
+				{tUnknownModifier, qPlus, "rr=all"},
+				{tAll, qMinus, ""}}},
 		{"v=spf1 mx -all exp=explain._spf.%{d}",
 			[]*token{
 				versionToken,
@@ -0,0 +1,290 @@
+package spf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity of a problem reported by Lint.
+type Severity int
+
+// Severities of problems
+const (
+	// SeverityInfo is an advice, e.g. a term which couldn't be checked
+	SeverityInfo Severity = iota
+	// SeverityWarning is reported for valid records which likely don't
+	// work as intended
+	SeverityWarning
+	// SeverityError is reported for records, which evaluation results in
+	// "permerror"
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// Problem is a problem of SPF record found by Lint or LintDomain.
+type Problem struct {
+	Severity Severity
+	// Domain is the domain the record was published for, empty if the record
+	// was given to Lint.
+	Domain string
+	// Term is the faulty term, it's empty if the problem is related to the
+	// whole record. Offset is byte offset of the term in the record.
+	Term   string
+	Offset int
+	// Section of RFC 7208 describing the problem, e.g. "4.6.4"
+	Section string
+	Message string
+}
+
+func (p *Problem) String() string {
+	s := p.Severity.String() + ": "
+	if p.Domain != "" {
+		s += p.Domain + ": "
+	}
+	if p.Term != "" {
+		s += fmt.Sprintf("%q at offset %d: ", p.Term, p.Offset)
+	}
+	return s + p.Message + " (RFC 7208, section " + p.Section + ")"
+}
+
+// recordSizeLimit is the size of the record, which should not be exceeded
+// to fit DNS response into a single UDP packet, see RFC 7208, section 3.4.
+const recordSizeLimit = 450
+
+// Lint checks SPF record and reports all problems found. Unlike Parse, it
+// doesn't stop at the first syntax error. The number of DNS lookups is
+// checked for the record itself only, see LintDomain for checking included
+// records as well.
+func Lint(record string) []*Problem {
+	l := &linter{}
+	lookups, _ := l.lint("", record)
+	l.checkLookups("", lookups)
+	return l.problems
+}
+
+// LintDomain looks up SPF record of domain and checks it like Lint does.
+// Moreover, records of "include" mechanisms and "redirect" modifier are
+// checked recursively, the total number of DNS lookups is checked and
+// problems with looking up the records are reported.
+// Terms with macros cannot be followed, they are reported as
+// SeverityInfo problems.
+//
+// The returned error is not nil if the record of domain itself could not
+// be looked up, e.g. it's ErrSPFNotFound if there's no SPF record.
+func LintDomain(domain string, resolver Resolver) ([]*Problem, error) {
+	l := &linter{
+		resolver: resolver,
+		lookups:  make(map[string]int),
+		path:     make(map[string]bool),
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	record, err := lookupSPF(l.resolver, domain)
+	switch err {
+	case nil:
+	case errTooManySPFRecords:
+		l.add(SeverityError, domain, nil, "4.5", "multiple SPF records")
+		return l.problems, nil
+	default:
+		return nil, err
+	}
+	l.checkLookups(domain, l.walk(domain, record))
+	return l.problems, nil
+}
+
+type linter struct {
+	problems []*Problem
+
+	resolver Resolver
+	lookups  map[string]int  // number of DNS lookups of walked domains
+	path     map[string]bool // domains being walked
+}
+
+func (l *linter) add(severity Severity, domain string, lx *lexeme, section, format string, args ...interface{}) {
+	p := &Problem{
+		Severity: severity,
+		Domain:   domain,
+		Section:  section,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if lx != nil {
+		p.Term, p.Offset = lx.text, lx.pos
+	}
+	l.problems = append(l.problems, p)
+}
+
+func (l *linter) checkLookups(domain string, lookups int) {
+	// RFC 7208, section 4.6.4:
+	// SPF implementations MUST limit the total number of those terms to 10
+	// during SPF evaluation
+	if lookups > 10 {
+		l.add(SeverityError, domain, nil, "4.6.4", "%d DNS lookups exceed the limit of 10", lookups)
+	}
+}
+
+// linkedTerm is "include" or "redirect" term referencing another record.
+type linkedTerm struct {
+	lexeme
+	domain string
+}
+
+// lint checks the record and returns the number of terms causing DNS
+// lookups and the terms referencing other records, which are evaluated.
+func (l *linter) lint(domain, record string) (int, []linkedTerm) {
+	if len(record) > recordSizeLimit {
+		l.add(SeverityWarning, domain, nil, "3.4", "record is %d bytes long, it should not exceed %d bytes", len(record), recordSizeLimit)
+	}
+
+	lexemes := lexTerms(record)
+	if len(lexemes) == 0 || lexemes[0].token.mechanism != tVersion || lexemes[0].token.value != "spf1" {
+		l.add(SeverityError, domain, nil, "4.5", `record must begin with "v=spf1"`)
+		return 0, nil
+	}
+
+	var (
+		lookups  int
+		linked   []linkedTerm
+		all      *lexeme
+		redirect *linkedTerm
+		seen     = make(map[string]bool)
+	)
+	for i := range lexemes[1:] {
+		lx := &lexemes[i+1]
+		t, err := newTerm(*lx)
+		if err != nil {
+			l.add(SeverityError, domain, lx, "12", "%s", err.(*ParseError).Msg)
+			continue
+		}
+
+		if m, ok := t.(*Modifier); ok {
+			if m.Name != "redirect" && m.Name != "exp" {
+				continue
+			}
+			if seen[m.Name] {
+				l.add(SeverityError, domain, lx, "6", "%q must not appear more than once", m.Name)
+				continue
+			}
+			seen[m.Name] = true
+			if m.Name == "redirect" {
+				redirect = &linkedTerm{*lx, m.Value}
+			}
+			continue
+		}
+
+		m := t.(*Mechanism)
+		if all != nil {
+			l.add(SeverityWarning, domain, lx, "5.1", `mechanism following "all" is never evaluated`)
+			continue
+		}
+		switch m.Name {
+		case "all":
+			all = lx
+			if m.Qualifier == QualifierPass {
+				l.add(SeverityWarning, domain, lx, "5.1", "any host is authorized to send mail")
+			}
+		case "ptr":
+			l.add(SeverityWarning, domain, lx, "5.5", `"ptr" mechanism should not be used`)
+		case "ip4", "ip6":
+			if n := m.Network(); !n.IP.Equal(m.IP) {
+				l.add(SeverityWarning, domain, lx, "5.6", "host bits are set, the network is %s", n)
+			}
+		case "include":
+			linked = append(linked, linkedTerm{*lx, m.Domain})
+		}
+		if isLookupMechanism(m.Name) {
+			lookups++
+		}
+	}
+
+	if redirect != nil {
+		if all != nil {
+			l.add(SeverityWarning, domain, &redirect.lexeme, "6.1", `"redirect" is ignored, as the record contains "all"`)
+		} else {
+			lookups++
+			linked = append(linked, *redirect)
+		}
+	}
+	return lookups, linked
+}
+
+// isLookupMechanism reports whether mechanism causes a DNS lookup, see RFC
+// 7208, section 4.6.4.
+func isLookupMechanism(name string) bool {
+	switch name {
+	case "include", "a", "mx", "ptr", "exists":
+		return true
+	}
+	return false
+}
+
+// walk checks the record of domain along with the referenced records and
+// returns the total number of DNS lookups.
+func (l *linter) walk(domain, record string) int {
+	l.path[domain] = true
+	defer delete(l.path, domain)
+
+	lookups, linked := l.lint(domain, record)
+	for _, t := range linked {
+		name := t.token.mechanism.String()
+		target := strings.ToLower(strings.TrimSuffix(t.domain, "."))
+		if strings.Contains(target, "%") {
+			l.add(SeverityInfo, domain, &t.lexeme, "7", "%q with macros is not checked", name)
+			continue
+		}
+		if l.path[target] {
+			l.add(SeverityError, domain, &t.lexeme, "4.6.4", "%q loop, the evaluation always exceeds DNS lookup limit", name)
+			continue
+		}
+		if n, ok := l.lookups[target]; ok {
+			lookups += n
+			continue
+		}
+
+		section := "5.2"
+		if name == "redirect" {
+			section = "6.1"
+		}
+		r, err := lookupSPF(l.resolver, target)
+		switch err {
+		case nil:
+			n := l.walk(target, r)
+			l.lookups[target] = n
+			lookups += n
+		case ErrSPFNotFound, ErrDNSPermerror, ErrInvalidDomain:
+			l.add(SeverityError, domain, &t.lexeme, section, "no SPF record of %q", target)
+		case errTooManySPFRecords:
+			l.add(SeverityError, target, nil, "4.5", "multiple SPF records")
+		default:
+			l.add(SeverityWarning, domain, &t.lexeme, section, "looking up SPF record of %q failed: %v", target, err)
+		}
+	}
+	return lookups
+}
+
+// lookupSPF returns SPF record of domain. It returns ErrSPFNotFound if there
+// is no record and errTooManySPFRecords if there are more of them.
+func lookupSPF(resolver Resolver, domain string) (string, error) {
+	if !isDomainName(domain) {
+		return "", ErrInvalidDomain
+	}
+	txts, err := resolver.LookupTXTStrict(NormalizeFQDN(domain))
+	if err != nil {
+		return "", err
+	}
+	record, err := filterSPF(txts)
+	if err == nil && record == "" {
+		err = ErrSPFNotFound
+	}
+	return record, err
+}
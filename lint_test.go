@@ -0,0 +1,111 @@
+package spf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// lintSummary returns problems as "severity section term" strings.
+func lintSummary(problems []*Problem) []string {
+	var s []string
+	for _, p := range problems {
+		s = append(s, strings.TrimSpace(p.Domain+" "+p.Severity.String()+" "+p.Section+" "+p.Term))
+	}
+	return s
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		record   string
+		problems []string
+	}{
+		{"v=spf1 mx -all", nil},
+		{"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 exp=%{i} ra=x -all", nil},
+		{"spf1 -all", []string{"error 4.5"}},
+		{"v=spf1 foo ip4:192.0.2.0/33 mx//129 include:%{z} -all", []string{
+			"error 12 foo", "error 12 ip4:192.0.2.0/33", "error 12 mx//129", "error 12 include:%{z}",
+		}},
+		{"v=spf1 -all mx ip4:192.0.2.1", []string{"warning 5.1 mx", "warning 5.1 ip4:192.0.2.1"}},
+		{"v=spf1 mx ~all redirect=_spf.example.com", []string{"warning 6.1 redirect=_spf.example.com"}},
+		{"v=spf1 redirect=a.example.com exp=x redirect=b.example.com exp=y", []string{
+			"error 6 redirect=b.example.com", "error 6 exp=y",
+		}},
+		{"v=spf1 ptr +all", []string{"warning 5.5 ptr", "warning 5.1 +all"}},
+		{"v=spf1 ip4:192.0.2.1/24 ip6:2001:db8::1/64 ip4:192.0.2.1 -all", []string{
+			"warning 5.6 ip4:192.0.2.1/24", "warning 5.6 ip6:2001:db8::1/64",
+		}},
+		{"v=spf1 a mx a:a.example.com mx:b.example.com exists:%{i}.example.com ptr include:c.example.com include:d.example.com a:e.example.com a:f.example.com redirect=g.example.com", []string{
+			"warning 5.5 ptr", "error 4.6.4",
+		}},
+		{"v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 40) + "-all", []string{"warning 3.4"}},
+	}
+
+	for _, test := range tests {
+		problems := lintSummary(Lint(test.record))
+		if !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%q: expected %q, got %q", test.record, test.problems, problems)
+		}
+	}
+}
+
+func TestLintProblemString(t *testing.T) {
+	p := Lint("v=spf1 -all mx")[0]
+	expected := `warning: "mx" at offset 12: mechanism following "all" is never evaluated (RFC 7208, section 5.1)`
+	if s := p.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+}
+
+func TestLintDomain(t *testing.T) {
+	dns.HandleFunc("lint.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`lint.test. 0 IN TXT "v=spf1 include:a.lint.test include:none.lint.test include:%{l}.lint.test include:multi.lint.test redirect=b.lint.test"`,
+			`a.lint.test. 0 IN TXT "v=spf1 a mx include:c.lint.test ptr -all"`,
+			`b.lint.test. 0 IN TXT "v=spf1 a:x.lint.test include:c.lint.test include:loop.lint.test ~all"`,
+			`c.lint.test. 0 IN TXT "v=spf1 exists:%{i}.lint.test mx:d.lint.test ?all"`,
+			`loop.lint.test. 0 IN TXT "v=spf1 include:b.lint.test -all"`,
+			`none.lint.test. 0 IN TXT "not an SPF record"`,
+			`multi.lint.test. 0 IN TXT "v=spf1 -all"`,
+			`multi.lint.test. 0 IN TXT "v=spf1 +all"`,
+			`twice.lint.test. 0 IN TXT "v=spf1 -all"`,
+			`twice.lint.test. 0 IN TXT "v=spf1 mx -all"`,
+		},
+	}))
+	defer dns.HandleRemove("lint.test.")
+
+	problems, err := LintDomain("lint.test", testResolver)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// lint.test: 5, a.lint.test: 4, b.lint.test: 3, c.lint.test: 2 (twice),
+	// loop.lint.test: 1
+	expected := []string{
+		"a.lint.test warning 5.5 ptr",
+		"lint.test error 5.2 include:none.lint.test",
+		"lint.test info 7 include:%{l}.lint.test",
+		"multi.lint.test error 4.5",
+		"loop.lint.test error 4.6.4 include:b.lint.test",
+		"lint.test error 4.6.4",
+	}
+	if s := lintSummary(problems); !reflect.DeepEqual(s, expected) {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+	if m := problems[len(problems)-1].Message; !strings.HasPrefix(m, "17 DNS lookups") {
+		t.Errorf("unexpected message: %q", m)
+	}
+
+	problems, err = LintDomain("twice.lint.test", testResolver)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s := lintSummary(problems); !reflect.DeepEqual(s, []string{"twice.lint.test error 4.5"}) {
+		t.Errorf("unexpected problems: %q", s)
+	}
+
+	if _, err = LintDomain("none.lint.test", testResolver); err != ErrSPFNotFound {
+		t.Errorf("expected %v, got %v", ErrSPFNotFound, err)
+	}
+}
@@ -3,16 +3,14 @@ package spf
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
 const (
-	// delimiter is a constant rune other than any allowed delimiter.
-	// It indicates lack of allowed delimiters, hence no split in delimiter
-	delimiter rune = '*'
-
 	// negative is a special value indicating there will be no split on macro.
 	negative int = -1
 )
@@ -25,18 +23,21 @@ type macro struct {
 	input  string
 	output []string
 	state  stateFn
+	exp    bool
 }
 
-func newMacro(input string) *macro {
-	return &macro{0, 0, 0, len(input), input, make([]string, 0, 0), nil}
+func newMacro(input string, exp bool) *macro {
+	return &macro{0, 0, 0, len(input), input, make([]string, 0, 0), nil, exp}
 }
 
 type stateFn func(*macro, *parser) (stateFn, error)
 
 // parseMacro evaluates whole input string and replaces keywords with appropriate
 // values from
-func parseMacro(p *parser, input string) (string, error) {
-	m := newMacro(input)
+// The exp indicates whether input is an explanation string, that is the only
+// place where "c", "r" and "t" macro letters are allowed.
+func parseMacro(p *parser, input string, exp bool) (string, error) {
+	m := newMacro(input, exp)
 	var err error
 	for m.state = scanText; m.state != nil; {
 		m.state, err = m.state(m, p)
@@ -52,7 +53,56 @@ func parseMacro(p *parser, input string) (string, error) {
 // parseMacroToken evaluates whole input string and replaces keywords with appropriate
 // values from
 func parseMacroToken(p *parser, t *token) (string, error) {
-	return parseMacro(p, t.value)
+	return parseMacro(p, t.value, false)
+}
+
+// parseMacroDomain evaluates domain-spec of the token and truncates the
+// result of macro expansion, so it can be used in a DNS query.
+func parseMacroDomain(p *parser, t *token) (string, error) {
+	domain, err := parseMacroToken(p, t)
+	if err != nil {
+		return "", err
+	}
+	return domainName(domain, hasMacro(t.value))
+}
+
+// hasMacro returns true if domain-spec s contains macros.
+func hasMacro(s string) bool {
+	return strings.ContainsRune(s, '%')
+}
+
+// domainName returns name truncated as described by truncateDomainName if
+// it's the result of macro expansion. Literal names longer than 253
+// characters are invalid.
+func domainName(name string, expanded bool) (string, error) {
+	if expanded {
+		return truncateDomainName(name), nil
+	}
+	if len(strings.TrimSuffix(name, ".")) > maxDomainNameLength {
+		return "", ErrInvalidDomain
+	}
+	return name, nil
+}
+
+// maxDomainNameLength is the maximum length of a domain name in the text
+// form, excluding the trailing dot.
+const maxDomainNameLength = 253
+
+// truncateDomainName implements the rule from RFC 7208, section 7.3:
+// When the result of macro expansion is used in a domain name query, if the
+// expanded domain name exceeds 253 characters (the maximum length of a domain
+// name in this format), the left side is truncated to fit, by removing
+// successive domain labels (and their following dots) until the total length
+// does not exceed 253 characters.
+func truncateDomainName(name string) string {
+	for len(name) > maxDomainNameLength {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return name
 }
 
 // macro.eof() return true when scanned record has ended, false otherwise
@@ -129,7 +179,7 @@ func scanPercent(m *macro, p *parser) (stateFn, error) {
 type item struct {
 	value       string
 	cardinality int
-	delimiter   rune
+	delimiters  string // empty if there are no delimiters, hence no split
 	reversed    bool
 }
 
@@ -139,81 +189,67 @@ func scanMacro(m *macro, p *parser) (stateFn, error) {
 	if err != nil {
 		return nil, err
 	}
-	var curItem item
 
-	//var err error
-	var result string
-	var email *addrSpec
+	var value string
 
-	switch r {
+	switch unicode.ToLower(r) {
 	case 's':
-		curItem = item{p.Sender, negative, delimiter, false}
-		m.moveon()
-		result, err = parseDelimiter(m, &curItem)
-		if err != nil {
-			break
-		}
-		m.output = append(m.output, result)
-		m.moveon()
-
+		value = p.Sender
 	case 'l':
-		email = parseAddrSpec(p.Sender, p.Sender)
-		curItem = item{email.local, negative, delimiter, false}
-		m.moveon()
-		result, err = parseDelimiter(m, &curItem)
-		if err != nil {
-			break
-		}
-		m.output = append(m.output, result)
-		m.moveon()
-
+		value = parseAddrSpec(p.Sender, p.Sender).local
 	case 'o':
-		email = parseAddrSpec(p.Sender, p.Sender)
-		curItem = item{email.domain, negative, delimiter, false}
-		m.moveon()
-		result, err = parseDelimiter(m, &curItem)
-		if err != nil {
-			break
-		}
-		m.output = append(m.output, result)
-		m.moveon()
-
-	case 'd', 'h':
-		curItem = item{p.Domain, negative, delimiter, false}
-		m.moveon()
-		result, err = parseDelimiter(m, &curItem)
-		if err != nil {
-			break
-		}
-		m.output = append(m.output, result)
-		m.moveon()
-
+		value = parseAddrSpec(p.Sender, p.Sender).domain
+	case 'd':
+		value = p.Domain
+	case 'h':
+		value = p.cfg.helo
 	case 'i':
-		curItem = item{p.IP.String(), negative, delimiter, false}
-		m.moveon()
-		result, err = parseDelimiter(m, &curItem)
-		if err != nil {
-			break
-		}
-		m.output = append(m.output, result)
-		m.moveon()
-
+		value = dottedIP(p.IP)
 	case 'p':
-		// let's not use it for the moment, RFC doesn't recommend it.
+		value, err = p.validatedDomain()
 	case 'v':
 		// TODO(zaccone): move such functions to some generic utils module
 		if p.IP.To4() == nil {
-			m.output = append(m.output, "ip6")
+			value = "ip6"
 		} else {
-			m.output = append(m.output, "in-addr")
+			value = "in-addr"
 		}
-		m.moveon()
-		// TODO(zaccone): add remaining "c", "r", "t"
+	case 'c', 'r', 't':
+		// RFC 7208, section 7.3:
+		// The following macro letters are allowed only in "exp" text:
+		// c, r, t
+		if !m.exp {
+			return nil, fmt.Errorf("macro letter (%c) allowed only in explanation", r)
+		}
+		switch unicode.ToLower(r) {
+		case 'c':
+			value = p.IP.String()
+		case 'r':
+			value = p.cfg.receivingFQDN
+		case 't':
+			value = strconv.FormatInt(p.cfg.now().Unix(), 10)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected macro letter (%c)", r)
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
+	m.moveon()
+	curItem := item{value, negative, "", false}
+	result, err := parseDelimiter(m, &curItem)
 	if err != nil {
 		return nil, errors.New("macro parsing error: " + err.Error())
 	}
+	// Uppercase macros expand exactly as their lowercase equivalents,
+	// and are then URL escaped.
+	if unicode.IsUpper(r) {
+		result = urlEscape(result)
+	}
+	m.output = append(m.output, result)
+	m.moveon()
 
 	r, err = m.next()
 	if err != nil {
@@ -279,8 +315,12 @@ func parseDelimiter(m *macro, curItem *item) (string, error) {
 			return "", err
 		}
 	}
-	if isMacroDelimiter(r) {
-		curItem.delimiter = r
+	// RFC 7208, section 7.1: transformers may be followed by any number
+	// of delimiters, the value is split on each of them
+	for isMacroDelimiter(r) {
+		if !strings.ContainsRune(curItem.delimiters, r) {
+			curItem.delimiters += string(r)
+		}
 		r, err = m.next()
 		if err != nil {
 			return "", err
@@ -297,12 +337,12 @@ func parseDelimiter(m *macro, curItem *item) (string, error) {
 	var parts []string
 	if curItem.cardinality > 0 ||
 		curItem.reversed ||
-		curItem.delimiter != delimiter {
+		curItem.delimiters != "" {
 
-		if curItem.delimiter == delimiter {
-			curItem.delimiter = '.'
+		if curItem.delimiters == "" {
+			curItem.delimiters = "."
 		}
-		parts = strings.Split(curItem.value, string(curItem.delimiter))
+		parts = splitAny(curItem.value, curItem.delimiters)
 		if curItem.reversed {
 			first, last := 0, len(parts)-1
 			for first < last {
@@ -324,3 +364,56 @@ func parseDelimiter(m *macro, curItem *item) (string, error) {
 	}
 	return strings.Join(parts[len(parts)-curItem.cardinality:], "."), nil
 }
+
+// splitAny slices s into all substrings separated by any of delimiters.
+func splitAny(s, delimiters string) []string {
+	var parts []string
+	for {
+		i := strings.IndexAny(s, delimiters)
+		if i < 0 {
+			return append(parts, s)
+		}
+		_, n := utf8.DecodeRuneInString(s[i:])
+		parts = append(parts, s[:i])
+		s = s[i+n:]
+	}
+}
+
+// dottedIP returns ip in a format used by the "i" macro. IPv4 addresses are
+// returned in the usual dotted quad notation, whereas IPv6 addresses are
+// returned in the dot-format, that is 32 hexadecimal nibbles separated by
+// dots (RFC 7208, section 7.3).
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ip.String()
+	}
+	const hexDigits = "0123456789abcdef"
+	nibbles := make([]byte, 0, 2*2*net.IPv6len)
+	for _, b := range ip16 {
+		nibbles = append(nibbles, hexDigits[b>>4], '.', hexDigits[b&0xf], '.')
+	}
+	return string(nibbles[:len(nibbles)-1])
+}
+
+// urlEscape returns s with all characters, except those which RFC 3986
+// defines as unreserved, replaced by their percent-encoded form.
+func urlEscape(s string) string {
+	isUnreserved := func(c byte) bool {
+		return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			'0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0
+	}
+	escaped := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) {
+			escaped = append(escaped, c)
+			continue
+		}
+		escaped = append(escaped, fmt.Sprintf("%%%02X", c)...)
+	}
+	return string(escaped)
+}
@@ -2,7 +2,11 @@ package spf
 
 import (
 	"net"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 const (
@@ -35,6 +39,8 @@ func TestMacroIteration(t *testing.T) {
 			"Please email to domain.com end"},
 		{"Domain %{d} end",
 			"Domain matching.com end"},
+		{"HELO %{h} end",
+			"HELO unknown end"},
 		{"Address IP %{i} end",
 			"Address IP 10.11.12.13 end"},
 		{"Address IP %{i1} end",
@@ -93,6 +99,9 @@ func TestMacroExpansionRFCExamples(t *testing.T) {
 			"3.2.0.192.in-addr.strong.lp._spf.example.com"},
 		{"%{d2}.trusted-domains.example.net",
 			"example.com.trusted-domains.example.net"},
+		{"%{S}", "strong-bad%40email.example.com"},
+		{"%{L2-}", "strong.bad"},
+		{"%{vr}", "in-addr"},
 	}
 
 	parser := newParser("strong-bad@email.example.com",
@@ -113,6 +122,202 @@ func TestMacroExpansionRFCExamples(t *testing.T) {
 	}
 }
 
+// TestMacroExpansionDelimiters checks the value is split on any of multiple
+// delimiters (RFC 7208, section 7.1).
+func TestMacroExpansionDelimiters(t *testing.T) {
+	testCases := []*MacroTest{
+		{"%{l-}", "first.last.tag+x"},
+		{"%{l--}", "first.last.tag+x"},
+		{"%{l-+}", "first.last.tag.x"},
+		{"%{l+-}", "first.last.tag.x"},
+		{"%{l1r-+}", "first.last"},
+		{"%{l2r.-+}", "last.first"},
+		{"%{l.-+}", "first.last.tag.x"},
+		{"%{lr=/_,.}", "last-tag+x.first"},
+	}
+
+	parser := newParser("first.last-tag+x@example.com",
+		"example.com", net.IP{192, 0, 2, 3}, stub, testResolver)
+
+	for _, test := range testCases {
+		tkn.value = test.Input
+		result, err := parseMacroToken(parser, tkn)
+		if err != nil {
+			t.Errorf("Macro %s evaluation failed due to returned error: %v\n",
+				test.Input, err)
+		}
+		if result != test.Output {
+			t.Errorf("Macro '%s', evaluation failed, got: '%s',\nexpected '%s'\n",
+				test.Input, result, test.Output)
+		}
+	}
+
+	tkn.value = "%{l-r}"
+	if _, err := parseMacroToken(parser, tkn); err == nil {
+		t.Errorf("Macro %s evaluation expected to fail", tkn.value)
+	}
+}
+
+// TestMacroExpansionIPv6 will execute IPv6 example from RFC 7208, section 7.4
+func TestMacroExpansionIPv6(t *testing.T) {
+	testCases := []*MacroTest{
+		{"%{i}", "2.0.0.1.0.d.b.8.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.c.b.0.1"},
+		{"%{ir}.%{v}._spf.%{d2}",
+			"1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+	}
+
+	parser := newParser("strong-bad@email.example.com",
+		"email.example.com", net.ParseIP("2001:db8::cb01"), stub, testResolver)
+
+	for _, test := range testCases {
+		tkn.value = test.Input
+		result, err := parseMacroToken(parser, tkn)
+		if err != nil {
+			t.Errorf("Macro %s evaluation failed due to returned error: %v\n",
+				test.Input, err)
+		}
+		if result != test.Output {
+			t.Errorf("Macro '%s', evaluation failed, got: '%s',\nexpected '%s'\n",
+				test.Input, result, test.Output)
+		}
+	}
+}
+
+// TestMacroExpansionExplanation executes macro letters allowed only in the
+// explanation string.
+func TestMacroExpansionExplanation(t *testing.T) {
+	testCases := []*MacroTest{
+		{"%{c}", "192.0.2.3"},
+		{"%{r}", "mx.example.org"},
+		{"%{t}", "1500000000"},
+		{"%{c} is not allowed to send mail on behalf of %{d} (checked by %{r} at %{t})",
+			"192.0.2.3 is not allowed to send mail on behalf of email.example.com (checked by mx.example.org at 1500000000)"},
+	}
+
+	parser := newParser("strong-bad@email.example.com",
+		"email.example.com", net.IP{192, 0, 2, 3}, stub, testResolver)
+	parser.cfg = newConfig([]Option{
+		WithReceivingFQDN("mx.example.org"),
+		WithClock(func() time.Time { return time.Unix(1500000000, 0) }),
+	})
+
+	for _, test := range testCases {
+		result, err := parseMacro(parser, test.Input, true)
+		if err != nil {
+			t.Errorf("Macro %s evaluation failed due to returned error: %v\n",
+				test.Input, err)
+		}
+		if result != test.Output {
+			t.Errorf("Macro '%s', evaluation failed, got: '%s',\nexpected '%s'\n",
+				test.Input, result, test.Output)
+		}
+	}
+
+	// default value of the receiving host name
+	parser.cfg = newConfig(nil)
+	if result, _ := parseMacro(parser, "%{r}", true); result != "unknown" {
+		t.Errorf("Macro '%%{r}' evaluation failed, got: '%s', expected 'unknown'", result)
+	}
+
+	_, err := parseMacro(parser, "%{x}", true)
+	if err == nil || err.Error() != "unexpected macro letter (x)" {
+		t.Errorf("Macro '%%{x}' expected error 'unexpected macro letter (x)', got: %v", err)
+	}
+}
+
+func TestMacroExpansionValidatedDomain(t *testing.T) {
+	dns.HandleFunc("in-addr.arpa.", zone(map[uint16][]string{
+		dns.TypePTR: {
+			"1.0.0.10.in-addr.arpa. 0 IN PTR mail.example.org.",
+			"1.0.0.10.in-addr.arpa. 0 IN PTR mail.macro.test.",
+			"2.0.0.10.in-addr.arpa. 0 IN PTR mail.example.org.",
+		},
+	}))
+	defer dns.HandleRemove("in-addr.arpa.")
+
+	dns.HandleFunc("example.org.", zone(map[uint16][]string{
+		dns.TypeA: {
+			"mail.example.org. 0 IN A 10.0.0.1",
+			"mail.example.org. 0 IN A 10.0.0.2",
+		},
+	}))
+	defer dns.HandleRemove("example.org.")
+
+	dns.HandleFunc("macro.test.", zone(map[uint16][]string{
+		dns.TypeA: {
+			"mail.macro.test. 0 IN A 10.0.0.1",
+		},
+	}))
+	defer dns.HandleRemove("macro.test.")
+
+	testCases := []struct {
+		domain string
+		ip     net.IP
+		output string
+	}{
+		{"macro.test", net.IP{10, 0, 0, 1}, "mail.macro.test"},
+		{"mail.example.org", net.IP{10, 0, 0, 1}, "mail.example.org"},
+		{"other.test", net.IP{10, 0, 0, 2}, "mail.example.org"},
+		{"other.test", net.IP{10, 0, 0, 3}, "unknown"},
+	}
+
+	for _, test := range testCases {
+		parser := newParser(sender, test.domain, test.ip, stub, testResolver)
+		result, err := parseMacro(parser, "%{p}", false)
+		if err != nil {
+			t.Errorf("Macro %%{p} evaluation failed due to returned error: %v", err)
+		}
+		if result != test.output {
+			t.Errorf("Macro %%{p} evaluation failed for %s, got: '%s', expected '%s'",
+				test.ip, result, test.output)
+		}
+	}
+}
+
+func TestTruncateDomainName(t *testing.T) {
+	label := strings.Repeat("a", 63)
+	long := strings.Join([]string{"x", label, label, label, label, "com"}, ".")
+
+	testCases := []*MacroTest{
+		{"example.com", "example.com"},
+		{long, strings.Join([]string{label, label, label, "com"}, ".")},
+		{strings.Repeat("a", 300), strings.Repeat("a", 300)},
+	}
+
+	for _, test := range testCases {
+		if result := truncateDomainName(test.Input); result != test.Output {
+			t.Errorf("truncateDomainName(%q) = %q, expected %q",
+				test.Input, result, test.Output)
+		}
+	}
+
+	// expansion of the domain-spec is truncated as well
+	parser := newParser(long, long, ip4, stub, testResolver)
+	result, err := parseMacroDomain(parser, &token{tExists, qPlus, "%{d}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) > 253 || !strings.HasSuffix(long, result) {
+		t.Errorf("parseMacroDomain returned %q, expected truncated %q", result, long)
+	}
+	if host, _, _, err := parser.dualCIDRDomain(&token{tA, qPlus, "%{d}/24"}); err != nil || host != result {
+		t.Errorf("dualCIDRDomain returned %q, %v, expected %q", host, err, result)
+	}
+
+	// literal domain-spec is not truncated, but invalid
+	if _, err := parseMacroDomain(parser, &token{tExists, qPlus, long}); err != ErrInvalidDomain {
+		t.Errorf("parseMacroDomain returned %v, expected %v", err, ErrInvalidDomain)
+	}
+	if _, _, _, err := parser.dualCIDRDomain(&token{tA, qPlus, long + "/24"}); err != ErrInvalidDomain {
+		t.Errorf("dualCIDRDomain returned %v, expected %v", err, ErrInvalidDomain)
+	}
+	for _, record := range []string{"v=spf1 a:" + long + " -all", "v=spf1 include:" + long + " -all"} {
+		if r, _, _ := newParser(long, "example.com", ip4, record, testResolver).parse(); r != Permerror {
+			t.Errorf("%q: expected %v, got %v", record, Permerror, r)
+		}
+	}
+}
+
 // TODO(zaccone): Fill epected error messages and compare with those returned.
 func TestParsingErrors(t *testing.T) {
 	testcases := []*MacroTest{
@@ -134,6 +339,10 @@ func TestParsingErrors(t *testing.T) {
 		{"%{o2a3}", ""},
 		{"%{d2a3}", ""},
 		{"%{i-2}", ""},
+		{"%{x}", ""},
+		{"%{c}", ""},
+		{"%{r}", ""},
+		{"%{t}", ""},
 	}
 
 	parser := newParser(sender, domain, ip4, stub, testResolver)
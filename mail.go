@@ -34,3 +34,104 @@ func parseAddrSpec(addr, domain string) *addrSpec {
 
 	return &addrSpec{l, d}
 }
+
+// Mailbox is an e-mail address from SMTP reverse-path. The local part is kept
+// as it's written in the path, including quotes of a quoted string.
+type Mailbox struct {
+	Local  string
+	Domain string
+
+	null bool
+}
+
+// String returns the mailbox in the local@domain form. It returns an empty
+// string for the null reverse-path and for the zero Mailbox.
+func (m Mailbox) String() string {
+	if m.null || m.Local == "" && m.Domain == "" {
+		return ""
+	}
+	return m.Local + "@" + m.Domain
+}
+
+// IsNull reports whether m is the null reverse-path "<>" as returned by
+// ParseReversePath. The zero Mailbox, which is returned along with an error,
+// is not the null reverse-path.
+func (m Mailbox) IsNull() bool {
+	return m.null
+}
+
+// ParseReversePath parses the reverse-path of the SMTP MAIL FROM command as
+// defined by RFC 5321, section 4.1.2. The null reverse-path "<>" results in
+// Mailbox for which IsNull reports true. Source routes are ignored as
+// RFC 5321 requires, ESMTP parameters following the path are ignored too.
+// Angle brackets are optional, as some clients omit them.
+func ParseReversePath(path string) (Mailbox, error) {
+	path = strings.TrimSpace(path)
+	if path == "" || path == "<>" || strings.HasPrefix(path, "<> ") || strings.HasPrefix(path, "<>\t") {
+		return Mailbox{null: true}, nil
+	}
+
+	bracket := path[0] == '<'
+	if bracket {
+		path = path[1:]
+	}
+
+	// A-d-l ":"
+	if strings.HasPrefix(path, "@") {
+		i := strings.IndexByte(path, ':')
+		if i < 0 {
+			return Mailbox{}, ErrInvalidReversePath
+		}
+		path = path[i+1:]
+	}
+
+	local, rest, err := splitLocalPart(path)
+	if err != nil {
+		return Mailbox{}, err
+	}
+
+	var domain string
+	if i := strings.IndexAny(rest, "> \t"); i < 0 {
+		domain = rest
+		rest = ""
+	} else {
+		domain = rest[:i]
+		rest = rest[i:]
+	}
+	if bracket {
+		if !strings.HasPrefix(rest, ">") {
+			return Mailbox{}, ErrInvalidReversePath
+		}
+		rest = rest[1:]
+	}
+	if domain == "" || (rest != "" && rest[0] != ' ' && rest[0] != '\t') {
+		return Mailbox{}, ErrInvalidReversePath
+	}
+
+	return Mailbox{Local: local, Domain: domain}, nil
+}
+
+// splitLocalPart splits the mailbox at "@" following the local part, which
+// is either a dot-string or a quoted string. The returned rest follows "@".
+func splitLocalPart(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++ // quoted-pair
+			case '"':
+				if i+1 < len(s) && s[i+1] == '@' {
+					return s[:i+1], s[i+2:], nil
+				}
+				return "", "", ErrInvalidReversePath
+			}
+		}
+		return "", "", ErrInvalidReversePath
+	}
+
+	i := strings.IndexByte(s, '@')
+	if i <= 0 || strings.ContainsAny(s[:i], "<>()[]\\,;:\" \t") {
+		return "", "", ErrInvalidReversePath
+	}
+	return s[:i], s[i+1:], nil
+}
@@ -0,0 +1,55 @@
+package spf
+
+import "testing"
+
+func TestParseReversePath(t *testing.T) {
+	samples := []struct {
+		path string
+		m    Mailbox
+		err  error
+	}{
+		{"<>", Mailbox{null: true}, nil},
+		{"", Mailbox{null: true}, nil},
+		{" <> ", Mailbox{null: true}, nil},
+		{"<> SIZE=1000", Mailbox{null: true}, nil},
+		{"<>\tBODY=8BITMIME", Mailbox{null: true}, nil},
+		{"<>trailing", Mailbox{}, ErrInvalidReversePath},
+		{"<user@example.com>", Mailbox{Local: "user", Domain: "example.com"}, nil},
+		{"user@example.com", Mailbox{Local: "user", Domain: "example.com"}, nil},
+		{"<user@example.com> SIZE=1024 BODY=8BITMIME", Mailbox{Local: "user", Domain: "example.com"}, nil},
+		{"<first.last+tag@example.com>", Mailbox{Local: "first.last+tag", Domain: "example.com"}, nil},
+		{`<"john doe"@example.com>`, Mailbox{Local: `"john doe"`, Domain: "example.com"}, nil},
+		{`<"a@b\"c"@example.com>`, Mailbox{Local: `"a@b\"c"`, Domain: "example.com"}, nil},
+		{"<@relay.example.net:user@example.com>", Mailbox{Local: "user", Domain: "example.com"}, nil},
+		{"<@one.example.net,@two.example.net:user@example.com>", Mailbox{Local: "user", Domain: "example.com"}, nil},
+		{"<user@[192.0.2.1]>", Mailbox{Local: "user", Domain: "[192.0.2.1]"}, nil},
+		{"<user@example.com", Mailbox{}, ErrInvalidReversePath},
+		{"<user>", Mailbox{}, ErrInvalidReversePath},
+		{"<@example.com>", Mailbox{}, ErrInvalidReversePath},
+		{"<user@>", Mailbox{}, ErrInvalidReversePath},
+		{"<@relay.example.net>", Mailbox{}, ErrInvalidReversePath},
+		{`<"unterminated@example.com>`, Mailbox{}, ErrInvalidReversePath},
+		{`<"quoted"example.com>`, Mailbox{}, ErrInvalidReversePath},
+		{"<john doe@example.com>", Mailbox{}, ErrInvalidReversePath},
+		{"<user@example.com>trailing", Mailbox{}, ErrInvalidReversePath},
+	}
+
+	for _, s := range samples {
+		m, err := ParseReversePath(s.path)
+		if m != s.m || err != s.err {
+			t.Errorf("ParseReversePath(%q) want [%+v %v], got [%+v %v]", s.path, s.m, s.err, m, err)
+		}
+		if err != nil && m.IsNull() {
+			t.Errorf("ParseReversePath(%q) returned the null reverse-path along with error", s.path)
+		}
+	}
+}
+
+func TestMailboxString(t *testing.T) {
+	if s := (Mailbox{Local: `"john doe"`, Domain: "example.com"}).String(); s != `"john doe"@example.com` {
+		t.Errorf("unexpected mailbox string: %q", s)
+	}
+	if s := (Mailbox{null: true}).String(); s != "" {
+		t.Errorf("unexpected null mailbox string: %q", s)
+	}
+}
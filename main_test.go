@@ -1,6 +1,7 @@
 package spf
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -15,7 +16,13 @@ import (
 var testResolver Resolver
 
 func TestMain(m *testing.M) {
-	s, err := runLocalUDPServer("127.0.0.1:0")
+	s, err := runLocalUDPServer("127.0.0.1:0", nil)
+	if err != nil {
+		panic(fmt.Sprintf("unable to run local server: %v", err))
+	}
+
+	// TCP server on the same port serves queries retried over TCP
+	ts, err := runLocalTCPServer(s.PacketConn.LocalAddr().String())
 	if err != nil {
 		panic(fmt.Sprintf("unable to run local server: %v", err))
 	}
@@ -25,18 +32,21 @@ func TestMain(m *testing.M) {
 	defer func() {
 		dns.HandleRemove(".")
 		_ = s.Shutdown()
+		_ = ts.Shutdown()
 	}()
 
 	testResolver, _ = NewMiekgDNSResolver(s.PacketConn.LocalAddr().String())
 	os.Exit(m.Run())
 }
 
-func runLocalUDPServer(laddr string) (*dns.Server, error) {
+// runLocalUDPServer runs a server, which serves queries with handler, or
+// with the handlers registered by dns.HandleFunc if it's nil.
+func runLocalUDPServer(laddr string, handler dns.Handler) (*dns.Server, error) {
 	pc, err := net.ListenPacket("udp", laddr)
 	if err != nil {
 		return nil, err
 	}
-	server := &dns.Server{PacketConn: pc, ReadTimeout: time.Second, WriteTimeout: time.Second}
+	server := &dns.Server{PacketConn: pc, Handler: handler, ReadTimeout: time.Second, WriteTimeout: time.Second}
 
 	waitLock := sync.Mutex{}
 	waitLock.Lock()
@@ -51,6 +61,26 @@ func runLocalUDPServer(laddr string) (*dns.Server, error) {
 	return server, nil
 }
 
+func runLocalTCPServer(laddr string) (*dns.Server, error) {
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	server := &dns.Server{Listener: l, ReadTimeout: time.Second, WriteTimeout: time.Second}
+
+	waitLock := sync.Mutex{}
+	waitLock.Lock()
+	server.NotifyStartedFunc = waitLock.Unlock
+
+	go func() {
+		_ = server.ActivateAndServe()
+		_ = l.Close()
+	}()
+
+	waitLock.Lock()
+	return server, nil
+}
+
 func rootZone(w dns.ResponseWriter, req *dns.Msg) {
 	m := new(dns.Msg)
 	switch req.Question[0].Name {
@@ -89,3 +119,51 @@ func zone(zone map[uint16][]string) func(dns.ResponseWriter, *dns.Msg) {
 		_ = w.WriteMsg(m)
 	}
 }
+
+// serializedResolver passes one query at a time to the wrapped resolver, the
+// way MiekgDNSResolver used to exchange its queries.
+type serializedResolver struct {
+	mu       sync.Mutex
+	resolver QueryResolver
+}
+
+func (r *serializedResolver) QueryContext(ctx context.Context, name string, qtype uint16) (*Answer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.resolver.QueryContext(ctx, name, qtype)
+}
+
+func BenchmarkMiekgDNSResolver(b *testing.B) {
+	hosts := make(map[uint16][]string)
+	for i := 0; i < 5; i++ {
+		hosts[dns.TypeMX] = append(hosts[dns.TypeMX], fmt.Sprintf("bench.test. 0 IN MX %d mx%d.bench.test.", i, i))
+		hosts[dns.TypeA] = append(hosts[dns.TypeA], fmt.Sprintf("mx%d.bench.test. 0 IN A 10.0.0.%d", i, i))
+	}
+	handler := zone(hosts)
+	// simulate the round trip to a remote server
+	dns.HandleFunc("bench.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(time.Millisecond)
+		handler(w, req)
+	})
+	defer dns.HandleRemove("bench.test.")
+
+	ctx := context.Background()
+	matcher := func(net.IP) (bool, error) { return false, nil }
+	for _, bm := range []struct {
+		name     string
+		resolver ResolverContext
+	}{
+		{"serialized", queryResolver{&serializedResolver{resolver: testResolver.(QueryResolver)}}},
+		{"concurrent", testResolver.(ResolverContext)},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := bm.resolver.MatchMXContext(ctx, "bench.test.", matcher); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
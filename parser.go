@@ -1,6 +1,7 @@
 package spf
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -46,13 +47,17 @@ type parser struct {
 	Explanation *token
 	Redirect    *token
 	resolver    Resolver
+	cfg         *config
+	match       *match
+	nested      *match // evaluation of the last "include" or "redirect"
+	trace       *Trace
 }
 
 // newParser creates new Parser objects and returns its reference.
 // It accepts CheckHost() parameters as well as SPF query (fetched from TXT RR
 // during initial DNS lookup.
 func newParser(sender, domain string, ip net.IP, query string, resolver Resolver) *parser {
-	return &parser{sender, domain, ip, query, make([]*token, 0, 10), nil, nil, resolver}
+	return &parser{sender, domain, ip, query, make([]*token, 0, 10), nil, nil, resolver, newConfig(nil), nil, nil, nil}
 }
 
 // parse aggregates all steps required for SPF evaluation.
@@ -61,17 +66,25 @@ func newParser(sender, domain string, ip net.IP, query string, resolver Resolver
 // each token (from left to right). Once a token matches parse stops and
 // returns matched result.
 func (p *parser) parse() (Result, string, error) {
-	tokens := lex(p.Query)
+	record, err := Parse(p.Query)
+	if err != nil {
+		return Permerror, "", err
+	}
 
-	if err := p.sortTokens(tokens); err != nil {
+	if err := p.sortTokens(record.tokens()); err != nil {
 		return Permerror, "", err
 	}
 
 	var result = Neutral
 	var matches bool
-	var err error
 
 	for _, token := range p.Mechanisms {
+		var term *TraceTerm
+		if token.mechanism != tVersion {
+			term = p.trace.term(token)
+		}
+		p.nested = nil
+
 		switch token.mechanism {
 		case tVersion:
 			matches, result, err = p.parseVersion(token)
@@ -85,15 +98,36 @@ func (p *parser) parse() (Result, string, error) {
 			matches, result, err = p.parseIP6(token)
 		case tMX:
 			matches, result, err = p.parseMX(token)
+		case tPTR:
+			matches, result, err = p.parsePTR(token)
 		case tInclude:
 			matches, result, err = p.parseInclude(token)
 		case tExists:
 			matches, result, err = p.parseExists(token)
 		}
 
+		switch err {
+		case ErrDNSLimitExceeded, ErrDNSVoidLookupLimitExceeded:
+			// Exceeding any of lookup limits MUST produce "permerror"
+			// result regardless of whether the term matched.
+			p.trace.done(term, true, Permerror, err)
+			p.match.matched(token, p.nested)
+			return Permerror, "", err
+		case context.Canceled, context.DeadlineExceeded:
+			// Evaluation was interrupted by the caller, see
+			// CheckHostWithResolverContext.
+			p.trace.done(term, true, Temperror, err)
+			p.match.matched(token, p.nested)
+			return Temperror, "", err
+		}
+		p.trace.done(term, matches, result, err)
+
 		if matches {
-			if result == Fail && p.Explanation != nil {
+			p.match.matched(token, p.nested)
+			if result == Fail && p.Explanation != nil && p.cfg.explanation {
+				term := p.trace.term(p.Explanation)
 				explanation, expError := p.handleExplanation()
+				p.trace.done(term, false, result, expError)
 				return result, explanation, expError
 			}
 			return result, "", err
@@ -101,9 +135,15 @@ func (p *parser) parse() (Result, string, error) {
 
 	}
 
-	result, err = p.handleRedirect(Neutral)
+	if p.Redirect != nil {
+		term := p.trace.term(p.Redirect)
+		result, explanation, err := p.handleRedirect(Neutral)
+		p.trace.done(term, true, result, err)
+		p.match.matched(p.Redirect, p.nested)
+		return result, explanation, err
+	}
 
-	return result, "", err
+	return Neutral, "", nil
 }
 
 func (p *parser) sortTokens(tokens []*token) error {
@@ -132,6 +172,7 @@ func (p *parser) sortTokens(tokens []*token) error {
 					return errors.New(`too many "exp"`)
 				}
 			}
+			// unknown modifiers are ignored
 		}
 	}
 
@@ -149,6 +190,67 @@ func nonemptyString(s, def string) string {
 	return s
 }
 
+// dualCIDRDomain returns the target domain and the network masks of
+// dual-cidr-length of "a" or "mx" mechanism t. The checked domain is used in
+// place of the omitted domain-spec, e.g. "a" or "a/24". The dual-cidr-length
+// is split off first, so only the domain-spec is expanded and macros can't
+// produce the lengths. The domain is truncated if it's expanded from macros,
+// see domainName.
+func (p *parser) dualCIDRDomain(t *token) (string, net.IPMask, net.IPMask, error) {
+	var ip4Len, ip6Len string
+	i := cidrIndex(t.value)
+	spec, parts := t.value[:i], strings.SplitN(t.value[i:], "/", 3)
+	if len(parts) > 1 {
+		ip4Len = parts[1]
+	}
+	if len(parts) > 2 {
+		ip6Len = parts[2]
+	}
+
+	domain := p.Domain
+	if spec != "" {
+		var err error
+		if domain, err = parseMacro(p, spec, false); err != nil {
+			return "", nil, nil, err
+		}
+		if domain, err = domainName(domain, hasMacro(spec)); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	if !isDomainName(domain) {
+		return "", nil, nil, ErrInvalidDomain
+	}
+	ip4Mask, err := parseCIDRMask(ip4Len, 8*net.IPv4len)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	ip6Mask, err := parseCIDRMask(ip6Len, 8*net.IPv6len)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return domain, ip4Mask, ip6Mask, nil
+}
+
+// cidrIndex returns the index of "/" starting dual-cidr-length of the value
+// of "a" or "mx" mechanism s, or len(s) if there's none. Slashes of macros,
+// e.g. "%{l/}", are delimiters, thus they are skipped.
+func cidrIndex(s string) int {
+	macro := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '%' && !macro:
+			// "%{" starts a macro, "%%", "%_" and "%-" are escapes
+			macro = i+1 < len(s) && s[i+1] == '{'
+			i++
+		case s[i] == '}':
+			macro = false
+		case s[i] == '/' && !macro:
+			return i
+		}
+	}
+	return len(s)
+}
+
 func (p *parser) parseVersion(t *token) (bool, Result, error) {
 	if t.value == "spf1" {
 		return false, None, nil
@@ -203,7 +305,7 @@ func (p *parser) parseIP6(t *token) (bool, Result, error) {
 }
 
 func (p *parser) parseA(t *token) (bool, Result, error) {
-	host, ip4Mask, ip6Mask, err := splitDomainDualCIDR(nonemptyString(t.value, p.Domain))
+	host, ip4Mask, ip6Mask, err := p.dualCIDRDomain(t)
 	if err != nil {
 		return true, Permerror, SyntaxError{t, err}
 	}
@@ -226,7 +328,7 @@ func (p *parser) parseA(t *token) (bool, Result, error) {
 }
 
 func (p *parser) parseMX(t *token) (bool, Result, error) {
-	host, ip4Mask, ip6Mask, err := splitDomainDualCIDR(nonemptyString(t.value, p.Domain))
+	host, ip4Mask, ip6Mask, err := p.dualCIDRDomain(t)
 	if err != nil {
 		return true, Permerror, SyntaxError{t, err}
 	}
@@ -247,12 +349,91 @@ func (p *parser) parseMX(t *token) (bool, Result, error) {
 	return found, result, err
 }
 
+// parsePTR evaluates "ptr" mechanism as described in RFC 7208, section 5.5.
+// Names returned by the reverse lookup of p.IP are validated by the resolver,
+// the mechanism matches if the target domain equals to or is a parent of
+// any validated name.
+func (p *parser) parsePTR(t *token) (bool, Result, error) {
+	fqdn, err := parseMacroDomain(p, t)
+	if err != nil {
+		return true, Permerror, SyntaxError{t, err}
+	}
+	fqdn = nonemptyString(fqdn, p.Domain)
+	if !isDomainName(fqdn) {
+		return true, Permerror, SyntaxError{t, ErrInvalidDomain}
+	}
+
+	result, _ := matchingResult(t.qualifier)
+
+	names, err := lookupPTR(p.resolver, p.IP)
+	switch err {
+	case nil:
+		// continue
+	case ErrDNSLimitExceeded, ErrDNSVoidLookupLimitExceeded:
+		return true, Permerror, err
+	case context.Canceled, context.DeadlineExceeded:
+		return false, result, err
+	default:
+		// If a DNS error occurs while doing the PTR RR lookup,
+		// then this mechanism fails to match.
+		return false, result, nil
+	}
+
+	fqdn = strings.ToLower(NormalizeFQDN(fqdn))
+	for _, name := range names {
+		name = strings.ToLower(NormalizeFQDN(name))
+		if name == fqdn || strings.HasSuffix(name, "."+fqdn) {
+			return true, result, nil
+		}
+	}
+	return false, result, nil
+}
+
+// validatedDomain returns the validated domain name of p.IP, used as the
+// value of the "p" macro. As per RFC 7208, section 7.3, the target domain is
+// preferred over its subdomains, which are in turn preferred over any other
+// validated name. If there are no validated names, or if a DNS error
+// occurs, the string "unknown" is used.
+func (p *parser) validatedDomain() (string, error) {
+	const unknown = "unknown"
+
+	names, err := lookupPTR(p.resolver, p.IP)
+	switch err {
+	case nil:
+		// continue
+	case ErrDNSLimitExceeded, ErrDNSVoidLookupLimitExceeded:
+		return "", err
+	default:
+		return unknown, nil
+	}
+	if len(names) == 0 {
+		return unknown, nil
+	}
+
+	domain := strings.ToLower(NormalizeFQDN(p.Domain))
+	for _, name := range names {
+		if strings.ToLower(NormalizeFQDN(name)) == domain {
+			return strings.TrimSuffix(name, "."), nil
+		}
+	}
+	for _, name := range names {
+		if strings.HasSuffix(strings.ToLower(NormalizeFQDN(name)), "."+domain) {
+			return strings.TrimSuffix(name, "."), nil
+		}
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
+
 func (p *parser) parseInclude(t *token) (bool, Result, error) {
-	domain := t.value
+	domain, err := parseMacroDomain(p, t)
+	if err != nil {
+		return true, Permerror, SyntaxError{t, err}
+	}
 	if domain == "" {
 		return true, Permerror, SyntaxError{t, errors.New("empty domain")}
 	}
-	theirResult, _, err := CheckHostWithResolver(p.IP, domain, p.Sender, p.resolver)
+	p.nested = p.match.nest(domain)
+	theirResult, _, err := checkHost(p.IP, domain, p.Sender, p.resolver, p.cfg, p.nested, p.trace.nest(domain))
 
 	/* Adhere to following result table:
 	* +---------------------------------+---------------------------------+
@@ -275,7 +456,12 @@ func (p *parser) parseInclude(t *token) (bool, Result, error) {
 	  +---------------------------------+---------------------------------+
 	*/
 
-	if err != nil {
+	// Syntax errors of the included record, either of the record itself or
+	// of the macros of its terms, are reported along with the "include"
+	// term, other errors, e.g. exceeded limits or canceled context, are
+	// returned as they are.
+	switch err.(type) {
+	case SyntaxError, *ParseError:
 		err = SyntaxError{t, err}
 	}
 
@@ -296,7 +482,7 @@ func (p *parser) parseInclude(t *token) (bool, Result, error) {
 }
 
 func (p *parser) parseExists(t *token) (bool, Result, error) {
-	resolvedDomain, err := parseMacroToken(p, t)
+	resolvedDomain, err := parseMacroDomain(p, t)
 	if err != nil {
 		return true, Permerror, SyntaxError{t, err}
 	}
@@ -317,21 +503,30 @@ func (p *parser) parseExists(t *token) (bool, Result, error) {
 	}
 }
 
-func (p *parser) handleRedirect(oldResult Result) (Result, error) {
+// handleRedirect evaluates "redirect" modifier. As per RFC 7208, section 6.1,
+// the explanation of the target record is returned along with its result.
+func (p *parser) handleRedirect(oldResult Result) (Result, string, error) {
 	if p.Redirect == nil {
-		return oldResult, nil
+		return oldResult, "", nil
 	}
 
 	var (
-		err    error
-		result Result
+		err         error
+		result      Result
+		explanation string
 	)
 
-	redirectDomain := p.Redirect.value
+	redirectDomain, err := parseMacroDomain(p, p.Redirect)
+	if err != nil {
+		return Permerror, "", SyntaxError{p.Redirect, err}
+	}
 
-	if result, _, err = CheckHostWithResolver(p.IP, redirectDomain, p.Sender, p.resolver); err != nil {
+	p.nested = p.match.nest(redirectDomain)
+	if result, explanation, err = checkHost(p.IP, redirectDomain, p.Sender, p.resolver, p.cfg, p.nested, p.trace.nest(redirectDomain)); err != nil {
 		//TODO(zaccone): confirm result value
-		result = Permerror
+		if result != Temperror {
+			result = Permerror
+		}
 	} else if result == None || result == Permerror {
 		// See RFC7208, section 6.1
 		//
@@ -340,11 +535,11 @@ func (p *parser) handleRedirect(oldResult Result) (Result, error) {
 		result = Permerror
 	}
 
-	return result, err
+	return result, explanation, err
 }
 
 func (p *parser) handleExplanation() (string, error) {
-	domain, err := parseMacroToken(p, p.Explanation)
+	domain, err := parseMacroDomain(p, p.Explanation)
 	if err != nil {
 		return "", SyntaxError{p.Explanation, err}
 	}
@@ -359,7 +554,7 @@ func (p *parser) handleExplanation() (string, error) {
 
 	// RFC 7208, section 6.2 specifies that result strings should be
 	// concatenated with no spaces.
-	exp, err := parseMacro(p, strings.Join(txts, ""))
+	exp, err := parseMacro(p, strings.Join(txts, ""), true)
 	if err != nil {
 		return "", SyntaxError{p.Explanation, err}
 	}
@@ -383,36 +578,3 @@ func parseCIDRMask(s string, bits int) (net.IPMask, error) {
 	}
 	return mask, nil
 }
-
-func splitDomainDualCIDR(domain string) (string, net.IPMask, net.IPMask, error) {
-	var (
-		ip4Mask net.IPMask
-		ip6Mask net.IPMask
-		ip4Len  string
-		ip6Len  string
-		err     error
-	)
-
-	parts := strings.SplitN(domain, "/", 3)
-	domain = parts[0]
-	if len(parts) > 1 {
-		ip4Len = parts[1]
-	}
-	if len(parts) > 2 {
-		ip6Len = parts[2]
-	}
-
-	if !isDomainName(domain) {
-		return "", nil, nil, ErrInvalidDomain
-	}
-	ip4Mask, err = parseCIDRMask(ip4Len, 8*net.IPv4len)
-	if err != nil {
-		return "", nil, nil, err
-	}
-	ip6Mask, err = parseCIDRMask(ip6Len, 8*net.IPv6len)
-	if err != nil {
-		return "", nil, nil, err
-	}
-
-	return domain, ip4Mask, ip6Mask, nil
-}
@@ -184,6 +184,27 @@ func TestTokensSoriting(t *testing.T) {
 
 }
 
+func TestTokensSortingUnknownModifiers(t *testing.T) {
+	tokens := []*token{
+		{tVersion, qPlus, "spf1"},
+		{tUnknownModifier, qPlus, "ra=postmaster"},
+		{tMX, qTilde, "example.org"},
+		{tAll, qMinus, ""},
+		{tUnknownModifier, qPlus, "rp=100"},
+	}
+
+	p := newParser(stub, stub, ip, stub, testResolver)
+	if err := p.sortTokens(tokens); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(p.Mechanisms, []*token{tokens[0], tokens[2], tokens[3]}) {
+		t.Error("Mechanisms mistmatch, got: ", p.Mechanisms)
+	}
+	if p.Redirect != nil || p.Explanation != nil {
+		t.Error("unknown modifiers sorted as known ones, got: ", p.Redirect, p.Explanation)
+	}
+}
+
 func TestTokensSoritingHandleErrors(t *testing.T) {
 	versionToken := &token{tVersion, qPlus, "spf1"}
 	type TestCase struct {
@@ -355,6 +376,42 @@ func TestParseA(t *testing.T) {
 	}
 }
 
+// TestParseAMacroCIDR checks only domain-spec of "a" and "mx" is expanded.
+func TestParseAMacroCIDR(t *testing.T) {
+	dns.HandleFunc("positive.matching.com.", zone(map[uint16][]string{
+		dns.TypeA: {
+			"positive.matching.com. 0 IN A 172.18.0.2",
+		},
+	}))
+	defer dns.HandleRemove("positive.matching.com.")
+
+	p := newParser("positive/matching/com@positive.matching.com/0", "matching.com", net.IP{172, 18, 0, 9}, stub, testResolver)
+	testcases := []TokenTestCase{
+		// "/" is a macro delimiter, not the start of dual-cidr-length
+		{&token{tA, qPlus, "%{l/}/24"}, Pass, true},
+		{&token{tA, qPlus, "%{l/}"}, Pass, false},
+		{&token{tMX, qPlus, "%{l/}/24"}, Pass, false},
+		// expanded "/0" is not a cidr-length, but an invalid domain
+		{&token{tA, qPlus, "%{o}"}, Permerror, true},
+		{&token{tMX, qPlus, "%{o}"}, Permerror, true},
+	}
+	for i, testcase := range testcases {
+		var (
+			match  bool
+			result Result
+		)
+		if testcase.Input.mechanism == tA {
+			match, result, _ = p.parseA(testcase.Input)
+		} else {
+			match, result, _ = p.parseMX(testcase.Input)
+		}
+		if testcase.Match != match || testcase.Result != result {
+			t.Errorf("#%d %q: expected %v (%v), got %v (%v)", i, testcase.Input.value,
+				testcase.Result, testcase.Match, result, match)
+		}
+	}
+}
+
 func TestParseAIpv6(t *testing.T) {
 
 	hosts := make(map[uint16][]string)
@@ -606,6 +663,75 @@ func TestParseMXNegativeTests(t *testing.T) {
 	}
 }
 
+func TestParsePTR(t *testing.T) {
+	dns.HandleFunc("in-addr.arpa.", zone(map[uint16][]string{
+		dns.TypePTR: {
+			"1.0.0.10.in-addr.arpa. 0 IN PTR mail.ptr.matching.org.",
+			"1.0.0.10.in-addr.arpa. 0 IN PTR spoofed.ptr.matching.org.",
+		},
+	}))
+	defer dns.HandleRemove("in-addr.arpa.")
+
+	dns.HandleFunc("ptr.matching.org.", zone(map[uint16][]string{
+		dns.TypeA: {
+			"mail.ptr.matching.org. 0 IN A 10.0.0.1",
+			"spoofed.ptr.matching.org. 0 IN A 10.0.0.2",
+		},
+	}))
+	defer dns.HandleRemove("ptr.matching.org.")
+
+	p := newParser("ptr.matching.org", "ptr.matching.org", net.IP{10, 0, 0, 1}, stub, testResolver)
+	testcases := []TokenTestCase{
+		{&token{tPTR, qPlus, ""}, Pass, true},
+		{&token{tPTR, qPlus, "ptr.matching.org"}, Pass, true},
+		{&token{tPTR, qMinus, "matching.org"}, Fail, true},
+		{&token{tPTR, qTilde, "mail.ptr.matching.org"}, Softfail, true},
+		{&token{tPTR, qPlus, "MAIL.ptr.matching.org."}, Pass, true},
+		// name is returned by the reverse lookup, but does not resolve
+		// back to the IP address
+		{&token{tPTR, qPlus, "spoofed.ptr.matching.org"}, Pass, false},
+		// suffix must match on a label boundary
+		{&token{tPTR, qPlus, "ail.ptr.matching.org"}, Pass, false},
+		{&token{tPTR, qPlus, "example.org"}, Pass, false},
+		{&token{tPTR, qPlus, "invalid..domain"}, Permerror, true},
+	}
+
+	for _, testcase := range testcases {
+		match, result, _ := p.parsePTR(testcase.Input)
+		if testcase.Match != match {
+			t.Errorf("%q Match mismatch, expected %v, got %v", testcase.Input.value, testcase.Match, match)
+		}
+		if testcase.Result != result {
+			t.Errorf("%q Result mismatch, expected %v, got %v", testcase.Input.value, testcase.Result, result)
+		}
+	}
+
+	// no PTR records for the IP address
+	p.IP = net.IP{10, 0, 0, 2}
+	if match, _, err := p.parsePTR(&token{tPTR, qPlus, ""}); match || err != nil {
+		t.Errorf("want no match and no error, got %v, %v", match, err)
+	}
+
+	// resolver with no reverse lookups
+	p = newParser("ptr.matching.org", "ptr.matching.org", net.IP{10, 0, 0, 1}, stub, plainResolver{testResolver})
+	if match, _, err := p.parsePTR(&token{tPTR, qPlus, ""}); match || err != nil {
+		t.Errorf("want no match and no error, got %v, %v", match, err)
+	}
+
+	parseTestCases := []parseTestCase{
+		{"v=spf1 ptr -all", net.IP{10, 0, 0, 1}, Pass},
+		{"v=spf1 ptr -all", net.IP{10, 0, 0, 2}, Fail},
+		{"v=spf1 ?ptr:spoofed.ptr.matching.org ~all", net.IP{10, 0, 0, 1}, Softfail},
+	}
+	for _, testcase := range parseTestCases {
+		p := newParser("ptr.matching.org", "ptr.matching.org", testcase.IP, testcase.Query, testResolver)
+		result, _, _ := p.parse()
+		if result != testcase.Result {
+			t.Errorf("%q Expected %v, got %v", testcase.Query, testcase.Result, result)
+		}
+	}
+}
+
 /* parseInclude tests */
 
 func TestParseInclude(t *testing.T) {
@@ -742,6 +868,30 @@ func TestParseIncludeNegative(t *testing.T) {
 
 }
 
+// TestParseIncludeSyntaxError checks syntax errors of the included record are
+// reported along with the "include" term.
+func TestParseIncludeSyntaxError(t *testing.T) {
+	dns.HandleFunc("malformed.matching.net.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`malformed.matching.net. 0 IN TXT "v=spf1 ip4:10.0.0.0/33 -all"`,
+			`macro.malformed.matching.net. 0 IN TXT "v=spf1 a:%{z}.matching.net -all"`,
+		},
+	}))
+	defer dns.HandleRemove("malformed.matching.net.")
+
+	p := newParser("matching.net", "matching.net", ip, stub, testResolver)
+	for _, domain := range []string{"malformed.matching.net", "macro.malformed.matching.net"} {
+		include := &token{tInclude, qPlus, domain}
+		match, result, err := p.parseInclude(include)
+		if !match || result != Permerror {
+			t.Errorf("%s: expected permerror, got %v (%v)", domain, result, match)
+		}
+		if serr, ok := err.(SyntaxError); !ok || serr.token != include {
+			t.Errorf("%s: expected syntax error of the include term, got %#v", domain, err)
+		}
+	}
+}
+
 // TestParseExists executes tests for exists term.
 func TestParseExists(t *testing.T) {
 
@@ -895,6 +1045,11 @@ func TestParse(t *testing.T) {
 		// Test ensures that once no term was matched and there is no
 		// redirect: mechanism, we should return Neutral result.
 		{"v=spf1 -ip4:8.8.8.8", net.IP{9, 9, 9, 9}, Neutral},
+		// Unknown modifiers are ignored, malformed terms are not.
+		{"v=spf1 ra=postmaster rp=100 rr=e:f:s:n -all", net.IP{9, 9, 9, 9}, Fail},
+		{"v=spf1 +ip4:9.9.9.9 ra=postmaster -all", net.IP{9, 9, 9, 9}, Pass},
+		{"v=spf1 1ra=postmaster -all", net.IP{9, 9, 9, 9}, Permerror},
+		{"v=spf1 ra:postmaster -all", net.IP{9, 9, 9, 9}, Permerror},
 		// Test will return SPFResult Fail as 172.20.20.1 does not result
 		// positively for domain _spf.matching.net
 		{"v=spf1 ip4:127.0.0.1 +include:_spf.matching.net -all", net.IP{172, 20, 20, 1}, Fail},
@@ -915,6 +1070,18 @@ func TestParse(t *testing.T) {
 		// the >>.com<< suffix. This test should give same matching result as
 		// the test above, as effectively the host to be queried is identical.
 		{"v=spf1 ?exists:lb.%{d1r}.com -all", ip, Neutral},
+		// domain-spec of every mechanism is macro-expanded
+		{"v=spf1 a:%{d} -all", net.IP{172, 18, 0, 2}, Pass},
+		{"v=spf1 mx:%{d}/24 -all", net.IP{172, 20, 20, 1}, Pass},
+		{"v=spf1 mx:%{d}/24 -all", net.IP{172, 20, 21, 1}, Fail},
+		{"v=spf1 mx/24 -all", net.IP{172, 20, 20, 1}, Pass},
+		{"v=spf1 MX/24 -All", net.IP{172, 20, 20, 1}, Pass},
+		{"v=spf1 -A:%{d} +ALL", net.IP{172, 18, 0, 2}, Fail},
+		{"V=spf1 -all", net.IP{172, 18, 0, 2}, Permerror},
+		{"v=spf1 -a/24 +all", net.IP{172, 18, 0, 1}, Fail},
+		{"v=spf1 a:%{x} -all", net.IP{172, 18, 0, 2}, Permerror},
+		{"v=spf1 include:_spf.%{d1r}.net -all", net.IP{172, 100, 100, 1}, Pass},
+		{"v=spf1 include:%{x} -all", net.IP{172, 100, 100, 1}, Permerror},
 		// 4.6.4 DNS Lookup Limits
 		// Some mechanisms and modifiers (collectively, "terms") cause DNS
 		// queries at the time of evaluation, and some do not.  The following
@@ -938,7 +1105,7 @@ func TestParse(t *testing.T) {
 		}
 		done := make(chan R)
 		go func() {
-			result, _, err := newParser("matching.com", "matching.com", testcase.IP, testcase.Query, NewLimitedResolver(testResolver, 4, 4)).parse()
+			result, _, err := newParser("matching.com", "matching.com", testcase.IP, testcase.Query, NewLimitedResolver(testResolver, 5, 4)).parse()
 			done <- R{result, err}
 		}()
 		select {
@@ -956,6 +1123,33 @@ func TestParse(t *testing.T) {
 	}
 }
 
+// TestParseVoidLookups ensures exceeding void lookups limit results in
+// Permerror, see RFC 7208, section 4.6.4
+func TestParseVoidLookups(t *testing.T) {
+	dns.HandleFunc("void.matching.com.", zone(map[uint16][]string{
+		dns.TypeA: {
+			"void.matching.com. 0 IN A 172.20.20.20",
+		},
+	}))
+	defer dns.HandleRemove("void.matching.com.")
+
+	parseTestCases := []parseTestCase{
+		{"v=spf1 exists:void.matching.com -all", ip, Pass},
+		{"v=spf1 -exists:a.void.matching.com -exists:b.void.matching.com +all", ip, Pass},
+		{"v=spf1 -exists:a.void.matching.com -exists:b.void.matching.com -exists:c.void.matching.com +all", ip, Permerror},
+		{"v=spf1 -a:a.void.matching.com -mx:b.void.matching.com -exists:c.void.matching.com +all", ip, Permerror},
+		{"v=spf1 -a:void.matching.com -a:void.matching.com -a:void.matching.com ~all", ip, Softfail},
+	}
+
+	for _, testcase := range parseTestCases {
+		r := NewLimitedResolverWithVoidLimit(testResolver, 10, 10, 2)
+		result, _, _ := newParser("matching.com", "matching.com", testcase.IP, testcase.Query, r).parse()
+		if result != testcase.Result {
+			t.Errorf("%q Expected %v, got %v", testcase.Query, testcase.Result, result)
+		}
+	}
+}
+
 // TestParseRedirect tests whole parsing behavior with a special testing of
 // redirect modifier
 func TestHandleRedirect(t *testing.T) {
@@ -1046,6 +1240,14 @@ func TestHandleRedirect(t *testing.T) {
 		// Ensure recursive redirects work
 		{"v=spf1 redirect=redirect.matching.com", net.IP{172, 18, 0, 2}, Pass},
 		{"v=spf1 redirect=redirect.matching.com", net.IP{127, 0, 0, 1}, Fail},
+		// redirect domain-spec is macro-expanded
+		{"v=spf1 redirect=_spf.%{d1r}.net", net.IP{172, 100, 100, 1}, Pass},
+		{"v=spf1 redirect=redirect.%{d}", net.IP{172, 18, 0, 2}, Pass},
+		{"v=spf1 redirect=%{x}", net.IP{172, 100, 100, 1}, Permerror},
+		// modifier names are case-insensitive
+		{"v=spf1 REDIRECT=_spf.matching.net", net.IP{172, 100, 100, 1}, Pass},
+		{"v=spf1 Redirect=_spf.matching.net", net.IP{127, 0, 0, 1}, Fail},
+		{"v=spf1 REDIRECT=malformed", net.IP{172, 100, 100, 1}, Permerror},
 	}
 
 	for _, testcase := range ParseTestCases {
@@ -1096,6 +1298,10 @@ func TestHandleExplanation(t *testing.T) {
 		{"v=spf1 -all exp=redirect.exp.matching.com",
 			"See http://matching.com/why.html?s=matching.com&i=127.0.0.1"},
 		{"v=spf1 -all exp=idontexist", ""},
+		{"v=spf1 -all Exp=static.exp.matching.com",
+			"Invalid SPF record"},
+		{"v=spf1 -ALL EXP=static.exp.matching.com",
+			"Invalid SPF record"},
 	}
 
 	for _, testcase := range expTestCases {
@@ -1123,7 +1329,10 @@ func TestHandleExplanationNegative(t *testing.T) {
 	expTestCases := []ExpTestCase{
 		// While evaluating exp domain we never encounter closing '}', hence we
 		// should raise appropriate error and return ""
-		{"v=spf1 -all exp=%{randomstuff", "unexpected char (97), expected '}'"},
+		{"v=spf1 -all exp=%{ir-andomstuff", "macro parsing error: unexpected char (97), expected '}'"},
+		// The "r" macro letter is allowed only in the explanation string,
+		// not in the domain-spec of the "exp" modifier.
+		{"v=spf1 -all exp=%{randomstuff", "macro letter (r) allowed only in explanation"},
 		// We cut the domain name, and eventually what we get is empty string.
 		// We cannot find any explanation's domain, so we return "" AND
 		// a SyntaxError{} error as an indication for operators.
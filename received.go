@@ -0,0 +1,168 @@
+package spf
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ReceivedSPF represents Received-SPF header field as defined by RFC 7208,
+// section 9.1. Empty fields are omitted from the rendered header.
+type ReceivedSPF struct {
+	Result Result
+	// Comment is free text, e.g. "mybox.example.org: domain of
+	// myname@example.com designates 192.0.2.1 as permitted sender"
+	Comment string
+
+	ClientIP     net.IP
+	EnvelopeFrom string // MAIL FROM identity
+	HELO         string
+	Problem      string // description of the error, if any
+	Receiver     string // the host which performed the check
+	Identity     string // "mailfrom" or "helo"
+	Mechanism    string // matched mechanism, "default" if none matched
+}
+
+// NewReceivedSPF returns Received-SPF header field describing the result of
+// checking the identity ("mailfrom" or "helo") of sender. e and err are the
+// values returned by Evaluate or EvaluateWithResolver, receiver is the host
+// which performed the check. The comment is generated from the result.
+func NewReceivedSPF(e *Evaluation, err error, ip net.IP, helo, sender, identity, receiver string) *ReceivedSPF {
+	h := &ReceivedSPF{
+		Result:       e.Result,
+		ClientIP:     ip,
+		EnvelopeFrom: sender,
+		HELO:         helo,
+		Receiver:     receiver,
+		Identity:     identity,
+		Mechanism:    e.Mechanism,
+	}
+
+	h.Comment = resultComment(e.Result, ip, sender, receiver)
+	if err != nil && (e.Result == Temperror || e.Result == Permerror) {
+		h.Problem = err.Error()
+	}
+	if h.Mechanism == "" && e.Result != Temperror && e.Result != Permerror && e.Result != None {
+		h.Mechanism = "default"
+	}
+	return h
+}
+
+// resultComment returns human readable description of the result of
+// checking sender identity, prefixed by the receiver if not empty.
+func resultComment(result Result, ip net.IP, sender, receiver string) string {
+	var comment string
+	switch result {
+	case Pass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", sender, ip)
+	case Fail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", sender, ip)
+	case Softfail:
+		comment = fmt.Sprintf("domain of transitioning %s does not designate %s as permitted sender", sender, ip)
+	case Neutral, None:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", ip, sender)
+	default:
+		comment = fmt.Sprintf("error in processing during lookup of %s", sender)
+	}
+	if receiver != "" {
+		comment = receiver + ": " + comment
+	}
+	return comment
+}
+
+// receivedSPFLineLength is the length of header lines, which the header is
+// folded to if possible.
+const receivedSPFLineLength = 78
+
+// String renders the header field, including "Received-SPF:" name and without
+// trailing CRLF. Long header is folded at whitespace, values are quoted
+// as needed.
+func (h *ReceivedSPF) String() string {
+	words := []string{"Received-SPF:", h.Result.String()}
+
+	if comment := strings.Fields(escapeComment(h.Comment)); len(comment) > 0 {
+		comment[0] = "(" + comment[0]
+		comment[len(comment)-1] += ")"
+		words = append(words, comment...)
+	}
+
+	pairs := []struct{ key, value string }{
+		{"client-ip", ""},
+		{"envelope-from", h.EnvelopeFrom},
+		{"helo", h.HELO},
+		{"problem", h.Problem},
+		{"receiver", h.Receiver},
+		{"identity", h.Identity},
+		{"mechanism", h.Mechanism},
+	}
+	if h.ClientIP != nil {
+		pairs[0].value = h.ClientIP.String()
+	}
+	for _, p := range pairs {
+		if p.value != "" {
+			words = append(words, p.key+"="+quoteValue(p.value)+";")
+		}
+	}
+
+	return foldWords(words, receivedSPFLineLength)
+}
+
+// foldWords joins words with spaces, folding the line before a word which
+// wouldn't fit into the line length.
+func foldWords(words []string, length int) string {
+	var b bytes.Buffer
+	line := 0
+	for i, w := range words {
+		switch {
+		case i == 0:
+		case line+1+len(w) > length:
+			b.WriteString("\r\n\t")
+			line = 1
+		default:
+			b.WriteByte(' ')
+			line++
+		}
+		b.WriteString(w)
+		line += len(w)
+	}
+	return b.String()
+}
+
+// escapeComment escapes characters which aren't allowed in a comment as
+// defined by RFC 5322, section 3.2.2.
+func escapeComment(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`, "\r", " ", "\n", " ")
+	return r.Replace(s)
+}
+
+// quoteValue returns s as dot-atom, or quoted-string if s isn't a valid
+// dot-atom, see RFC 5322, section 3.2.3.
+func quoteValue(s string) string {
+	if isDotAtom(s) {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", " ", "\n", " ")
+	return `"` + r.Replace(s) + `"`
+}
+
+func isDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '.' && !isAtext(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAtext reports whether c is atext as defined by RFC 5322, section 3.2.3.
+func isAtext(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
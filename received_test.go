@@ -0,0 +1,83 @@
+package spf
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReceivedSPFString(t *testing.T) {
+	samples := []struct {
+		h    ReceivedSPF
+		want string
+	}{
+		{ReceivedSPF{Result: None}, "Received-SPF: none"},
+		{ReceivedSPF{
+			Result:       Pass,
+			Comment:      "mybox.example.org: domain of myname@example.com designates 192.0.2.1 as permitted sender",
+			ClientIP:     net.IP{192, 0, 2, 1},
+			EnvelopeFrom: "myname@example.com",
+			HELO:         "foo.example.com",
+			Receiver:     "mybox.example.org",
+		},
+			"Received-SPF: pass (mybox.example.org: domain of myname@example.com designates\r\n" +
+				"\t192.0.2.1 as permitted sender) client-ip=192.0.2.1;\r\n" +
+				"\tenvelope-from=\"myname@example.com\"; helo=foo.example.com;\r\n" +
+				"\treceiver=mybox.example.org;"},
+		{ReceivedSPF{
+			Result:       Permerror,
+			Comment:      "bad (really) record",
+			ClientIP:     net.ParseIP("2001:db8::1"),
+			EnvelopeFrom: `"john doe"@example.com`,
+			Problem:      "syntax error",
+			Identity:     "mailfrom",
+			Mechanism:    "include:_spf.example.com",
+		},
+			"Received-SPF: permerror (bad \\(really\\) record) client-ip=\"2001:db8::1\";\r\n" +
+				"\tenvelope-from=\"\\\"john doe\\\"@example.com\"; problem=\"syntax error\";\r\n" +
+				"\tidentity=mailfrom; mechanism=\"include:_spf.example.com\";"},
+	}
+
+	for i, s := range samples {
+		if got := s.h.String(); got != s.want {
+			t.Errorf("#%d want:\n%s\ngot:\n%s", i, s.want, got)
+		}
+		for _, line := range strings.Split(s.want, "\r\n") {
+			if len(line) > receivedSPFLineLength {
+				t.Errorf("#%d line too long: %q", i, line)
+			}
+		}
+	}
+}
+
+func TestNewReceivedSPF(t *testing.T) {
+	ip := net.IP{192, 0, 2, 1}
+	samples := []struct {
+		e    Evaluation
+		err  error
+		want string
+	}{
+		{Evaluation{Result: Pass, Mechanism: "ip4:192.0.2.0/24"}, nil,
+			"Received-SPF: pass (mx.example.org: domain of user@example.com designates\r\n" +
+				"\t192.0.2.1 as permitted sender) client-ip=192.0.2.1;\r\n" +
+				"\tenvelope-from=\"user@example.com\"; helo=mail.example.com;\r\n" +
+				"\treceiver=mx.example.org; identity=mailfrom; mechanism=\"ip4:192.0.2.0/24\";"},
+		{Evaluation{Result: Neutral}, nil,
+			"Received-SPF: neutral (mx.example.org: 192.0.2.1 is neither permitted nor\r\n" +
+				"\tdenied by domain of user@example.com) client-ip=192.0.2.1;\r\n" +
+				"\tenvelope-from=\"user@example.com\"; helo=mail.example.com;\r\n" +
+				"\treceiver=mx.example.org; identity=mailfrom; mechanism=default;"},
+		{Evaluation{Result: Temperror}, ErrDNSTemperror,
+			"Received-SPF: temperror (mx.example.org: error in processing during lookup of\r\n" +
+				"\tuser@example.com) client-ip=192.0.2.1; envelope-from=\"user@example.com\";\r\n" +
+				"\thelo=mail.example.com; problem=\"temporary DNS error\";\r\n" +
+				"\treceiver=mx.example.org; identity=mailfrom;"},
+	}
+
+	for i, s := range samples {
+		h := NewReceivedSPF(&s.e, s.err, ip, "mail.example.com", "user@example.com", "mailfrom", "mx.example.org")
+		if got := h.String(); got != s.want {
+			t.Errorf("#%d want:\n%s\ngot:\n%s", i, s.want, got)
+		}
+	}
+}
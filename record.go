@@ -0,0 +1,505 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Record is a parsed SPF record, see Parse.
+type Record struct {
+	// Terms keeps mechanisms and modifiers in order they appear in the
+	// record, "v=spf1" version section is not included.
+	Terms []Term
+}
+
+// Term is a mechanism or a modifier of SPF record, that is *Mechanism or
+// *Modifier.
+type Term interface {
+	// String returns the term as it's written in SPF record
+	String() string
+	// Offset returns the byte offset of the term in the parsed record
+	Offset() int
+
+	token() *token
+}
+
+// Qualifier of a mechanism as defined by RFC 7208, section 4.6.2.
+// Zero value is the same as QualifierPass.
+type Qualifier byte
+
+// Qualifiers of mechanisms
+const (
+	QualifierPass     Qualifier = '+'
+	QualifierFail     Qualifier = '-'
+	QualifierSoftfail Qualifier = '~'
+	QualifierNeutral  Qualifier = '?'
+)
+
+// Result returns the result of a matching mechanism with the qualifier.
+func (q Qualifier) Result() Result {
+	switch q {
+	case QualifierFail:
+		return Fail
+	case QualifierSoftfail:
+		return Softfail
+	case QualifierNeutral:
+		return Neutral
+	default:
+		return Pass
+	}
+}
+
+// String returns the qualifier character.
+func (q Qualifier) String() string {
+	if q == 0 {
+		return string(QualifierPass)
+	}
+	return string(q)
+}
+
+// Mechanism represents a directive of SPF record, that is a mechanism with
+// its qualifier. Fields which are not used by the mechanism have zero values.
+type Mechanism struct {
+	Qualifier Qualifier
+	// Name is one of "all", "include", "a", "mx", "ptr", "ip4", "ip6" and
+	// "exists".
+	Name string
+	// Domain is the domain-spec of "include", "exists", "a", "mx" and "ptr"
+	// mechanisms. It may contain macros. Empty Domain of "a", "mx" and "ptr"
+	// stands for the evaluated domain.
+	Domain string
+	// IP is the address of "ip4" and "ip6" mechanisms.
+	IP net.IP
+	// CIDR4 is ip4-cidr-length of "a", "mx" and "ip4" mechanisms.
+	// CIDR6 is ip6-cidr-length of "a", "mx" and "ip6" mechanisms.
+	// They are -1 if the length is not specified.
+	CIDR4, CIDR6 int
+
+	pos int
+}
+
+// Network returns the network of "ip4" and "ip6" mechanisms. It returns nil
+// for other mechanisms.
+func (m *Mechanism) Network() *net.IPNet {
+	var ones, bits int
+	switch m.Name {
+	case "ip4":
+		ones, bits = m.CIDR4, 8*net.IPv4len
+	case "ip6":
+		ones, bits = m.CIDR6, 8*net.IPv6len
+	default:
+		return nil
+	}
+	if ones < 0 {
+		ones = bits
+	}
+	mask := net.CIDRMask(ones, bits)
+	return &net.IPNet{IP: m.IP.Mask(mask), Mask: mask}
+}
+
+// Offset returns the byte offset of the mechanism in the parsed record.
+func (m *Mechanism) Offset() int { return m.pos }
+
+// String returns the mechanism as it's written in SPF record, the default
+// "+" qualifier is omitted.
+func (m *Mechanism) String() string {
+	var q string
+	if m.Qualifier != 0 && m.Qualifier != QualifierPass {
+		q = string(m.Qualifier)
+	}
+	v := m.value()
+	if v == "" || v[0] == '/' {
+		return q + m.Name + v
+	}
+	return q + m.Name + ":" + v
+}
+
+// value returns the part of the mechanism following its name and ":", or
+// dual-cidr-length of "a" and "mx" with no domain-spec.
+func (m *Mechanism) value() string {
+	switch m.Name {
+	case "ip4":
+		return cidrString(m.IP.String(), m.CIDR4, -1)
+	case "ip6":
+		return cidrString(m.IP.String(), m.CIDR6, -1)
+	case "a", "mx":
+		return cidrString(m.Domain, m.CIDR4, m.CIDR6)
+	default:
+		return m.Domain
+	}
+}
+
+func cidrString(s string, cidr4, cidr6 int) string {
+	if cidr4 >= 0 {
+		s += "/" + strconv.Itoa(cidr4)
+	}
+	if cidr6 >= 0 {
+		s += "//" + strconv.Itoa(cidr6)
+	}
+	return s
+}
+
+func (m *Mechanism) token() *token {
+	q := qPlus
+	if m.Qualifier != 0 {
+		q = qualifiers[rune(m.Qualifier)]
+	}
+	return &token{tokenTypeFromString(m.Name), q, m.value()}
+}
+
+// Modifier represents a modifier of SPF record, that is "redirect", "exp"
+// or an unknown modifier, which is ignored by the evaluation.
+type Modifier struct {
+	Name  string
+	Value string // macro-string, domain-spec of "redirect" and "exp"
+
+	pos int
+}
+
+// Offset returns the byte offset of the modifier in the parsed record.
+func (m *Modifier) Offset() int { return m.pos }
+
+// String returns the modifier as it's written in SPF record.
+func (m *Modifier) String() string { return m.Name + "=" + m.Value }
+
+func (m *Modifier) token() *token {
+	switch m.Name {
+	case "redirect":
+		return &token{tRedirect, qPlus, m.Value}
+	case "exp":
+		return &token{tExp, qPlus, m.Value}
+	default:
+		return &token{tUnknownModifier, qPlus, m.String()}
+	}
+}
+
+// String returns the record as it's published in DNS.
+func (r *Record) String() string {
+	s := []string{"v=spf1"}
+	for _, t := range r.Terms {
+		s = append(s, t.String())
+	}
+	return strings.Join(s, " ")
+}
+
+// Mechanisms returns mechanisms of the record in order.
+func (r *Record) Mechanisms() []*Mechanism {
+	var mechanisms []*Mechanism
+	for _, t := range r.Terms {
+		if m, ok := t.(*Mechanism); ok {
+			mechanisms = append(mechanisms, m)
+		}
+	}
+	return mechanisms
+}
+
+// Redirect returns "redirect" modifier of the record, or nil.
+func (r *Record) Redirect() *Modifier { return r.modifier("redirect") }
+
+// Explanation returns "exp" modifier of the record, or nil.
+func (r *Record) Explanation() *Modifier { return r.modifier("exp") }
+
+func (r *Record) modifier(name string) *Modifier {
+	for _, t := range r.Terms {
+		if m, ok := t.(*Modifier); ok && m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// tokens returns tokens evaluated by parser, starting with the version.
+func (r *Record) tokens() []*token {
+	tokens := []*token{{tVersion, qPlus, "spf1"}}
+	for _, t := range r.Terms {
+		tokens = append(tokens, t.token())
+	}
+	return tokens
+}
+
+// ParseError describes a syntax error of SPF record.
+type ParseError struct {
+	Offset int    // byte offset of the error in the record
+	Term   string // the faulty term
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("syntax error at offset %d (%q): %s", e.Offset, e.Term, e.Msg)
+}
+
+// Parse parses SPF record as defined by RFC 7208, section 12. The record
+// must start with "v=spf1" version section.
+// Any syntax error is reported as *ParseError.
+func Parse(record string) (*Record, error) {
+	lexemes := lexTerms(record)
+	if len(lexemes) == 0 || lexemes[0].token.mechanism != tVersion || lexemes[0].token.value != "spf1" {
+		term := ""
+		if len(lexemes) > 0 {
+			term = lexemes[0].text
+		}
+		return nil, &ParseError{0, term, `record must begin with "v=spf1"`}
+	}
+
+	r := &Record{}
+	seen := make(map[string]bool)
+	for _, lx := range lexemes[1:] {
+		t, err := newTerm(lx)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := t.(*Modifier); ok && (m.Name == "redirect" || m.Name == "exp") {
+			// RFC 7208, section 6:
+			// These two modifiers MUST NOT appear in a record more than once
+			// each.
+			if seen[m.Name] {
+				return nil, &ParseError{lx.pos, lx.text, fmt.Sprintf("too many %q", m.Name)}
+			}
+			seen[m.Name] = true
+		}
+		r.Terms = append(r.Terms, t)
+	}
+	return r, nil
+}
+
+// newTerm returns Term of lx, or *ParseError.
+func newTerm(lx lexeme) (Term, error) {
+	t := lx.token
+	errorf := func(offset int, format string, args ...interface{}) error {
+		return &ParseError{lx.pos + offset, lx.text, fmt.Sprintf(format, args...)}
+	}
+
+	// offset of the value within the term
+	valuePos := strings.IndexAny(lx.text, ":=/")
+	if valuePos >= 0 && lx.text[valuePos] != '/' {
+		valuePos++
+	}
+
+	switch {
+	case t.mechanism.isErr():
+		return nil, errorf(0, "%s", diagnoseTerm(lx.text))
+	case t.mechanism == tVersion:
+		return nil, errorf(0, "unexpected version section")
+	case t.mechanism.isModifier() && isQualifier(rune(lx.text[0])):
+		return nil, errorf(0, "modifier must not have a qualifier")
+	case t.mechanism == tUnknownModifier:
+		i := strings.IndexByte(t.value, '=')
+		m := &Modifier{Name: t.value[:i], Value: t.value[i+1:], pos: lx.pos}
+		if i, err := checkMacroString(m.Value); err != nil {
+			return nil, errorf(valuePos+i, "%v", err)
+		}
+		return m, nil
+	case t.mechanism == tExp:
+		// RFC 7208, section 6.2: errors of the explanation are reported
+		// upon its evaluation, which proceeds as if no "exp" was given.
+		return &Modifier{Name: "exp", Value: t.value, pos: lx.pos}, nil
+	case t.mechanism.isModifier():
+		m := &Modifier{Name: t.mechanism.String(), Value: t.value, pos: lx.pos}
+		if i, err := checkMacroString(m.Value); err != nil {
+			return nil, errorf(valuePos+i, "%v", err)
+		}
+		return m, nil
+	}
+
+	m := &Mechanism{
+		Qualifier: Qualifier(lx.text[0]),
+		Name:      t.mechanism.String(),
+		CIDR4:     -1,
+		CIDR6:     -1,
+		pos:       lx.pos,
+	}
+	if !isQualifier(rune(lx.text[0])) {
+		m.Qualifier = QualifierPass
+	}
+
+	switch t.mechanism {
+	case tAll:
+		if t.value != "" {
+			return nil, errorf(valuePos, "unexpected value of %q", m.Name)
+		}
+		return m, nil
+	case tIP4, tIP6:
+		addr, cidr := t.value, -1
+		if i := strings.IndexByte(addr, '/'); i >= 0 {
+			var err error
+			if cidr, err = parseCIDRLength(addr[i+1:], t.mechanism == tIP4); err != nil {
+				return nil, errorf(valuePos+i+1, "%v", err)
+			}
+			addr = addr[:i]
+		}
+		m.IP = net.ParseIP(addr)
+		if t.mechanism == tIP4 {
+			m.IP, m.CIDR4 = m.IP.To4(), cidr
+		} else if m.IP.To4() != nil {
+			m.IP = nil // ip6 must not be an IPv4 address
+		} else {
+			m.CIDR6 = cidr
+		}
+		if m.IP == nil {
+			return nil, errorf(valuePos, "invalid %s address", m.Name)
+		}
+		return m, nil
+	case tA, tMX:
+		var (
+			i   int
+			err error
+		)
+		m.Domain, m.CIDR4, m.CIDR6, i, err = splitDualCIDR(t.value)
+		if err != nil {
+			return nil, errorf(valuePos+i, "%v", err)
+		}
+	case tInclude, tExists:
+		if t.value == "" {
+			return nil, errorf(len(lx.text), "missing domain-spec of %q", m.Name)
+		}
+		m.Domain = t.value
+	case tPTR:
+		m.Domain = t.value
+	}
+
+	if i, err := checkMacroString(m.Domain); err != nil {
+		return nil, errorf(valuePos+i, "%v", err)
+	}
+	return m, nil
+}
+
+// diagnoseTerm returns the reason why the lexer rejected the term.
+func diagnoseTerm(text string) string {
+	name, qualified := text, false
+	if text != "" && isQualifier(rune(text[0])) {
+		name, qualified = text[1:], true
+	}
+	i := strings.IndexAny(name, ":=")
+	if i < 0 {
+		return fmt.Sprintf("unknown mechanism %q", name)
+	}
+	delimiter, value := name[i], name[i+1:]
+	name = name[:i]
+	known := !tokenTypeFromString(name).isErr()
+	switch {
+	case name == "":
+		return "missing name"
+	case !known && delimiter == ':':
+		return fmt.Sprintf("unknown mechanism %q", name)
+	case !known && qualified:
+		return "modifier must not have a qualifier"
+	case !known && !isModifierName(name):
+		return fmt.Sprintf("invalid modifier name %q", name)
+	case value == "":
+		return fmt.Sprintf("missing value of %q", name)
+	case delimiter == ':':
+		return fmt.Sprintf("%q is a modifier, expected '='", name)
+	default:
+		return fmt.Sprintf("%q is a mechanism, expected ':'", name)
+	}
+}
+
+// splitDualCIDR splits domain-spec and dual-cidr-length of "a" and "mx"
+// mechanisms. Lengths are -1 if they are not given. In case of error the
+// offset of faulty part is returned.
+func splitDualCIDR(s string) (string, int, int, int, error) {
+	cidr4, cidr6 := -1, -1
+
+	// domain-spec may contain "/" as a macro delimiter, thus lengths are
+	// looked for at the end only
+	end := len(s)
+	trailingDigits := func() int {
+		i := end
+		for i > 0 && isDigit(rune(s[i-1])) {
+			i--
+		}
+		return i
+	}
+
+	i := trailingDigits()
+	if i >= 2 && s[i-2:i] == "//" {
+		var err error
+		if cidr6, err = parseCIDRLength(s[i:end], false); err != nil {
+			return "", 0, 0, i, err
+		}
+		end = i - 2
+		i = trailingDigits()
+	}
+	if i >= 1 && s[i-1] == '/' && (i < 2 || s[i-2] != '/') {
+		var err error
+		if cidr4, err = parseCIDRLength(s[i:end], true); err != nil {
+			return "", 0, 0, i, err
+		}
+		end = i - 1
+	}
+	if end > 0 && s[end-1] == '/' {
+		return "", 0, 0, end - 1, errInvalidCIDRLength
+	}
+	return s[:end], cidr4, cidr6, 0, nil
+}
+
+// parseCIDRLength parses ip4-cidr-length or ip6-cidr-length.
+func parseCIDRLength(s string, ip4 bool) (int, error) {
+	max := 128
+	if ip4 {
+		max = 32
+	}
+	// leading zeros are not allowed, RFC 7208, section 5.6
+	if s == "" || len(s) > 1 && s[0] == '0' {
+		return 0, errInvalidCIDRLength
+	}
+	l, err := strconv.Atoi(s)
+	if err != nil || l > max {
+		return 0, errInvalidCIDRLength
+	}
+	return l, nil
+}
+
+// checkMacroString checks syntax of macro-string (RFC 7208, section 7.1)
+// used in domain-spec and modifiers. In case of error it returns the offset
+// of the faulty macro.
+func checkMacroString(s string) (int, error) {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return i, fmt.Errorf("unexpected character %q", s[i])
+		}
+		if s[i] != '%' {
+			continue
+		}
+		if i+1 == len(s) {
+			return i, fmt.Errorf("unterminated macro")
+		}
+		switch s[i+1] {
+		case '%', '_', '-':
+			i++
+			continue
+		case '{':
+		default:
+			return i, fmt.Errorf("unexpected macro %q", s[i:i+2])
+		}
+
+		j := i + 2
+		if j == len(s) || !strings.ContainsRune("slodiphv", toLowerASCII(s[j])) {
+			return i, fmt.Errorf("invalid macro letter")
+		}
+		j++
+		for j < len(s) && isDigit(rune(s[j])) {
+			j++
+		}
+		if j < len(s) && toLowerASCII(s[j]) == 'r' {
+			j++
+		}
+		for j < len(s) && strings.IndexByte(".-+,/_=", s[j]) >= 0 {
+			j++
+		}
+		if j == len(s) || s[j] != '}' {
+			return i, fmt.Errorf("unterminated macro")
+		}
+		i = j
+	}
+	return 0, nil
+}
+
+func toLowerASCII(c byte) rune {
+	if 'A' <= c && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+	return rune(c)
+}
@@ -0,0 +1,110 @@
+package spf
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseRecord(t *testing.T) {
+	r, err := Parse("v=spf1 a/24//64 -mx:mail.example.com ~ip4:192.0.2.0/24 ip6:2001:db8::/32 ?include:_spf.example.net exists:%{i}.bl.example.org ptr redirect=_spf.example.com exp=exp.example.com x-vendor=%{d} -all")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []Term{
+		&Mechanism{Qualifier: QualifierPass, Name: "a", CIDR4: 24, CIDR6: 64, pos: 7},
+		&Mechanism{Qualifier: QualifierFail, Name: "mx", Domain: "mail.example.com", CIDR4: -1, CIDR6: -1, pos: 16},
+		&Mechanism{Qualifier: QualifierSoftfail, Name: "ip4", IP: net.IP{192, 0, 2, 0}, CIDR4: 24, CIDR6: -1, pos: 37},
+		&Mechanism{Qualifier: QualifierPass, Name: "ip6", IP: net.ParseIP("2001:db8::"), CIDR4: -1, CIDR6: 32, pos: 55},
+		&Mechanism{Qualifier: QualifierNeutral, Name: "include", Domain: "_spf.example.net", CIDR4: -1, CIDR6: -1, pos: 73},
+		&Mechanism{Qualifier: QualifierPass, Name: "exists", Domain: "%{i}.bl.example.org", CIDR4: -1, CIDR6: -1, pos: 99},
+		&Mechanism{Qualifier: QualifierPass, Name: "ptr", CIDR4: -1, CIDR6: -1, pos: 126},
+		&Modifier{Name: "redirect", Value: "_spf.example.com", pos: 130},
+		&Modifier{Name: "exp", Value: "exp.example.com", pos: 156},
+		&Modifier{Name: "x-vendor", Value: "%{d}", pos: 176},
+		&Mechanism{Qualifier: QualifierFail, Name: "all", CIDR4: -1, CIDR6: -1, pos: 190},
+	}
+	if len(r.Terms) != len(expected) {
+		t.Fatalf("expected %d terms, got %d", len(expected), len(r.Terms))
+	}
+	for i, term := range r.Terms {
+		if !reflect.DeepEqual(term, expected[i]) {
+			t.Errorf("term %d: expected %#v, got %#v", i, expected[i], term)
+		}
+	}
+
+	if m := r.Redirect(); m == nil || m.Value != "_spf.example.com" {
+		t.Errorf("unexpected redirect: %v", m)
+	}
+	if m := r.Explanation(); m == nil || m.Value != "exp.example.com" {
+		t.Errorf("unexpected exp: %v", m)
+	}
+	if n := len(r.Mechanisms()); n != 8 {
+		t.Errorf("expected 8 mechanisms, got %d", n)
+	}
+	if n := r.Mechanisms()[2].Network().String(); n != "192.0.2.0/24" {
+		t.Errorf("expected network 192.0.2.0/24, got %s", n)
+	}
+}
+
+func TestRecordString(t *testing.T) {
+	tests := []struct {
+		record   string
+		expected string
+	}{
+		{"v=spf1", "v=spf1"},
+		{"v=spf1   +a  -all ", "v=spf1 a -all"},
+		{"v=spf1 +mx/24 ?all", "v=spf1 mx/24 ?all"},
+		{"v=spf1 a:example.com//64 ip4:192.0.2.1 ip6:2001:DB8::1/128 ~all", "v=spf1 a:example.com//64 ip4:192.0.2.1 ip6:2001:db8::1/128 ~all"},
+		{"v=spf1 include:_spf.%{d2} redirect=%{d} ra=postmaster", "v=spf1 include:_spf.%{d2} redirect=%{d} ra=postmaster"},
+	}
+	for _, test := range tests {
+		r, err := Parse(test.record)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.record, err)
+			continue
+		}
+		if s := r.String(); s != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.record, test.expected, s)
+		}
+	}
+}
+
+func TestParseRecordError(t *testing.T) {
+	tests := []struct {
+		record string
+		offset int
+		term   string
+	}{
+		{"", 0, ""},
+		{"v=spf2 -all", 0, "v=spf2"},
+		{"a -all", 0, "a"},
+		{"v=spf1 a v=spf1", 9, "v=spf1"},
+		{"v=spf1 foo -all", 7, "foo"},
+		{"v=spf1 -foo:bar -all", 7, "-foo:bar"},
+		{"v=spf1 ip4:192.0.2.0/33 -all", 21, "ip4:192.0.2.0/33"},
+		{"v=spf1 ip4:192.0.2.0/024 -all", 21, "ip4:192.0.2.0/024"},
+		{"v=spf1 ip4:2001:db8::1 -all", 11, "ip4:2001:db8::1"},
+		{"v=spf1 ip6:192.0.2.1 -all", 11, "ip6:192.0.2.1"},
+		{"v=spf1 mx/24//129 -all", 14, "mx/24//129"},
+		{"v=spf1 a:example.com/ -all", 21, "a:example.com/"},
+		{"v=spf1 include:%{z}.example.com -all", 15, "include:%{z}.example.com"},
+		{"v=spf1 exists:%{i -all", 14, "exists:%{i"},
+		{"v=spf1 all:example.com", 11, "all:example.com"},
+		{"v=spf1 redirect=a.example.com redirect=b.example.com", 30, "redirect=b.example.com"},
+		{"v=spf1 exp=a.example.com exp=b.example.com", 25, "exp=b.example.com"},
+		{"v=spf1 -ra=postmaster", 7, "-ra=postmaster"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.record)
+		e, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%q: expected *ParseError, got %v", test.record, err)
+			continue
+		}
+		if e.Offset != test.offset || e.Term != test.term {
+			t.Errorf("%q: expected error at %d (%q), got %v", test.record, test.offset, test.term, e)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package spf
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachingResolver wraps a QueryResolver and caches its answers for their
+// TTL. Negative answers ("Name Error" or no records of the queried type) are
+// cached for the TTL derived from SOA record of the authority section, see
+// Answer.TTL. Answers with zero TTL and errors are not cached.
+//
+// The number of cached answers is bounded, once the limit is reached the
+// least recently used answer is evicted.
+//
+// CachingResolver implements Resolver, ResolverContext and QueryResolver and
+// is safe for concurrent use, so it can be shared by many Checkers, e.g.
+//
+//	r, _ := NewMiekgDNSResolver("8.8.8.8:53")
+//	c := NewChecker(WithResolver(NewCachingResolver(r.(QueryResolver), 10000)))
+//
+// Lookup limits still apply to each evaluation, as the cached answers count
+// as lookups too.
+type CachingResolver struct {
+	resolver QueryResolver
+	capacity int
+	now      func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	answer  *Answer
+	expires time.Time
+}
+
+// NewCachingResolver returns a resolver which caches up to capacity answers
+// of r.
+func NewCachingResolver(r QueryResolver, capacity int) *CachingResolver {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &CachingResolver{
+		resolver: r,
+		capacity: capacity,
+		now:      time.Now,
+		lru:      list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+	}
+}
+
+// Len returns the number of cached answers, including the expired ones not
+// evicted yet.
+func (r *CachingResolver) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lru.Len()
+}
+
+// get returns the cached answer with its TTL decreased by the time it's been
+// cached for.
+func (r *CachingResolver) get(key cacheKey) (*Answer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	el, ok := r.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	ttl := e.expires.Sub(r.now())
+	if ttl <= 0 {
+		r.lru.Remove(el)
+		delete(r.entries, key)
+		return nil, false
+	}
+	r.lru.MoveToFront(el)
+	a := e.answer.copy()
+	a.TTL = ttl
+	return a, true
+}
+
+func (r *CachingResolver) put(key cacheKey, a *Answer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := &cacheEntry{key, a.copy(), r.now().Add(a.TTL)}
+	if el, ok := r.entries[key]; ok {
+		el.Value = e
+		r.lru.MoveToFront(el)
+		return
+	}
+	r.entries[key] = r.lru.PushFront(e)
+	for r.lru.Len() > r.capacity {
+		el := r.lru.Back()
+		r.lru.Remove(el)
+		delete(r.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+// QueryContext returns the cached answer to the query or passes the query to
+// the wrapped resolver and caches its answer.
+func (r *CachingResolver) QueryContext(ctx context.Context, name string, qtype uint16) (*Answer, error) {
+	key := cacheKey{strings.ToLower(name), qtype}
+	if a, ok := r.get(key); ok {
+		return a, nil
+	}
+	a, err := r.resolver.QueryContext(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if a.TTL > 0 {
+		r.put(key, a)
+	}
+	return a, nil
+}
+
+// LookupTXT returns the DNS TXT records for the given domain name.
+func (r *CachingResolver) LookupTXT(name string) ([]string, error) {
+	return r.LookupTXTContext(context.Background(), name)
+}
+
+// LookupTXTContext is LookupTXT, which uses provided context for the
+// underlying DNS query.
+func (r *CachingResolver) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	return queryResolver{r}.LookupTXTContext(ctx, name)
+}
+
+// LookupTXTStrict returns DNS TXT records for the given name, however it
+// will return ErrDNSPermerror upon NXDOMAIN (RCODE 3)
+func (r *CachingResolver) LookupTXTStrict(name string) ([]string, error) {
+	return r.LookupTXTStrictContext(context.Background(), name)
+}
+
+// LookupTXTStrictContext is LookupTXTStrict, which uses provided context for the
+// underlying DNS query.
+func (r *CachingResolver) LookupTXTStrictContext(ctx context.Context, name string) ([]string, error) {
+	return queryResolver{r}.LookupTXTStrictContext(ctx, name)
+}
+
+// Exists is used for a DNS A RR lookup (even when the
+// connection type is IPv6).  If any A record is returned, this
+// mechanism matches.
+func (r *CachingResolver) Exists(name string) (bool, error) {
+	return r.ExistsContext(context.Background(), name)
+}
+
+// ExistsContext is Exists, which uses provided context for the underlying
+// DNS query.
+func (r *CachingResolver) ExistsContext(ctx context.Context, name string) (bool, error) {
+	return queryResolver{r}.ExistsContext(ctx, name)
+}
+
+// MatchIP provides an address lookup, which should be done on the name
+// using the type of lookup (A or AAAA).
+// Then IPMatcherFunc used to compare checked IP to the returned address(es).
+// If any address matches, the mechanism matches
+func (r *CachingResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, error) {
+	return r.MatchIPContext(context.Background(), name, matcher)
+}
+
+// MatchIPContext is MatchIP, which uses provided context for the underlying
+// DNS queries.
+func (r *CachingResolver) MatchIPContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	return queryResolver{r}.MatchIPContext(ctx, name, matcher)
+}
+
+// MatchMX is similar to MatchIP but first performs an MX lookup on the
+// name.  Then it performs an address lookup on each MX name returned.
+// Then IPMatcherFunc used to compare checked IP to the returned address(es).
+// If any address matches, the mechanism matches
+func (r *CachingResolver) MatchMX(name string, matcher IPMatcherFunc) (bool, error) {
+	return r.MatchMXContext(context.Background(), name, matcher)
+}
+
+// MatchMXContext is MatchMX, which uses provided context for the underlying
+// DNS queries.
+func (r *CachingResolver) MatchMXContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	return queryResolver{r}.MatchMXContext(ctx, name, matcher)
+}
+
+// LookupPTR performs a reverse lookup of the given IP address and returns
+// names which resolve back to the address.
+func (r *CachingResolver) LookupPTR(ip net.IP) ([]string, error) {
+	return r.LookupPTRContext(context.Background(), ip)
+}
+
+// LookupPTRContext is LookupPTR, which uses provided context for the
+// underlying DNS queries.
+func (r *CachingResolver) LookupPTRContext(ctx context.Context, ip net.IP) ([]string, error) {
+	return queryResolver{r}.LookupPTRContext(ctx, ip)
+}
@@ -0,0 +1,192 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingZone returns a handler answering with rcode, answer and authority
+// records, which counts the queries it receives.
+func countingZone(queries *int32, rcode int, answer, ns []string) func(dns.ResponseWriter, *dns.Msg) {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		for _, s := range answer {
+			if rr, err := dns.NewRR(s); err == nil && rr.Header().Rrtype == req.Question[0].Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		for _, s := range ns {
+			if rr, err := dns.NewRR(s); err == nil {
+				m.Ns = append(m.Ns, rr)
+			}
+		}
+		_ = w.WriteMsg(m)
+	}
+}
+
+const testSOA = "test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 60"
+
+func TestMiekgDNSResolverQuery(t *testing.T) {
+	var queries int32
+	dns.HandleFunc("ttl.test.", countingZone(&queries, dns.RcodeSuccess, []string{
+		"ttl.test. 300 IN A 10.0.0.1",
+		"ttl.test. 120 IN A 10.0.0.2",
+	}, nil))
+	defer dns.HandleRemove("ttl.test.")
+	dns.HandleFunc("nx.test.", countingZone(&queries, dns.RcodeNameError, nil, []string{testSOA}))
+	defer dns.HandleRemove("nx.test.")
+
+	r := testResolver.(QueryResolver)
+	a, err := r.QueryContext(context.Background(), "ttl.test.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Answer{Values: []string{"10.0.0.1", "10.0.0.2"}, TTL: 120 * time.Second}
+	if !reflect.DeepEqual(a, expected) {
+		t.Errorf("expected %+v, got %+v", expected, a)
+	}
+
+	// NODATA without SOA must not be cached
+	a, err = r.QueryContext(context.Background(), "ttl.test.", dns.TypeTXT)
+	if err != nil || len(a.Values) != 0 || a.TTL != 0 || a.NameError {
+		t.Errorf("unexpected answer: %+v, %v", a, err)
+	}
+
+	a, err = r.QueryContext(context.Background(), "nx.test.", dns.TypeTXT)
+	expected = &Answer{TTL: 60 * time.Second, NameError: true}
+	if err != nil || !reflect.DeepEqual(a, expected) {
+		t.Errorf("expected %+v, got %+v, %v", expected, a, err)
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	var queries int32
+	dns.HandleFunc("cache.test.", countingZone(&queries, dns.RcodeSuccess, []string{
+		`cache.test. 300 IN TXT "v=spf1 a -all"`,
+		"cache.test. 60 IN A 10.0.0.1",
+	}, []string{testSOA}))
+	defer dns.HandleRemove("cache.test.")
+
+	now := time.Now()
+	r := NewCachingResolver(testResolver.(QueryResolver), 10)
+	r.now = func() time.Time { return now }
+
+	c := NewChecker(WithResolver(r))
+	for i := 0; i < 3; i++ {
+		res, _, err := c.CheckHost(net.IP{10, 0, 0, 2}, "cache.test", "")
+		if res != Fail || err != nil {
+			t.Fatalf("expected Fail, got %v, %v", res, err)
+		}
+	}
+	// TXT, A and AAAA are queried once
+	if q := atomic.LoadInt32(&queries); q != 3 {
+		t.Errorf("expected 3 queries, got %d", q)
+	}
+
+	now = now.Add(59 * time.Second)
+	a, err := r.QueryContext(context.Background(), "cache.test.", dns.TypeA)
+	if err != nil || a.TTL != time.Second {
+		t.Errorf("expected TTL of 1s, got %+v, %v", a, err)
+	}
+	// callers get copies of the cached answer
+	if a != nil && len(a.Values) == 1 {
+		a.Values[0] = "modified"
+	}
+	if a, _ := r.QueryContext(context.Background(), "cache.test.", dns.TypeA); a == nil || a.Values[0] != "10.0.0.1" {
+		t.Errorf("cached answer was modified: %+v", a)
+	}
+	// the negative AAAA answer expires along with the A record, TXT is kept
+	now = now.Add(time.Second)
+	if _, err := r.LookupTXT("cache.test."); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.MatchIP("cache.test.", func(net.IP) (bool, error) { return false, nil }); ok || err != nil {
+		t.Fatalf("unexpected match: %v, %v", ok, err)
+	}
+	if q := atomic.LoadInt32(&queries); q != 5 {
+		t.Errorf("expected 5 queries, got %d", q)
+	}
+}
+
+func TestCachingResolverNegative(t *testing.T) {
+	var queries int32
+	dns.HandleFunc("nx.test.", countingZone(&queries, dns.RcodeNameError, nil, []string{testSOA}))
+	defer dns.HandleRemove("nx.test.")
+	dns.HandleFunc("nosoa.test.", countingZone(&queries, dns.RcodeNameError, nil, nil))
+	defer dns.HandleRemove("nosoa.test.")
+
+	r := NewCachingResolver(testResolver.(QueryResolver), 10)
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupTXTStrict("nx.test."); err != ErrDNSPermerror {
+			t.Errorf("expected %v, got %v", ErrDNSPermerror, err)
+		}
+		if txts, err := r.LookupTXT("nosoa.test."); len(txts) != 0 || err != nil {
+			t.Errorf("unexpected answer: %q, %v", txts, err)
+		}
+	}
+	if q := atomic.LoadInt32(&queries); q != 3 {
+		t.Errorf("expected 3 queries, got %d", q)
+	}
+}
+
+func TestCachingResolverEviction(t *testing.T) {
+	var queries int32
+	dns.HandleFunc("lru.test.", countingZone(&queries, dns.RcodeSuccess, []string{
+		"lru.test. 300 IN A 10.0.0.1",
+		"lru.test. 300 IN AAAA 2001:db8::1",
+		`lru.test. 300 IN TXT "v=spf1 -all"`,
+	}, nil))
+	defer dns.HandleRemove("lru.test.")
+
+	r := NewCachingResolver(testResolver.(QueryResolver), 2)
+	ctx := context.Background()
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeA, dns.TypeTXT, dns.TypeA, dns.TypeAAAA} {
+		if _, err := r.QueryContext(ctx, "lru.test.", qtype); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// TXT evicts AAAA, which is queried again
+	if q := atomic.LoadInt32(&queries); q != 4 {
+		t.Errorf("expected 4 queries, got %d", q)
+	}
+	if l := r.Len(); l != 2 {
+		t.Errorf("expected 2 cached answers, got %d", l)
+	}
+}
+
+func TestCachingResolverConcurrent(t *testing.T) {
+	var queries int32
+	dns.HandleFunc("concurrent.test.", countingZone(&queries, dns.RcodeSuccess, []string{
+		"concurrent.test. 300 IN A 10.0.0.1",
+	}, nil))
+	defer dns.HandleRemove("concurrent.test.")
+
+	r := NewCachingResolver(testResolver.(QueryResolver), 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := "concurrent.test."
+			if i%2 == 0 {
+				name = "CONCURRENT.test."
+			}
+			if ok, err := r.Exists(name); !ok || err != nil {
+				t.Errorf("expected match, got %v, %v", ok, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if l := r.Len(); l != 1 {
+		t.Errorf("expected 1 cached answer, got %d", l)
+	}
+}
@@ -0,0 +1,184 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// AdaptResolver returns ResolverContext for the given Resolver.
+// If r already implements ResolverContext it's returned as is. Otherwise
+// returned adapter checks the context before each call of r, however it can't
+// interrupt a call in progress.
+func AdaptResolver(r Resolver) ResolverContext {
+	if rc, ok := r.(ResolverContext); ok {
+		return rc
+	}
+	return &resolverAdapter{r}
+}
+
+// resolverAdapter implements ResolverContext using Resolver
+type resolverAdapter struct {
+	resolver Resolver
+}
+
+// LookupTXTContext returns the DNS TXT records for the given domain name.
+func (r *resolverAdapter) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.resolver.LookupTXT(name)
+}
+
+// LookupTXTStrictContext returns DNS TXT records for the given name, however
+// it will return ErrDNSPermerror upon NXDOMAIN (RCODE 3)
+func (r *resolverAdapter) LookupTXTStrictContext(ctx context.Context, name string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.resolver.LookupTXTStrict(name)
+}
+
+// ExistsContext is used for a DNS A RR lookup (even when the
+// connection type is IPv6).  If any A record is returned, this
+// mechanism matches.
+func (r *resolverAdapter) ExistsContext(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return r.resolver.Exists(name)
+}
+
+// MatchIPContext provides an address lookup, which should be done on the
+// name using the type of lookup (A or AAAA).
+func (r *resolverAdapter) MatchIPContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return r.resolver.MatchIP(name, matcher)
+}
+
+// MatchMXContext is similar to MatchIPContext but first performs an MX lookup
+// on the name.
+func (r *resolverAdapter) MatchMXContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return r.resolver.MatchMX(name, matcher)
+}
+
+// LookupPTRContext performs a reverse lookup of the given IP address and
+// returns names which resolve back to the address.
+func (r *resolverAdapter) LookupPTRContext(ctx context.Context, ip net.IP) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return lookupPTR(r.resolver, ip)
+}
+
+// boundResolver implements Resolver using ResolverContext and a context
+// bound to a single evaluation.
+// Once the context is done, all calls return the context's error, so the
+// evaluation stops with Temperror result.
+// It also counts lookups of the evaluation, see Evaluation.
+type boundResolver struct {
+	ctx         context.Context
+	resolver    ResolverContext
+	lookups     int32
+	voidLookups int32
+}
+
+// count records a lookup passed to the underlying resolver. Void lookups are
+// detected the same way LimitedResolver does, calls rejected by
+// LimitedResolver are not counted.
+func (r *boundResolver) count(err error, void bool) {
+	switch err {
+	case ErrDNSLimitExceeded, ErrDNSVoidLookupLimitExceeded:
+		return
+	}
+	atomic.AddInt32(&r.lookups, 1)
+	if void {
+		atomic.AddInt32(&r.voidLookups, 1)
+	}
+}
+
+// ctxErr returns the context's error if the context is done, err otherwise.
+// It's used to distinguish lookups interrupted by the context from the
+// ordinary DNS errors.
+func (r *boundResolver) ctxErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if e := r.ctx.Err(); e != nil {
+		return e
+	}
+	return err
+}
+
+// LookupTXT returns the DNS TXT records for the given domain name.
+func (r *boundResolver) LookupTXT(name string) ([]string, error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+	txts, err := r.resolver.LookupTXTContext(r.ctx, name)
+	r.count(err, err == nil && len(txts) == 0)
+	return txts, r.ctxErr(err)
+}
+
+// LookupTXTStrict returns DNS TXT records for the given name, however it
+// will return ErrDNSPermerror upon NXDOMAIN (RCODE 3)
+func (r *boundResolver) LookupTXTStrict(name string) ([]string, error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+	txts, err := r.resolver.LookupTXTStrictContext(r.ctx, name)
+	r.count(err, false)
+	return txts, r.ctxErr(err)
+}
+
+// Exists is used for a DNS A RR lookup (even when the
+// connection type is IPv6).  If any A record is returned, this
+// mechanism matches.
+func (r *boundResolver) Exists(name string) (bool, error) {
+	if err := r.ctx.Err(); err != nil {
+		return false, err
+	}
+	found, err := r.resolver.ExistsContext(r.ctx, name)
+	r.count(err, err == nil && !found)
+	return found, r.ctxErr(err)
+}
+
+// MatchIP provides an address lookup, which should be done on the name
+// using the type of lookup (A or AAAA).
+func (r *boundResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, error) {
+	if err := r.ctx.Err(); err != nil {
+		return false, err
+	}
+	var called int32
+	found, err := r.resolver.MatchIPContext(r.ctx, name, calledMatcher(matcher, &called))
+	r.count(err, err == nil && atomic.LoadInt32(&called) == 0)
+	return found, r.ctxErr(err)
+}
+
+// MatchMX is similar to MatchIP but first performs an MX lookup on the
+// name.
+func (r *boundResolver) MatchMX(name string, matcher IPMatcherFunc) (bool, error) {
+	if err := r.ctx.Err(); err != nil {
+		return false, err
+	}
+	var called int32
+	found, err := r.resolver.MatchMXContext(r.ctx, name, calledMatcher(matcher, &called))
+	r.count(err, err == nil && atomic.LoadInt32(&called) == 0)
+	return found, r.ctxErr(err)
+}
+
+// LookupPTR performs a reverse lookup of the given IP address and returns
+// names which resolve back to the address.
+func (r *boundResolver) LookupPTR(ip net.IP) ([]string, error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+	names, err := r.resolver.LookupPTRContext(r.ctx, ip)
+	r.count(err, false)
+	return names, r.ctxErr(err)
+}
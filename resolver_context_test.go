@@ -0,0 +1,108 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	_ ResolverContext = &DNSResolver{}
+	_ ResolverContext = &MiekgDNSResolver{}
+	_ ResolverContext = &LimitedResolver{}
+
+	_ PTRResolver = &DNSResolver{}
+	_ PTRResolver = &MiekgDNSResolver{}
+	_ PTRResolver = &LimitedResolver{}
+	_ PTRResolver = &CachingResolver{}
+	_ PTRResolver = &SingleflightResolver{}
+)
+
+// plainResolver hides ResolverContext methods of the embedded Resolver
+type plainResolver struct {
+	Resolver
+}
+
+func TestAdaptResolver(t *testing.T) {
+	if r := AdaptResolver(testResolver); r != testResolver.(ResolverContext) {
+		t.Error("ResolverContext must be returned as is")
+	}
+
+	r := AdaptResolver(plainResolver{testResolver})
+	if _, ok := r.(*resolverAdapter); !ok {
+		t.Fatalf("want *resolverAdapter, got %T", r)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.LookupTXTContext(ctx, "domain."); err != context.Canceled {
+		t.Errorf("LookupTXTContext got %v; want context.Canceled", err)
+	}
+	if _, err := r.MatchIPContext(ctx, "domain.", nil); err != context.Canceled {
+		t.Errorf("MatchIPContext got %v; want context.Canceled", err)
+	}
+
+	// reverse lookups are optional
+	if _, err := r.LookupPTRContext(context.Background(), net.IPv4(10, 0, 0, 1)); err != errNoReverseLookups {
+		t.Errorf("LookupPTRContext got %v; want errNoReverseLookups", err)
+	}
+}
+
+func TestCheckHostWithResolverContext(t *testing.T) {
+	dns.HandleFunc("context.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`context.test. 0 IN TXT "v=spf1 a:slow.context.test -all"`,
+			`include.context.test. 0 IN TXT "v=spf1 include:context.test ip4:10.0.0.1 -all"`,
+		},
+		dns.TypeA: {
+			"context.test. 0 IN A 10.0.0.1",
+		},
+	}))
+	defer dns.HandleRemove("context.test.")
+
+	dns.HandleFunc("slow.context.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(500 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("slow.context.test.")
+
+	ip := net.ParseIP("10.0.0.1")
+	resolver := AdaptResolver(NewLimitedResolver(testResolver, 10, 10))
+
+	r, _, err := CheckHostWithResolverContext(context.Background(), ip, "context.test", "context.test", resolver)
+	if r != Fail || err != nil {
+		t.Errorf("want [`fail` `<nil>`], got [`%v` `%v`]", r, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _, err = CheckHostWithResolverContext(ctx, ip, "context.test", "context.test", resolver)
+	if r != Temperror || err != context.Canceled {
+		t.Errorf("want [`temperror` `context canceled`], got [`%v` `%v`]", r, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r, _, err = CheckHostWithResolverContext(ctx, ip, "context.test", "context.test", resolver)
+	if r != Temperror || err != context.DeadlineExceeded {
+		t.Errorf("want [`temperror` `context deadline exceeded`], got [`%v` `%v`]", r, err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("evaluation was not interrupted, took %v", elapsed)
+	}
+
+	// canceled while evaluating the included record
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r, _, err = CheckHostWithResolverContext(ctx, ip, "include.context.test", "context.test",
+		AdaptResolver(NewLimitedResolver(testResolver, 10, 10)))
+	if r != Temperror || err != context.DeadlineExceeded {
+		t.Errorf("want [`temperror` `context deadline exceeded`], got [`%v` `%v`]", r, err)
+	}
+}
@@ -0,0 +1,95 @@
+package spf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the media type of DNS messages exchanged over HTTPS.
+const dohMediaType = "application/dns-message"
+
+// NewDoHResolver returns new instance of Resolver, which sends the queries
+// over HTTPS (DNS over HTTPS, RFC 8484) to the servers at urls, e.g.
+// "https://dns.example.com/dns-query". The queries are sent by client, or by
+// http.DefaultClient if it's nil, so TLS settings can be set by its
+// Transport.
+//
+// Apart from the transport the resolver works like the one returned by
+// NewMiekgDNSResolverWithServers.
+func NewDoHResolver(urls []string, client *http.Client, opts ...ResolverOption) (Resolver, error) {
+	if len(urls) == 0 {
+		return nil, errNoServers
+	}
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid DNS over HTTPS URL: %s", s)
+		}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	r := newMiekgDNSResolver(new(dns.Client), urls, opts)
+	r.transport = (&httpsTransport{client}).roundTrip
+	return r, nil
+}
+
+// httpsTransport exchanges DNS messages using POST requests.
+type httpsTransport struct {
+	client *http.Client
+}
+
+var errDoHResponse = errors.New("invalid DNS over HTTPS response")
+
+// roundTrip sends req to the server at URL server and returns the response.
+//
+// From RFC 8484, section 4.1:
+// In order to maximize HTTP cache friendliness, DoH clients using media
+// formats that include the ID field from the DNS message header, such as
+// "application/dns-message", SHOULD use a DNS ID of 0 in every DNS request.
+func (t *httpsTransport) roundTrip(ctx context.Context, req *dns.Msg, server string) (*dns.Msg, error) {
+	req.Id = 0
+	msg, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequest(http.MethodPost, server, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", dohMediaType)
+	hreq.Header.Set("Accept", dohMediaType)
+
+	hres, err := t.client.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer hres.Body.Close()
+	if hres.StatusCode != http.StatusOK || hres.Header.Get("Content-Type") != dohMediaType {
+		return nil, errDoHResponse
+	}
+	// DNS messages are limited to 65535 bytes
+	body, err := ioutil.ReadAll(io.LimitReader(hres.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	res := new(dns.Msg)
+	if err := res.Unpack(body); err != nil {
+		return nil, err
+	}
+	if res.Id != req.Id {
+		return nil, dns.ErrId
+	}
+	return res, nil
+}
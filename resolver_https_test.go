@@ -0,0 +1,106 @@
+package spf
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// dohResponseWriter captures the response of dns.Handler.
+type dohResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// dohHandler serves DNS over HTTPS POST requests at /dns-query with the
+// handlers registered by dns.HandleFunc. It counts the requests with
+// nonzero DNS ID.
+func dohHandler(nonzeroIDs *int32) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported request", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Id != 0 {
+			atomic.AddInt32(nonzeroIDs, 1)
+		}
+		rw := &dohResponseWriter{}
+		dns.DefaultServeMux.ServeDNS(rw, req)
+		res, err := rw.msg.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(res)
+	})
+	return mux
+}
+
+func TestDoHResolver(t *testing.T) {
+	defer encryptedZone("doh.test.")()
+
+	var nonzeroIDs int32
+	cert, pool := selfSignedCert(t)
+	s := httptest.NewUnstartedServer(dohHandler(&nonzeroIDs))
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	// handshakes of the clients not trusting the certificate fail
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.StartTLS()
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	r, err := NewDoHResolver([]string{s.URL + "/dns-query"}, client, WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEncryptedResolver(t, r, "doh.test.")
+	if n := atomic.LoadInt32(&nonzeroIDs); n != 0 {
+		t.Errorf("expected DNS ID 0, got %d requests with other ID", n)
+	}
+
+	// the first server fails with HTTP error
+	r, _ = NewDoHResolver([]string{s.URL + "/missing", s.URL + "/dns-query"}, client, WithRetries(0, 0))
+	if ok, err := r.Exists("doh.test."); !ok || err != nil {
+		t.Errorf("expected match, got %v, %v", ok, err)
+	}
+
+	// the certificate is not trusted
+	r, _ = NewDoHResolver([]string{s.URL + "/dns-query"}, nil, WithRetries(0, 0))
+	if _, err := r.LookupTXT("doh.test."); err != ErrDNSTemperror {
+		t.Errorf("expected %v, got %v", ErrDNSTemperror, err)
+	}
+
+	for _, urls := range [][]string{nil, {"http://127.0.0.1/dns-query"}, {"https:///dns-query"}, {"%"}} {
+		if _, err := NewDoHResolver(urls, nil); err == nil {
+			t.Errorf("%q: expected error", urls)
+		}
+	}
+}
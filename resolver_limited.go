@@ -1,27 +1,56 @@
 package spf
 
 import (
+	"context"
 	"net"
 	"sync/atomic"
 )
 
 // LimitedResolver wraps a Resolver and limits number of lookups possible to do
 // with it. All overlimited calls return ErrDNSLimitExceeded.
+// LimitedResolver implements ResolverContext as well, passing the context to
+// the wrapped resolver.
+// Optionally it also limits number of void lookups, that is lookups which
+// return no answers or NXDOMAIN. Once that limit is exceeded, the call
+// returns ErrDNSVoidLookupLimitExceeded.
 type LimitedResolver struct {
-	lookupLimit    int32
-	mxQueriesLimit uint16
-	resolver       Resolver
+	lookupLimit     int32
+	mxQueriesLimit  uint16
+	voidLookupLimit int32
+	resolver        ResolverContext
 }
 
 // NewLimitedResolver returns a resolver which will pass up to lookupLimit calls to r.
 // In addition to that limit, the evaluation of each "MX" record will be limited
 // to mxQueryLimit.
 // All calls over the limit will return ErrDNSLimitExceeded.
+// Void lookups are not limited by the returned resolver, see
+// NewLimitedResolverWithVoidLimit.
 func NewLimitedResolver(r Resolver, lookupLimit, mxQueriesLimit uint16) Resolver {
+	// there can't be more void lookups than lookups at all
+	return NewLimitedResolverWithVoidLimit(r, lookupLimit, mxQueriesLimit, lookupLimit)
+}
+
+// NewLimitedResolverWithVoidLimit returns a resolver which works like the one
+// returned by NewLimitedResolver, but in addition it will allow up to
+// voidLookupLimit lookups with empty answers or NXDOMAIN.
+// All void lookups over the limit will return ErrDNSVoidLookupLimitExceeded.
+//
+// From RFC 7208, section 4.6.4:
+// As described at the end of Section 11.1, there may be cases where it is
+// useful to limit the number of "terms" for which DNS queries return either
+// a positive answer (RCODE 0) with an answer count of 0, or a "Name Error"
+// (RCODE 3) answer.  These are sometimes collectively referred to as "void
+// lookups".  SPF implementations SHOULD limit "void lookups" to two.  An
+// implementation MAY choose to make such a limit configurable.  In this
+// case, a default of two is RECOMMENDED.  Exceeding the limit produces a
+// "permerror" result.
+func NewLimitedResolverWithVoidLimit(r Resolver, lookupLimit, mxQueriesLimit, voidLookupLimit uint16) Resolver {
 	return &LimitedResolver{
-		lookupLimit:    int32(lookupLimit), // sure that l is positive or zero
-		mxQueriesLimit: mxQueriesLimit,
-		resolver:       r,
+		lookupLimit:     int32(lookupLimit), // sure that l is positive or zero
+		mxQueriesLimit:  mxQueriesLimit,
+		voidLookupLimit: int32(voidLookupLimit),
+		resolver:        AdaptResolver(r),
 	}
 }
 
@@ -29,14 +58,41 @@ func (r *LimitedResolver) canLookup() bool {
 	return atomic.AddInt32(&r.lookupLimit, -1) > 0
 }
 
+// voidLookup registers a void lookup and returns ErrDNSVoidLookupLimitExceeded
+// if there were too many of them.
+func (r *LimitedResolver) voidLookup() error {
+	if atomic.AddInt32(&r.voidLookupLimit, -1) < 0 {
+		return ErrDNSVoidLookupLimitExceeded
+	}
+	return nil
+}
+
+// calledMatcher returns matcher which sets *called to 1 upon first call.
+// It's used to detect void address lookups.
+func calledMatcher(matcher IPMatcherFunc, called *int32) IPMatcherFunc {
+	return func(ip net.IP) (bool, error) {
+		atomic.StoreInt32(called, 1)
+		return matcher(ip)
+	}
+}
+
 // LookupTXT returns the DNS TXT records for the given domain name.
 // Returns nil and ErrDNSLimitExceeded if total number of lookups made
 // by underlying resolver exceed the limit.
 func (r *LimitedResolver) LookupTXT(name string) ([]string, error) {
+	return r.LookupTXTContext(context.Background(), name)
+}
+
+// LookupTXTContext is LookupTXT, which passes ctx to the underlying resolver.
+func (r *LimitedResolver) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
 	if !r.canLookup() {
 		return nil, ErrDNSLimitExceeded
 	}
-	return r.resolver.LookupTXT(name)
+	txts, err := r.resolver.LookupTXTContext(ctx, name)
+	if err == nil && len(txts) == 0 {
+		err = r.voidLookup()
+	}
+	return txts, err
 }
 
 // LookupTXTStrict returns the DNS TXT records for the given domain name.
@@ -44,11 +100,23 @@ func (r *LimitedResolver) LookupTXT(name string) ([]string, error) {
 // by underlying resolver exceed the limit.
 // It will also return ErrDNSPermerror upon DNS call return error NXDOMAIN
 // (RCODE 3)
+//
+// The lookups are not counted as void lookups. LookupTXTStrict is used to
+// look up SPF records of the evaluated domain and of "include" and "redirect"
+// targets, for which no record already results in "none" or "permerror", so
+// the void lookup limit could only turn "none" of the evaluated domain into
+// "permerror".
 func (r *LimitedResolver) LookupTXTStrict(name string) ([]string, error) {
+	return r.LookupTXTStrictContext(context.Background(), name)
+}
+
+// LookupTXTStrictContext is LookupTXTStrict, which passes ctx to the
+// underlying resolver.
+func (r *LimitedResolver) LookupTXTStrictContext(ctx context.Context, name string) ([]string, error) {
 	if !r.canLookup() {
 		return nil, ErrDNSLimitExceeded
 	}
-	return r.resolver.LookupTXTStrict(name)
+	return r.resolver.LookupTXTStrictContext(ctx, name)
 }
 
 // Exists is used for a DNS A RR lookup (even when the
@@ -57,10 +125,19 @@ func (r *LimitedResolver) LookupTXTStrict(name string) ([]string, error) {
 // Returns false and ErrDNSLimitExceeded if total number of lookups made
 // by underlying resolver exceed the limit.
 func (r *LimitedResolver) Exists(name string) (bool, error) {
+	return r.ExistsContext(context.Background(), name)
+}
+
+// ExistsContext is Exists, which passes ctx to the underlying resolver.
+func (r *LimitedResolver) ExistsContext(ctx context.Context, name string) (bool, error) {
 	if !r.canLookup() {
 		return false, ErrDNSLimitExceeded
 	}
-	return r.resolver.Exists(name)
+	found, err := r.resolver.ExistsContext(ctx, name)
+	if err == nil && !found {
+		err = r.voidLookup()
+	}
+	return found, err
 }
 
 // MatchIP provides an address lookup, which should be done on the name
@@ -70,10 +147,20 @@ func (r *LimitedResolver) Exists(name string) (bool, error) {
 // Returns false and ErrDNSLimitExceeded if total number of lookups made
 // by underlying resolver exceed the limit.
 func (r *LimitedResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, error) {
+	return r.MatchIPContext(context.Background(), name, matcher)
+}
+
+// MatchIPContext is MatchIP, which passes ctx to the underlying resolver.
+func (r *LimitedResolver) MatchIPContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
 	if !r.canLookup() {
 		return false, ErrDNSLimitExceeded
 	}
-	return r.resolver.MatchIP(name, matcher)
+	var called int32
+	found, err := r.resolver.MatchIPContext(ctx, name, calledMatcher(matcher, &called))
+	if err == nil && atomic.LoadInt32(&called) == 0 {
+		err = r.voidLookup()
+	}
+	return found, err
 }
 
 // MatchMX is similar to MatchIP but first performs an MX lookup on the
@@ -89,15 +176,44 @@ func (r *LimitedResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, err
 // Returns false and ErrDNSLimitExceeded if total number of lookups made
 // by underlying resolver exceed the limit.
 func (r *LimitedResolver) MatchMX(name string, matcher IPMatcherFunc) (bool, error) {
+	return r.MatchMXContext(context.Background(), name, matcher)
+}
+
+// MatchMXContext is MatchMX, which passes ctx to the underlying resolver.
+func (r *LimitedResolver) MatchMXContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
 	if !r.canLookup() {
 		return false, ErrDNSLimitExceeded
 	}
 
+	var called int32
 	limit := int32(r.mxQueriesLimit)
-	return r.resolver.MatchMX(name, func(ip net.IP) (bool, error) {
+	found, err := r.resolver.MatchMXContext(ctx, name, func(ip net.IP) (bool, error) {
+		atomic.StoreInt32(&called, 1)
 		if atomic.AddInt32(&limit, -1) < 1 {
 			return false, ErrDNSLimitExceeded
 		}
 		return matcher(ip)
 	})
+	if err == nil && atomic.LoadInt32(&called) == 0 {
+		err = r.voidLookup()
+	}
+	return found, err
+}
+
+// LookupPTR performs a reverse lookup of the given IP address and returns
+// names which resolve back to the address.
+// The "ptr" mechanism counts as a single lookup, address lookups made to
+// validate returned names are limited by underlying resolver.
+// Returns nil and ErrDNSLimitExceeded if total number of lookups made
+// by underlying resolver exceed the limit.
+func (r *LimitedResolver) LookupPTR(ip net.IP) ([]string, error) {
+	return r.LookupPTRContext(context.Background(), ip)
+}
+
+// LookupPTRContext is LookupPTR, which passes ctx to the underlying resolver.
+func (r *LimitedResolver) LookupPTRContext(ctx context.Context, ip net.IP) ([]string, error) {
+	if !r.canLookup() {
+		return nil, ErrDNSLimitExceeded
+	}
+	return r.resolver.LookupPTRContext(ctx, ip)
 }
@@ -36,6 +36,13 @@ func TestLimitedResolver(t *testing.T) {
 	}))
 	defer dns.HandleRemove("mxmustfail.")
 
+	dns.HandleFunc("1.0.0.10.in-addr.arpa.", zone(map[uint16][]string{
+		dns.TypePTR: {
+			"1.0.0.10.in-addr.arpa. 0 IN PTR domain.",
+		},
+	}))
+	defer dns.HandleRemove("1.0.0.10.in-addr.arpa.")
+
 	{
 		r := NewLimitedResolver(testResolver, 2, 2)
 		a, err := r.LookupTXT("domain.")
@@ -92,4 +99,63 @@ func TestLimitedResolver(t *testing.T) {
 			t.Errorf("MatchMX got: %v, %v; want false, ErrDNSLimitExceeded", b, err)
 		}
 	}
+	{
+		r := NewLimitedResolver(testResolver, 2, 2).(PTRResolver)
+		names, err := r.LookupPTR(net.ParseIP("10.0.0.1"))
+		if len(names) != 1 || err != nil {
+			t.Errorf("failed on 1st LookupPTR: %v, %v", names, err)
+		}
+		names, err = r.LookupPTR(net.ParseIP("10.0.0.1"))
+		if len(names) != 0 || err != ErrDNSLimitExceeded {
+			t.Error("failed on 2nd LookupPTR")
+		}
+	}
+}
+
+func TestLimitedResolverVoidLookups(t *testing.T) {
+	dns.HandleFunc("domain.", zone(map[uint16][]string{
+		dns.TypeA: {
+			"domain. 0 IN A 10.0.0.1",
+		},
+		dns.TypeTXT: {
+			`domain. 0 IN TXT "ok"`,
+		},
+	}))
+	defer dns.HandleRemove("domain.")
+
+	noMatch := func(ip net.IP) (bool, error) {
+		return false, nil
+	}
+	{
+		r := NewLimitedResolverWithVoidLimit(testResolver, 10, 10, 2)
+		if _, err := r.MatchIP("domain.", noMatch); err != nil {
+			t.Errorf("MatchIP with addresses is not a void lookup, got %v", err)
+		}
+		if _, err := r.LookupTXT("domain."); err != nil {
+			t.Errorf("LookupTXT with records is not a void lookup, got %v", err)
+		}
+		if _, err := r.Exists("void1.domain."); err != nil {
+			t.Errorf("failed on 1st void lookup: %v", err)
+		}
+		if _, err := r.MatchMX("void2.domain.", noMatch); err != nil {
+			t.Errorf("failed on 2nd void lookup: %v", err)
+		}
+		if _, err := r.LookupTXT("void3.domain."); err != ErrDNSVoidLookupLimitExceeded {
+			t.Errorf("LookupTXT got: %v; want ErrDNSVoidLookupLimitExceeded", err)
+		}
+	}
+	{
+		r := NewLimitedResolverWithVoidLimit(testResolver, 10, 10, 0)
+		if _, err := r.MatchIP("void.domain.", noMatch); err != ErrDNSVoidLookupLimitExceeded {
+			t.Errorf("MatchIP got: %v; want ErrDNSVoidLookupLimitExceeded", err)
+		}
+	}
+	{
+		r := NewLimitedResolver(testResolver, 10, 10)
+		for i := 0; i < 9; i++ {
+			if _, err := r.Exists("void.domain."); err != nil {
+				t.Errorf("#%d void lookups must not be limited, got %v", i, err)
+			}
+		}
+	}
 }
@@ -1,29 +1,181 @@
 package spf
 
 import (
+	"context"
+	"errors"
 	"net"
-	"sync"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
-	"strings"
 )
 
+// Defaults of MiekgDNSResolver, see ResolverOption.
+const (
+	// DefaultUDPBufferSize is the UDP payload size advertised with EDNS0.
+	// It's small enough to avoid IP fragmentation on common links.
+	DefaultUDPBufferSize = 1232
+	// DefaultQueryTimeout is the time to wait for a response of a server.
+	DefaultQueryTimeout = 2 * time.Second
+	// DefaultRetries is the number of times the servers are queried again
+	// after all of them failed.
+	DefaultRetries = 1
+	// DefaultBackoff is the time to wait before the first retry.
+	DefaultBackoff = 100 * time.Millisecond
+)
+
+// ResolverOption configures MiekgDNSResolver.
+type ResolverOption func(*MiekgDNSResolver)
+
+// WithUDPBufferSize sets the UDP payload size advertised with EDNS0
+// (RFC 6891), that is the size of the largest response the server may send
+// over UDP. Zero disables EDNS0, so UDP responses are limited to 512 bytes.
+// Responses which don't fit are truncated by the server and the queries are
+// retried over TCP.
+func WithUDPBufferSize(size uint16) ResolverOption {
+	return func(r *MiekgDNSResolver) {
+		r.udpSize = size
+	}
+}
+
+// WithQueryTimeout sets the time to wait for a response of a single server
+// before the query is sent to the next one.
+func WithQueryTimeout(timeout time.Duration) ResolverOption {
+	return func(r *MiekgDNSResolver) {
+		r.timeout = timeout
+	}
+}
+
+// WithRetries sets the number of times the servers are queried again once
+// all of them failed. Before the first retry the resolver waits for the
+// backoff time, which is doubled for each subsequent one.
+func WithRetries(retries int, backoff time.Duration) ResolverOption {
+	return func(r *MiekgDNSResolver) {
+		r.retries = retries
+		r.backoff = backoff
+	}
+}
+
 // NewMiekgDNSResolver returns new instance of Resolver
-func NewMiekgDNSResolver(addr string) (Resolver, error) {
-	if _, _, e := net.SplitHostPort(addr); e != nil {
-		return nil, e
+func NewMiekgDNSResolver(addr string, opts ...ResolverOption) (Resolver, error) {
+	return NewMiekgDNSResolverWithServers([]string{addr}, opts...)
+}
+
+// NewMiekgDNSResolverWithServers returns new instance of Resolver, which
+// queries the first of addrs and fails over to the next ones. A server,
+// which fails, is skipped by the subsequent queries until the others fail
+// too. ErrDNSTemperror is returned only after all the servers failed for
+// all the retries.
+func NewMiekgDNSResolverWithServers(addrs []string, opts ...ResolverOption) (Resolver, error) {
+	if len(addrs) == 0 {
+		return nil, errNoServers
+	}
+	for _, addr := range addrs {
+		if _, _, e := net.SplitHostPort(addr); e != nil {
+			return nil, e
+		}
 	}
-	return &MiekgDNSResolver{
-		client:     new(dns.Client),
-		serverAddr: addr,
-	}, nil
+	return newMiekgDNSResolver(new(dns.Client), addrs, opts), nil
 }
 
+func newMiekgDNSResolver(client *dns.Client, servers []string, opts []ResolverOption) *MiekgDNSResolver {
+	r := &MiekgDNSResolver{
+		client:  client,
+		servers: append([]string(nil), servers...),
+		udpSize: DefaultUDPBufferSize,
+		timeout: DefaultQueryTimeout,
+		retries: DefaultRetries,
+		backoff: DefaultBackoff,
+	}
+	r.transport = r.roundTrip
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// NewMiekgDNSResolverFromFile returns new instance of Resolver, which
+// queries the nameservers listed in resolv.conf file at path, e.g.
+// "/etc/resolv.conf". The query timeout and the number of attempts are
+// taken from the "timeout" and "attempts" options, unless set by opts.
+func NewMiekgDNSResolverFromFile(path string, opts ...ResolverOption) (Resolver, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(conf.Servers))
+	for _, s := range conf.Servers {
+		addrs = append(addrs, net.JoinHostPort(s, conf.Port))
+	}
+	o := []ResolverOption{WithQueryTimeout(time.Duration(conf.Timeout) * time.Second)}
+	if conf.Attempts > 0 {
+		o = append(o, WithRetries(conf.Attempts-1, DefaultBackoff))
+	}
+	return NewMiekgDNSResolverWithServers(addrs, append(o, opts...)...)
+}
+
+var errNoServers = errors.New("no nameservers")
+
 // MiekgDNSResolver implements Resolver using github.com/miekg/dns
+// It's safe for concurrent use, each query is exchanged over its own
+// connection and the response is matched by the message ID.
+// Queries are sent over UDP and retried over TCP if the response is
+// truncated, unless the resolver is returned by NewDoTResolver or
+// NewDoHResolver.
 type MiekgDNSResolver struct {
-	mu         sync.Mutex
-	client     *dns.Client
-	serverAddr string
+	current int32 // index of the server to query first
+	client  *dns.Client
+	servers []string
+	udpSize uint16
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+
+	// transport sends the query to the server and returns the response
+	transport func(ctx context.Context, req *dns.Msg, server string) (*dns.Msg, error)
+}
+
+// clientFor returns a new client, configured like r.client, for a single
+// exchange bound by the deadline of ctx. dns.Client.ExchangeContext is not
+// used as it modifies the client. With no deadline, e.g. when the query
+// timeout is disabled, DefaultQueryTimeout is used, as zero disables the
+// timeout of the dialer.
+func (r *MiekgDNSResolver) clientFor(ctx context.Context) *dns.Client {
+	timeout := DefaultQueryTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	return &dns.Client{
+		Net:          r.client.Net,
+		UDPSize:      r.client.UDPSize,
+		TLSConfig:    r.client.TLSConfig,
+		Dialer:       &net.Dialer{Timeout: timeout},
+		Timeout:      r.client.Timeout,
+		DialTimeout:  r.client.DialTimeout,
+		ReadTimeout:  r.client.ReadTimeout,
+		WriteTimeout: r.client.WriteTimeout,
+	}
+}
+
+// roundTrip sends req to the server at addr and returns the response.
+// Truncated UDP responses are discarded and the query is repeated over TCP.
+//
+// From RFC 7766, section 5:
+// A DNS client that receives a truncated response [...] SHOULD retry the
+// query over TCP.
+func (r *MiekgDNSResolver) roundTrip(ctx context.Context, req *dns.Msg, addr string) (*dns.Msg, error) {
+	client := r.clientFor(ctx)
+	res, _, err := client.Exchange(req, addr)
+	if res != nil && res.Truncated && isUDP(client.Net) {
+		client.Net = "tcp" + strings.TrimPrefix(client.Net, "udp")
+		res, _, err = client.Exchange(req, addr)
+	}
+	return res, err
+}
+
+func isUDP(network string) bool {
+	return network == "" || strings.HasPrefix(network, "udp")
 }
 
 // If the DNS lookup returns a server failure (RCODE 2) or some other
@@ -37,12 +189,86 @@ type MiekgDNSResolver struct {
 // server returns "Name Error" (RCODE 3), then evaluation of the
 // mechanism continues as if the server returned no error (RCODE 0) and
 // zero answer records.
-func (r *MiekgDNSResolver) exchange(req *dns.Msg) (*dns.Msg, error) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	res, _, err := r.client.Exchange(req, r.serverAddr)
-	if err != nil {
+//
+// Such a failure of a server is reported only after the other servers
+// failed too, including the retries.
+//
+// The exchange is abandoned once ctx is done, in such case ctx.Err() is
+// returned.
+func (r *MiekgDNSResolver) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if r.udpSize > 0 {
+		req.SetEdns0(r.udpSize, false)
+	}
+	backoff := r.backoff
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if attempt > 0 && backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		first := int(atomic.LoadInt32(&r.current))
+		for i := range r.servers {
+			n := (first + i) % len(r.servers)
+			res, err := r.exchangeWith(ctx, req, r.servers[n])
+			if err == nil {
+				return res, nil
+			}
+			if err != ErrDNSTemperror {
+				return nil, err
+			}
+			// rotate away from the failing server
+			atomic.CompareAndSwapInt32(&r.current, int32(n), int32((n+1)%len(r.servers)))
+		}
+	}
+	return nil, ErrDNSTemperror
+}
+
+// exchangeWith exchanges req with the server at addr within the query
+// timeout. It returns ErrDNSTemperror if the server fails and ctx.Err() if
+// ctx is done.
+func (r *MiekgDNSResolver) exchangeWith(ctx context.Context, req *dns.Msg, addr string) (*dns.Msg, error) {
+	type response struct {
+		msg *dns.Msg
+		err error
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	qctx := ctx
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		qctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	done := make(chan response, 1)
+	// the abandoned exchange may still use its copy of req
+	go func(req *dns.Msg) {
+		res, err := r.transport(qctx, req, addr)
+		done <- response{res, err}
+	}(req.Copy())
+
+	var res *dns.Msg
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-qctx.Done():
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, ErrDNSTemperror
+	case d := <-done:
+		if d.err != nil {
+			// the exchange times out at the context's deadline, possibly
+			// just before the context is marked as done
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				return nil, context.DeadlineExceeded
+			}
+			return nil, ErrDNSTemperror
+		}
+		res = d.msg
 	}
 	// RCODE 3
 	if res.Rcode == dns.RcodeNameError {
@@ -54,79 +280,53 @@ func (r *MiekgDNSResolver) exchange(req *dns.Msg) (*dns.Msg, error) {
 	return res, nil
 }
 
-// LookupTXT returns the DNS TXT records for the given domain name.
-func (r *MiekgDNSResolver) LookupTXT(name string) ([]string, error) {
+// QueryContext returns the answer to the query of qtype records of name,
+// including TTL, see QueryResolver.
+func (r *MiekgDNSResolver) QueryContext(ctx context.Context, name string, qtype uint16) (*Answer, error) {
 	req := new(dns.Msg)
-	req.SetQuestion(name, dns.TypeTXT)
+	req.SetQuestion(name, qtype)
 
-	res, err := r.exchange(req)
+	res, err := r.exchange(ctx, req)
 	if err != nil {
 		return nil, err
 	}
+	return newAnswer(res, qtype), nil
+}
 
-	txts := make([]string, 0, len(res.Answer))
-	for _, a := range res.Answer {
-		if r, ok := a.(*dns.TXT); ok {
-			txts = append(txts, strings.Join(r.Txt,""))
-		}
-	}
-	return txts, nil
+// LookupTXT returns the DNS TXT records for the given domain name.
+func (r *MiekgDNSResolver) LookupTXT(name string) ([]string, error) {
+	return r.LookupTXTContext(context.Background(), name)
+}
+
+// LookupTXTContext is LookupTXT, which uses provided context for the
+// underlying DNS query.
+func (r *MiekgDNSResolver) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	return queryResolver{r}.LookupTXTContext(ctx, name)
 }
 
 // LookupTXTStrict returns DNS TXT records for the given name, however it
 // will return ErrDNSPermerror upon NXDOMAIN (RCODE 3)
 func (r *MiekgDNSResolver) LookupTXTStrict(name string) ([]string, error) {
+	return r.LookupTXTStrictContext(context.Background(), name)
+}
 
-	req := new(dns.Msg)
-	req.SetQuestion(name, dns.TypeTXT)
-
-	res, err := r.exchange(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if res.Rcode == dns.RcodeNameError {
-		return nil, ErrDNSPermerror
-	}
-
-	txts := make([]string, 0, len(res.Answer))
-	for _, a := range res.Answer {
-		if r, ok := a.(*dns.TXT); ok {
-			txts = append(txts, strings.Join(r.Txt,""))
-		}
-	}
-	return txts, nil
+// LookupTXTStrictContext is LookupTXTStrict, which uses provided context for the
+// underlying DNS query.
+func (r *MiekgDNSResolver) LookupTXTStrictContext(ctx context.Context, name string) ([]string, error) {
+	return queryResolver{r}.LookupTXTStrictContext(ctx, name)
 }
 
 // Exists is used for a DNS A RR lookup (even when the
 // connection type is IPv6).  If any A record is returned, this
 // mechanism matches.
 func (r *MiekgDNSResolver) Exists(name string) (bool, error) {
-	req := new(dns.Msg)
-	req.SetQuestion(name, dns.TypeA)
-
-	res, err := r.exchange(req)
-	if err != nil {
-		return false, err
-	}
-
-	return len(res.Answer) > 0, nil
+	return r.ExistsContext(context.Background(), name)
 }
 
-func matchIP(rrs []dns.RR, matcher IPMatcherFunc) (bool, error) {
-	for _, rr := range rrs {
-		var ip net.IP
-		switch a := rr.(type) {
-		case *dns.A:
-			ip = a.A
-		case *dns.AAAA:
-			ip = a.AAAA
-		}
-		if m, e := matcher(ip); m || e != nil {
-			return m, e
-		}
-	}
-	return false, nil
+// ExistsContext is Exists, which uses provided context for the underlying
+// DNS query.
+func (r *MiekgDNSResolver) ExistsContext(ctx context.Context, name string) (bool, error) {
+	return queryResolver{r}.ExistsContext(ctx, name)
 }
 
 // MatchIP provides an address lookup, which should be done on the name
@@ -134,42 +334,13 @@ func matchIP(rrs []dns.RR, matcher IPMatcherFunc) (bool, error) {
 // Then IPMatcherFunc used to compare checked IP to the returned address(es).
 // If any address matches, the mechanism matches
 func (r *MiekgDNSResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, error) {
-	var wg sync.WaitGroup
-	qTypes := []uint16{dns.TypeA, dns.TypeAAAA}
-	hits := make(chan hit, len(qTypes))
-
-	for _, qType := range qTypes {
-		wg.Add(1)
-		go func(qType uint16) {
-			defer wg.Done()
-
-			req := new(dns.Msg)
-			req.SetQuestion(name, qType)
-			res, err := r.exchange(req)
-			if err != nil {
-				hits <- hit{false, err}
-				return
-			}
-
-			if m, e := matchIP(res.Answer, matcher); m || e != nil {
-				hits <- hit{m, e}
-				return
-			}
-		}(qType)
-	}
-
-	go func() {
-		wg.Wait()
-		close(hits)
-	}()
-
-	for h := range hits {
-		if h.found || h.err != nil {
-			return h.found, h.err
-		}
-	}
+	return r.MatchIPContext(context.Background(), name, matcher)
+}
 
-	return false, nil
+// MatchIPContext is MatchIP, which uses provided context for the underlying
+// DNS queries.
+func (r *MiekgDNSResolver) MatchIPContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	return queryResolver{r}.MatchIPContext(ctx, name, matcher)
 }
 
 // MatchMX is similar to MatchIP but first performs an MX lookup on the
@@ -177,40 +348,23 @@ func (r *MiekgDNSResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, er
 // Then IPMatcherFunc used to compare checked IP to the returned address(es).
 // If any address matches, the mechanism matches
 func (r *MiekgDNSResolver) MatchMX(name string, matcher IPMatcherFunc) (bool, error) {
-	req := new(dns.Msg)
-	req.SetQuestion(name, dns.TypeMX)
-
-	res, err := r.exchange(req)
-	if err != nil {
-		return false, err
-	}
+	return r.MatchMXContext(context.Background(), name, matcher)
+}
 
-	var wg sync.WaitGroup
-	hits := make(chan hit, len(res.Answer))
+// MatchMXContext is MatchMX, which uses provided context for the underlying
+// DNS queries.
+func (r *MiekgDNSResolver) MatchMXContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	return queryResolver{r}.MatchMXContext(ctx, name, matcher)
+}
 
-	for _, rr := range res.Answer {
-		mx, ok := rr.(*dns.MX)
-		if !ok {
-			continue
-		}
-		wg.Add(1)
-		go func(name string) {
-			found, err := r.MatchIP(name, matcher)
-			hits <- hit{found, err}
-			wg.Done()
-		}(mx.Mx)
-	}
-
-	go func() {
-		wg.Wait()
-		close(hits)
-	}()
-
-	for h := range hits {
-		if h.found || h.err != nil {
-			return h.found, h.err
-		}
-	}
+// LookupPTR performs a reverse lookup of the given IP address and returns
+// names which resolve back to the address.
+func (r *MiekgDNSResolver) LookupPTR(ip net.IP) ([]string, error) {
+	return r.LookupPTRContext(context.Background(), ip)
+}
 
-	return false, nil
+// LookupPTRContext is LookupPTR, which uses provided context for the
+// underlying DNS queries.
+func (r *MiekgDNSResolver) LookupPTRContext(ctx context.Context, ip net.IP) ([]string, error) {
+	return queryResolver{r}.LookupPTRContext(ctx, ip)
 }
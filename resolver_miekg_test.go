@@ -1,7 +1,16 @@
 package spf
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -50,3 +59,238 @@ func TestMiekgDNSResolver_LookupTXT_Multiline(t *testing.T) {
 		t.Errorf("want 1 got %d", len(r))
 	}
 }
+
+// truncatingWriter truncates responses larger than size, like servers do
+// for UDP responses which don't fit the client's buffer.
+type truncatingWriter struct {
+	dns.ResponseWriter
+	size int
+}
+
+func (w *truncatingWriter) WriteMsg(m *dns.Msg) error {
+	if m.Len() > w.size {
+		m.Truncated = true
+		m.Answer = nil
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// truncatingZone is zone, which truncates UDP responses exceeding the
+// buffer size of the query and counts the queries received over TCP.
+func truncatingZone(hosts map[uint16][]string, tcpQueries *int32) func(dns.ResponseWriter, *dns.Msg) {
+	handler := zone(hosts)
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			atomic.AddInt32(tcpQueries, 1)
+			handler(w, req)
+			return
+		}
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		handler(&truncatingWriter{w, size}, req)
+	}
+}
+
+// txtRR returns TXT record of name with text split into strings of 255
+// bytes.
+func txtRR(name, text string) string {
+	var s []string
+	for len(text) > 255 {
+		s = append(s, text[:255])
+		text = text[255:]
+	}
+	s = append(s, text)
+	return fmt.Sprintf(`%s 0 IN TXT "%s"`, name, strings.Join(s, `" "`))
+}
+
+func TestMiekgDNSResolverTruncated(t *testing.T) {
+	var ips []string
+	for i := 0; i < 120; i++ {
+		ips = append(ips, fmt.Sprintf("ip4:10.0.%d.%d", i/10, i%10))
+	}
+	large := "v=spf1 " + strings.Join(ips, " ") + " -all" // ~2000 bytes
+	medium := "v=spf1 " + strings.Join(ips[:40], " ") + " -all"
+	small := "v=spf1 ip4:10.0.0.1 -all"
+
+	var tcpQueries int32
+	dns.HandleFunc("truncated.test.", truncatingZone(map[uint16][]string{
+		dns.TypeTXT: {
+			txtRR("large.truncated.test.", large),
+			txtRR("medium.truncated.test.", medium),
+			txtRR("small.truncated.test.", small),
+		},
+	}, &tcpQueries))
+	defer dns.HandleRemove("truncated.test.")
+
+	addr := testResolver.(*MiekgDNSResolver).servers[0]
+	tests := []struct {
+		opts []ResolverOption
+		name string
+		txt  string
+		tcp  int32
+	}{
+		{nil, "large.truncated.test.", large, 1},
+		{nil, "medium.truncated.test.", medium, 0},
+		{nil, "small.truncated.test.", small, 0},
+		{[]ResolverOption{WithUDPBufferSize(4096)}, "large.truncated.test.", large, 0},
+		{[]ResolverOption{WithUDPBufferSize(0)}, "medium.truncated.test.", medium, 1},
+		{[]ResolverOption{WithUDPBufferSize(0)}, "small.truncated.test.", small, 0},
+	}
+	for _, test := range tests {
+		r, err := NewMiekgDNSResolver(addr, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&tcpQueries, 0)
+		txts, err := r.LookupTXTStrict(test.name)
+		if err != nil || len(txts) != 1 || txts[0] != test.txt {
+			t.Errorf("%s: unexpected answer: %q, %v", test.name, txts, err)
+		}
+		if q := atomic.LoadInt32(&tcpQueries); q != test.tcp {
+			t.Errorf("%s: expected %d TCP queries, got %d", test.name, test.tcp, q)
+		}
+	}
+
+	res, _, err := CheckHost(net.IP{10, 0, 11, 9}, "large.truncated.test", "", WithResolver(testResolver))
+	if res != Pass || err != nil {
+		t.Errorf("expected Pass, got %v, %v", res, err)
+	}
+}
+
+// countingServer runs a local server answering all queries with rcode and
+// returns its address.
+func countingServer(t *testing.T, queries *int32, rcode int) (string, func()) {
+	s, err := runLocalUDPServer("127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		if rcode == dns.RcodeSuccess {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 0 IN A 10.0.0.1")
+			m.Answer = []dns.RR{rr}
+		}
+		_ = w.WriteMsg(m)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.PacketConn.LocalAddr().String(), func() { _ = s.Shutdown() }
+}
+
+func TestMiekgDNSResolverFailover(t *testing.T) {
+	var failing, good int32
+	failingAddr, stop := countingServer(t, &failing, dns.RcodeServerFailure)
+	defer stop()
+	goodAddr, stop := countingServer(t, &good, dns.RcodeSuccess)
+	defer stop()
+
+	// a server which never responds
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	silentAddr := pc.LocalAddr().String()
+
+	r, err := NewMiekgDNSResolverWithServers([]string{silentAddr, failingAddr, goodAddr}, WithQueryTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if ok, err := r.Exists("failover.test."); !ok || err != nil {
+			t.Fatalf("expected match, got %v, %v", ok, err)
+		}
+	}
+	// the failing servers are skipped once they failed
+	if f, g := atomic.LoadInt32(&failing), atomic.LoadInt32(&good); f != 1 || g != 3 {
+		t.Errorf("expected 1 and 3 queries, got %d and %d", f, g)
+	}
+}
+
+func TestMiekgDNSResolverRetries(t *testing.T) {
+	var queries int32
+	addr1, stop := countingServer(t, &queries, dns.RcodeServerFailure)
+	defer stop()
+	addr2, stop := countingServer(t, &queries, dns.RcodeRefused)
+	defer stop()
+
+	r, err := NewMiekgDNSResolverWithServers([]string{addr1, addr2}, WithRetries(2, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := r.LookupTXT("retries.test."); err != ErrDNSTemperror {
+		t.Errorf("expected %v, got %v", ErrDNSTemperror, err)
+	}
+	if q := atomic.LoadInt32(&queries); q != 6 {
+		t.Errorf("expected 6 queries, got %d", q)
+	}
+	// backoff of 20ms and 40ms
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("expected backoff, took %v", elapsed)
+	}
+
+	// the backoff is interrupted by the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.(*MiekgDNSResolver).LookupTXTContext(ctx, "retries.test."); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if _, err := NewMiekgDNSResolverWithServers(nil); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := NewMiekgDNSResolverWithServers([]string{addr1, "127.0.0.1"}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestMiekgDNSResolverClientTimeout(t *testing.T) {
+	res, err := NewMiekgDNSResolver("127.0.0.1:53", WithQueryTimeout(0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := res.(*MiekgDNSResolver)
+	// zero timeout of the dialer would disable it
+	if c := r.clientFor(context.Background()); c.Dialer.Timeout != DefaultQueryTimeout {
+		t.Errorf("want %v, got %v", DefaultQueryTimeout, c.Dialer.Timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if c := r.clientFor(ctx); c.Dialer.Timeout <= DefaultQueryTimeout || c.Dialer.Timeout > time.Minute {
+		t.Errorf("want timeout of the context, got %v", c.Dialer.Timeout)
+	}
+}
+
+func TestNewMiekgDNSResolverFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("# test\nnameserver 192.0.2.1\nnameserver 2001:db8::1\noptions timeout:1 attempts:3\n")
+	_ = f.Close()
+
+	r, err := NewMiekgDNSResolverFromFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := r.(*MiekgDNSResolver)
+	if expected := []string{"192.0.2.1:53", "[2001:db8::1]:53"}; !reflect.DeepEqual(m.servers, expected) {
+		t.Errorf("expected %q, got %q", expected, m.servers)
+	}
+	if m.timeout != time.Second || m.retries != 2 {
+		t.Errorf("unexpected timeout %v and retries %d", m.timeout, m.retries)
+	}
+
+	r, _ = NewMiekgDNSResolverFromFile(f.Name(), WithQueryTimeout(time.Minute))
+	if m := r.(*MiekgDNSResolver); m.timeout != time.Minute {
+		t.Errorf("unexpected timeout %v", m.timeout)
+	}
+
+	if _, err := NewMiekgDNSResolverFromFile(f.Name() + ".missing"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,223 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Answer is the answer to a single DNS query.
+type Answer struct {
+	// Values of the answer records of the queried type: joined strings of
+	// TXT records, addresses of A and AAAA records and names of MX and PTR
+	// records.
+	Values []string
+	// TTL is the time the answer may be cached for, that is the minimal TTL
+	// of the answer records. For negative answers it's the minimum of TTL
+	// of SOA record and its MINIMUM field, see RFC 2308, section 5. It's
+	// zero if the answer must not be cached.
+	TTL time.Duration
+	// NameError is true for "Name Error" (RCODE 3) answers
+	NameError bool
+}
+
+// copy returns a copy of a, which doesn't share Values with a, so the
+// copies handed out to the callers can be modified independently.
+func (a *Answer) copy() *Answer {
+	c := *a
+	c.Values = append([]string(nil), a.Values...)
+	return &c
+}
+
+// QueryResolver is implemented by resolvers, which expose answers of the
+// DNS queries along with their TTLs, e.g. by MiekgDNSResolver.
+// Queries of types dns.TypeTXT, dns.TypeA, dns.TypeAAAA, dns.TypeMX and
+// dns.TypePTR are used.
+type QueryResolver interface {
+	// QueryContext returns the answer to the query of qtype records of
+	// name. Errors (RCODE other than 0 or 3) are returned as
+	// ErrDNSTemperror.
+	QueryContext(ctx context.Context, name string, qtype uint16) (*Answer, error)
+}
+
+// newAnswer returns Answer of the DNS response res.
+func newAnswer(res *dns.Msg, qtype uint16) *Answer {
+	a := &Answer{NameError: res.Rcode == dns.RcodeNameError}
+	ttl := uint32(0)
+	for i, rr := range res.Answer {
+		if h := rr.Header(); i == 0 || h.Ttl < ttl {
+			ttl = h.Ttl
+		}
+		if rr.Header().Rrtype != qtype {
+			continue // e.g. CNAME
+		}
+		switch rr := rr.(type) {
+		case *dns.TXT:
+			a.Values = append(a.Values, strings.Join(rr.Txt, ""))
+		case *dns.A:
+			a.Values = append(a.Values, rr.A.String())
+		case *dns.AAAA:
+			a.Values = append(a.Values, rr.AAAA.String())
+		case *dns.MX:
+			a.Values = append(a.Values, rr.Mx)
+		case *dns.PTR:
+			a.Values = append(a.Values, rr.Ptr)
+		}
+	}
+	if len(a.Values) == 0 {
+		// RFC 2308, section 5:
+		// Like normal answers negative answers have a time to live (TTL).
+		// [...] The TTL of this record is set from the minimum of the
+		// MINIMUM field of the SOA record and the TTL of the SOA itself.
+		ttl = 0
+		for _, rr := range res.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+			}
+		}
+	}
+	a.TTL = time.Duration(ttl) * time.Second
+	return a
+}
+
+// queryResolver implements ResolverContext on top of QueryResolver.
+type queryResolver struct {
+	resolver QueryResolver
+}
+
+// LookupTXTContext returns the DNS TXT records for the given domain name.
+func (r queryResolver) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	a, err := r.resolver.QueryContext(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	return a.Values, nil
+}
+
+// LookupTXTStrictContext returns DNS TXT records for the given name, however
+// it will return ErrDNSPermerror upon NXDOMAIN (RCODE 3)
+func (r queryResolver) LookupTXTStrictContext(ctx context.Context, name string) ([]string, error) {
+	a, err := r.resolver.QueryContext(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	if a.NameError {
+		return nil, ErrDNSPermerror
+	}
+	return a.Values, nil
+}
+
+// ExistsContext is used for a DNS A RR lookup (even when the
+// connection type is IPv6).  If any A record is returned, this
+// mechanism matches.
+func (r queryResolver) ExistsContext(ctx context.Context, name string) (bool, error) {
+	a, err := r.resolver.QueryContext(ctx, name, dns.TypeA)
+	if err != nil {
+		return false, err
+	}
+	return len(a.Values) > 0, nil
+}
+
+// MatchIPContext provides an address lookup, which should be done on the
+// name using the type of lookup (A or AAAA).
+// Then IPMatcherFunc used to compare checked IP to the returned address(es).
+// If any address matches, the mechanism matches
+func (r queryResolver) MatchIPContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	var wg sync.WaitGroup
+	qTypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	hits := make(chan hit, len(qTypes))
+
+	for _, qType := range qTypes {
+		wg.Add(1)
+		go func(qType uint16) {
+			defer wg.Done()
+
+			a, err := r.resolver.QueryContext(ctx, name, qType)
+			if err != nil {
+				hits <- hit{false, err}
+				return
+			}
+			for _, v := range a.Values {
+				ip := net.ParseIP(v)
+				if qType == dns.TypeA {
+					ip = ip.To4()
+				}
+				if m, e := matcher(ip); m || e != nil {
+					hits <- hit{m, e}
+					return
+				}
+			}
+		}(qType)
+	}
+
+	go func() {
+		wg.Wait()
+		close(hits)
+	}()
+
+	for h := range hits {
+		if h.found || h.err != nil {
+			return h.found, h.err
+		}
+	}
+
+	return false, nil
+}
+
+// MatchMXContext is similar to MatchIPContext but first performs an MX lookup
+// on the name.  Then it performs an address lookup on each MX name returned.
+// Then IPMatcherFunc used to compare checked IP to the returned address(es).
+// If any address matches, the mechanism matches
+func (r queryResolver) MatchMXContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	a, err := r.resolver.QueryContext(ctx, name, dns.TypeMX)
+	if err != nil {
+		return false, err
+	}
+
+	var wg sync.WaitGroup
+	hits := make(chan hit, len(a.Values))
+
+	for _, mx := range a.Values {
+		wg.Add(1)
+		go func(name string) {
+			found, err := r.MatchIPContext(ctx, name, matcher)
+			hits <- hit{found, err}
+			wg.Done()
+		}(mx)
+	}
+
+	go func() {
+		wg.Wait()
+		close(hits)
+	}()
+
+	for h := range hits {
+		if h.found || h.err != nil {
+			return h.found, h.err
+		}
+	}
+
+	return false, nil
+}
+
+// LookupPTRContext performs a reverse lookup of the given IP address and
+// returns names which resolve back to the address.
+func (r queryResolver) LookupPTRContext(ctx context.Context, ip net.IP) ([]string, error) {
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, ErrDNSPermerror
+	}
+
+	a, err := r.resolver.QueryContext(ctx, name, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	return validatePTR(ctx, r, ip, a.Values), nil
+}
@@ -0,0 +1,174 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// SingleflightResolver wraps a QueryResolver and collapses identical
+// concurrent queries, that is queries of the same name and type, into a
+// single query of the wrapped resolver. Each of the callers waiting for the
+// answer gets its own copy.
+//
+// It only deduplicates the queries in flight, see CachingResolver for
+// caching of the answers. As each call is still made by the caller, the
+// lookup limits of the evaluations sharing the resolver are accounted
+// separately.
+//
+// SingleflightResolver implements Resolver, ResolverContext and
+// QueryResolver and is safe for concurrent use.
+type SingleflightResolver struct {
+	resolver QueryResolver
+
+	mu      sync.Mutex
+	flights map[cacheKey]*flight
+}
+
+// flight is a query in progress.
+type flight struct {
+	done   chan struct{}
+	answer *Answer
+	err    error
+}
+
+// result returns the answer of the query. Each caller gets its own copy, so
+// modifying it doesn't affect the others.
+func (f *flight) result() (*Answer, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.answer.copy(), nil
+}
+
+// NewSingleflightResolver returns a resolver, which deduplicates concurrent
+// queries of r.
+func NewSingleflightResolver(r QueryResolver) *SingleflightResolver {
+	return &SingleflightResolver{
+		resolver: r,
+		flights:  make(map[cacheKey]*flight),
+	}
+}
+
+// QueryContext passes the query to the wrapped resolver, unless the same
+// query is already in flight, in which case it waits for its answer.
+//
+// The query is made with the context of the first caller. If it's canceled,
+// the callers waiting for the answer with their contexts still alive, make
+// the query again.
+func (r *SingleflightResolver) QueryContext(ctx context.Context, name string, qtype uint16) (*Answer, error) {
+	key := cacheKey{strings.ToLower(name), qtype}
+	for {
+		r.mu.Lock()
+		f, ok := r.flights[key]
+		if !ok {
+			// waiters get ErrDNSTemperror if the query panics
+			f = &flight{done: make(chan struct{}), err: ErrDNSTemperror}
+			r.flights[key] = f
+			r.mu.Unlock()
+			return r.lead(ctx, key, f, name, qtype)
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-f.done:
+		}
+		if (f.err == context.Canceled || f.err == context.DeadlineExceeded) && ctx.Err() == nil {
+			continue
+		}
+		return f.result()
+	}
+}
+
+// lead queries the wrapped resolver on behalf of the waiters of f. The flight
+// is ended even if the query panics, so the later queries don't wait for it
+// forever.
+func (r *SingleflightResolver) lead(ctx context.Context, key cacheKey, f *flight, name string, qtype uint16) (*Answer, error) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.flights, key)
+		r.mu.Unlock()
+		close(f.done)
+	}()
+	f.answer, f.err = r.resolver.QueryContext(ctx, name, qtype)
+	return f.result()
+}
+
+// LookupTXT returns the DNS TXT records for the given domain name.
+func (r *SingleflightResolver) LookupTXT(name string) ([]string, error) {
+	return r.LookupTXTContext(context.Background(), name)
+}
+
+// LookupTXTContext is LookupTXT, which uses provided context for the
+// underlying DNS query.
+func (r *SingleflightResolver) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	return queryResolver{r}.LookupTXTContext(ctx, name)
+}
+
+// LookupTXTStrict returns DNS TXT records for the given name, however it
+// will return ErrDNSPermerror upon NXDOMAIN (RCODE 3)
+func (r *SingleflightResolver) LookupTXTStrict(name string) ([]string, error) {
+	return r.LookupTXTStrictContext(context.Background(), name)
+}
+
+// LookupTXTStrictContext is LookupTXTStrict, which uses provided context for the
+// underlying DNS query.
+func (r *SingleflightResolver) LookupTXTStrictContext(ctx context.Context, name string) ([]string, error) {
+	return queryResolver{r}.LookupTXTStrictContext(ctx, name)
+}
+
+// Exists is used for a DNS A RR lookup (even when the
+// connection type is IPv6).  If any A record is returned, this
+// mechanism matches.
+func (r *SingleflightResolver) Exists(name string) (bool, error) {
+	return r.ExistsContext(context.Background(), name)
+}
+
+// ExistsContext is Exists, which uses provided context for the underlying
+// DNS query.
+func (r *SingleflightResolver) ExistsContext(ctx context.Context, name string) (bool, error) {
+	return queryResolver{r}.ExistsContext(ctx, name)
+}
+
+// MatchIP provides an address lookup, which should be done on the name
+// using the type of lookup (A or AAAA).
+// Then IPMatcherFunc used to compare checked IP to the returned address(es).
+// If any address matches, the mechanism matches
+func (r *SingleflightResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, error) {
+	return r.MatchIPContext(context.Background(), name, matcher)
+}
+
+// MatchIPContext is MatchIP, which uses provided context for the underlying
+// DNS queries.
+func (r *SingleflightResolver) MatchIPContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	return queryResolver{r}.MatchIPContext(ctx, name, matcher)
+}
+
+// MatchMX is similar to MatchIP but first performs an MX lookup on the
+// name.  Then it performs an address lookup on each MX name returned.
+// Then IPMatcherFunc used to compare checked IP to the returned address(es).
+// If any address matches, the mechanism matches
+func (r *SingleflightResolver) MatchMX(name string, matcher IPMatcherFunc) (bool, error) {
+	return r.MatchMXContext(context.Background(), name, matcher)
+}
+
+// MatchMXContext is MatchMX, which uses provided context for the underlying
+// DNS queries.
+func (r *SingleflightResolver) MatchMXContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	return queryResolver{r}.MatchMXContext(ctx, name, matcher)
+}
+
+// LookupPTR performs a reverse lookup of the given IP address and returns
+// names which resolve back to the address.
+func (r *SingleflightResolver) LookupPTR(ip net.IP) ([]string, error) {
+	return r.LookupPTRContext(context.Background(), ip)
+}
+
+// LookupPTRContext is LookupPTR, which uses provided context for the
+// underlying DNS queries.
+func (r *SingleflightResolver) LookupPTRContext(ctx context.Context, ip net.IP) ([]string, error) {
+	return queryResolver{r}.LookupPTRContext(ctx, ip)
+}
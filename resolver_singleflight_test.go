@@ -0,0 +1,215 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// blockingResolver answers queries once release is closed.
+type blockingResolver struct {
+	queries int32
+	release chan struct{}
+}
+
+func (r *blockingResolver) QueryContext(ctx context.Context, name string, qtype uint16) (*Answer, error) {
+	atomic.AddInt32(&r.queries, 1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.release:
+		return &Answer{Values: []string{"10.0.0.1"}}, nil
+	}
+}
+
+// waitFor waits until cond is true.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+// inFlight reports whether the query of name is in flight.
+func inFlight(r *SingleflightResolver, name string, qtype uint16) func() bool {
+	return func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		_, ok := r.flights[cacheKey{name, qtype}]
+		return ok
+	}
+}
+
+func TestSingleflightResolver(t *testing.T) {
+	b := &blockingResolver{release: make(chan struct{})}
+	r := NewSingleflightResolver(b)
+
+	const n = 10
+	var (
+		wg      sync.WaitGroup
+		started int32
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			atomic.AddInt32(&started, 1)
+			if ok, err := r.Exists("sf.test."); !ok || err != nil {
+				t.Errorf("expected match, got %v, %v", ok, err)
+			}
+		}()
+	}
+	if !waitFor(func() bool { return atomic.LoadInt32(&started) == n }) || !waitFor(inFlight(r, "sf.test.", dns.TypeA)) {
+		t.Fatal("timeout waiting for the query")
+	}
+	// let the callers reach the flight
+	time.Sleep(20 * time.Millisecond)
+	close(b.release)
+	wg.Wait()
+
+	if q := atomic.LoadInt32(&b.queries); q != 1 {
+		t.Errorf("expected 1 query, got %d", q)
+	}
+	if len(r.flights) != 0 {
+		t.Errorf("unexpected flights left: %v", r.flights)
+	}
+}
+
+func TestSingleflightResolverCanceled(t *testing.T) {
+	b := &blockingResolver{release: make(chan struct{})}
+	r := NewSingleflightResolver(b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.QueryContext(ctx, "sf.test.", dns.TypeA)
+		errs <- err
+	}()
+	if !waitFor(inFlight(r, "sf.test.", dns.TypeA)) {
+		t.Fatal("timeout waiting for the query")
+	}
+	done := make(chan *Answer, 1)
+	go func() {
+		a, err := r.QueryContext(context.Background(), "sf.test.", dns.TypeA)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		done <- a
+	}()
+	// let the caller wait for the answer
+	time.Sleep(20 * time.Millisecond)
+
+	// the first caller gives up, the waiting one queries again
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	close(b.release)
+	if a := <-done; a == nil || len(a.Values) != 1 {
+		t.Errorf("unexpected answer: %+v", a)
+	}
+	if q := atomic.LoadInt32(&b.queries); q != 2 {
+		t.Errorf("expected 2 queries, got %d", q)
+	}
+}
+
+func TestSingleflightResolverCopies(t *testing.T) {
+	b := &blockingResolver{release: make(chan struct{})}
+	r := NewSingleflightResolver(b)
+
+	answers := make(chan *Answer, 2)
+	for i := 0; i < cap(answers); i++ {
+		go func() {
+			a, _ := r.QueryContext(context.Background(), "sf.test.", dns.TypeA)
+			answers <- a
+		}()
+	}
+	if !waitFor(inFlight(r, "sf.test.", dns.TypeA)) {
+		t.Fatal("timeout waiting for the query")
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(b.release)
+
+	a1, a2 := <-answers, <-answers
+	if a1 == nil || a2 == nil {
+		t.Fatalf("unexpected answers: %+v, %+v", a1, a2)
+	}
+	a1.Values[0] = "modified"
+	if a2.Values[0] != "10.0.0.1" {
+		t.Errorf("answers share values: %q", a2.Values)
+	}
+}
+
+// panickingResolver panics on the first query.
+type panickingResolver struct {
+	queries int32
+}
+
+func (r *panickingResolver) QueryContext(ctx context.Context, name string, qtype uint16) (*Answer, error) {
+	if atomic.AddInt32(&r.queries, 1) == 1 {
+		panic("query failed")
+	}
+	return &Answer{Values: []string{"10.0.0.1"}}, nil
+}
+
+func TestSingleflightResolverPanic(t *testing.T) {
+	r := NewSingleflightResolver(&panickingResolver{})
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic")
+			}
+		}()
+		_, _ = r.QueryContext(context.Background(), "sf.test.", dns.TypeA)
+	}()
+
+	// the query is not in flight anymore
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if a, err := r.QueryContext(ctx, "sf.test.", dns.TypeA); err != nil || len(a.Values) != 1 {
+		t.Errorf("unexpected answer: %+v, %v", a, err)
+	}
+}
+
+func TestSingleflightResolverLimits(t *testing.T) {
+	dns.HandleFunc("sf.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`sf.test. 0 IN TXT "v=spf1 a:a1.sf.test a:a2.sf.test a:a3.sf.test -all"`,
+		},
+		dns.TypeA: {
+			"a1.sf.test. 0 IN A 10.0.0.1",
+			"a2.sf.test. 0 IN A 10.0.0.2",
+			"a3.sf.test. 0 IN A 10.0.0.3",
+		},
+	}))
+	defer dns.HandleRemove("sf.test.")
+
+	r := NewSingleflightResolver(testResolver.(QueryResolver))
+	limited := NewChecker(WithResolver(r), WithLookupLimit(2))
+	unlimited := NewChecker(WithResolver(r))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, expected := unlimited, Pass
+			if i%2 == 0 {
+				c, expected = limited, Permerror
+			}
+			if res, _, _ := c.CheckHost(net.IP{10, 0, 0, 3}, "sf.test", ""); res != expected {
+				t.Errorf("expected %v, got %v", expected, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
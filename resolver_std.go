@@ -1,6 +1,7 @@
 package spf
 
 import (
+	"context"
 	"net"
 	"sync"
 )
@@ -34,7 +35,13 @@ func errDNS(e error) error {
 // LookupTXTStrict returns DNS TXT records for the given name, however it
 // will return ErrDNSPermerror upon NXDOMAIN (RCODE 3)
 func (r *DNSResolver) LookupTXTStrict(name string) ([]string, error) {
-	txts, err := net.LookupTXT(name)
+	return r.LookupTXTStrictContext(context.Background(), name)
+}
+
+// LookupTXTStrictContext is LookupTXTStrict, which uses provided context
+// for the underlying DNS lookup.
+func (r *DNSResolver) LookupTXTStrictContext(ctx context.Context, name string) ([]string, error) {
+	txts, err := net.DefaultResolver.LookupTXT(ctx, name)
 
 	if dnsErr, ok := err.(*net.DNSError); ok {
 		// That is the most reliable way I found to detect Permerror
@@ -62,7 +69,13 @@ func (r *DNSResolver) LookupTXTStrict(name string) ([]string, error) {
 
 // LookupTXT returns the DNS TXT records for the given domain name.
 func (r *DNSResolver) LookupTXT(name string) ([]string, error) {
-	txts, err := net.LookupTXT(name)
+	return r.LookupTXTContext(context.Background(), name)
+}
+
+// LookupTXTContext is LookupTXT, which uses provided context for the
+// underlying DNS lookup.
+func (r *DNSResolver) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	txts, err := net.DefaultResolver.LookupTXT(ctx, name)
 	err = errDNS(err)
 	if err != nil {
 		return nil, err
@@ -74,7 +87,13 @@ func (r *DNSResolver) LookupTXT(name string) ([]string, error) {
 // connection type is IPv6).  If any A record is returned, this
 // mechanism matches.
 func (r *DNSResolver) Exists(name string) (bool, error) {
-	ips, err := net.LookupIP(name)
+	return r.ExistsContext(context.Background(), name)
+}
+
+// ExistsContext is Exists, which uses provided context for the underlying
+// DNS lookup.
+func (r *DNSResolver) ExistsContext(ctx context.Context, name string) (bool, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
 	err = errDNS(err)
 	if err != nil {
 		return false, err
@@ -92,13 +111,19 @@ type hit struct {
 // Then IPMatcherFunc used to compare checked IP to the returned address(es).
 // If any address matches, the mechanism matches
 func (r *DNSResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, error) {
-	ips, err := net.LookupIP(name)
+	return r.MatchIPContext(context.Background(), name, matcher)
+}
+
+// MatchIPContext is MatchIP, which uses provided context for the underlying
+// DNS lookup.
+func (r *DNSResolver) MatchIPContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
 	err = errDNS(err)
 	if err != nil {
 		return false, err
 	}
 	for _, ip := range ips {
-		if m, e := matcher(ip); m || e != nil {
+		if m, e := matcher(ip.IP); m || e != nil {
 			return m, e
 		}
 	}
@@ -110,7 +135,13 @@ func (r *DNSResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, error)
 // Then IPMatcherFunc used to compare checked IP to the returned address(es).
 // If any address matches, the mechanism matches
 func (r *DNSResolver) MatchMX(name string, matcher IPMatcherFunc) (bool, error) {
-	mxs, err := net.LookupMX(name)
+	return r.MatchMXContext(context.Background(), name, matcher)
+}
+
+// MatchMXContext is MatchMX, which uses provided context for the underlying
+// DNS lookups.
+func (r *DNSResolver) MatchMXContext(ctx context.Context, name string, matcher IPMatcherFunc) (bool, error) {
+	mxs, err := net.DefaultResolver.LookupMX(ctx, name)
 	err = errDNS(err)
 	if err != nil {
 		return false, err
@@ -122,7 +153,7 @@ func (r *DNSResolver) MatchMX(name string, matcher IPMatcherFunc) (bool, error)
 	for _, mx := range mxs {
 		wg.Add(1)
 		go func(name string) {
-			found, err := r.MatchIP(name, matcher)
+			found, err := r.MatchIPContext(ctx, name, matcher)
 			hits <- hit{found, err}
 			wg.Done()
 		}(mx.Host)
@@ -141,3 +172,51 @@ func (r *DNSResolver) MatchMX(name string, matcher IPMatcherFunc) (bool, error)
 
 	return false, nil
 }
+
+// LookupPTR performs a reverse lookup of the given IP address and returns
+// names which resolve back to the address.
+// If the DNS lookup returns an error, the error is passed back to the caller
+// which, as per RFC 7208, section 5.5, makes the "ptr" mechanism fail to match.
+func (r *DNSResolver) LookupPTR(ip net.IP) ([]string, error) {
+	return r.LookupPTRContext(context.Background(), ip)
+}
+
+// LookupPTRContext is LookupPTR, which uses provided context for the
+// underlying DNS lookups.
+func (r *DNSResolver) LookupPTRContext(ctx context.Context, ip net.IP) ([]string, error) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	err = errDNS(err)
+	if err != nil {
+		return nil, err
+	}
+	return validatePTR(ctx, r, ip, names), nil
+}
+
+// ptrNamesLimit is the maximum number of names returned by the PTR lookup
+// that are validated.
+// From RFC 7208, section 4.6.4:
+// the evaluation of each "PTR" record MUST NOT result in querying more than
+// 10 address records -- either "A" or "AAAA" resource records.  If this
+// limit is exceeded, all records other than the first 10 MUST be ignored.
+const ptrNamesLimit = 10
+
+// validatePTR returns names (up to ptrNamesLimit) with an address lookup
+// matching ip. As per RFC 7208, section 5.5, if a DNS error occurs while
+// doing an address lookup, then that domain name is skipped and the search
+// continues.
+func validatePTR(ctx context.Context, r ResolverContext, ip net.IP, names []string) []string {
+	if len(names) > ptrNamesLimit {
+		names = names[:ptrNamesLimit]
+	}
+	validated := make([]string, 0, len(names))
+	for _, name := range names {
+		found, err := r.MatchIPContext(ctx, NormalizeFQDN(name), func(addr net.IP) (bool, error) {
+			return addr.Equal(ip), nil
+		})
+		if err != nil || !found {
+			continue
+		}
+		validated = append(validated, name)
+	}
+	return validated
+}
@@ -0,0 +1,28 @@
+package spf
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// NewDoTResolver returns new instance of Resolver, which sends the queries
+// over TLS (DNS over TLS, RFC 7858) to the servers at addrs, usually at port
+// 853. The certificates of the servers are verified using config, e.g. its
+// ServerName and RootCAs; nil config uses the defaults of crypto/tls.
+//
+// Apart from the transport the resolver works like the one returned by
+// NewMiekgDNSResolverWithServers.
+func NewDoTResolver(addrs []string, config *tls.Config, opts ...ResolverOption) (Resolver, error) {
+	if len(addrs) == 0 {
+		return nil, errNoServers
+	}
+	for _, addr := range addrs {
+		if _, _, e := net.SplitHostPort(addr); e != nil {
+			return nil, e
+		}
+	}
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: config}
+	return newMiekgDNSResolver(client, addrs, opts), nil
+}
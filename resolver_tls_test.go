@@ -0,0 +1,140 @@
+package spf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// selfSignedCert returns a self-signed certificate for 127.0.0.1 and the pool
+// trusting it.
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// runLocalTLSServer runs a DNS over TLS server, which serves queries with the
+// handlers registered by dns.HandleFunc.
+func runLocalTLSServer(laddr string, config *tls.Config) (*dns.Server, error) {
+	l, err := tls.Listen("tcp", laddr, config)
+	if err != nil {
+		return nil, err
+	}
+	server := &dns.Server{Listener: l, ReadTimeout: time.Second, WriteTimeout: time.Second}
+
+	waitLock := sync.Mutex{}
+	waitLock.Lock()
+	server.NotifyStartedFunc = waitLock.Unlock
+
+	go func() {
+		_ = server.ActivateAndServe()
+		_ = l.Close()
+	}()
+
+	waitLock.Lock()
+	return server, nil
+}
+
+// encryptedZone registers the zone used by the tests of DoT and DoH
+// resolvers and returns the function removing it.
+func encryptedZone(name string) func() {
+	dns.HandleFunc(name, zone(map[uint16][]string{
+		dns.TypeTXT: {
+			name + ` 0 IN TXT "v=spf1 a -all"`,
+		},
+		dns.TypeA: {
+			name + " 0 IN A 10.0.0.1",
+		},
+	}))
+	dns.HandleFunc("servfail."+name, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		_ = w.WriteMsg(m)
+	})
+	return func() {
+		dns.HandleRemove(name)
+		dns.HandleRemove("servfail." + name)
+	}
+}
+
+// testEncryptedResolver tests the RCODE mapping and the evaluation using r,
+// which uses the zone registered by encryptedZone.
+func testEncryptedResolver(t *testing.T, r Resolver, name string) {
+	res, _, err := CheckHost(net.IP{10, 0, 0, 1}, name, "", WithResolver(r))
+	if res != Pass || err != nil {
+		t.Errorf("expected Pass, got %v, %v", res, err)
+	}
+	if _, err := r.LookupTXTStrict("nxdomain."); err != ErrDNSPermerror {
+		t.Errorf("expected %v, got %v", ErrDNSPermerror, err)
+	}
+	if txts, err := r.LookupTXT("nxdomain."); len(txts) != 0 || err != nil {
+		t.Errorf("unexpected answer: %q, %v", txts, err)
+	}
+	if _, err := r.LookupTXT("servfail." + name); err != ErrDNSTemperror {
+		t.Errorf("expected %v, got %v", ErrDNSTemperror, err)
+	}
+}
+
+func TestDoTResolver(t *testing.T) {
+	defer encryptedZone("dot.test.")()
+
+	cert, pool := selfSignedCert(t)
+	s, err := runLocalTLSServer("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Shutdown() }()
+	addr := s.Listener.Addr().String()
+
+	r, err := NewDoTResolver([]string{addr}, &tls.Config{RootCAs: pool}, WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEncryptedResolver(t, r, "dot.test.")
+
+	// the certificate is not trusted
+	r, _ = NewDoTResolver([]string{addr}, nil, WithRetries(0, 0))
+	if _, err := r.LookupTXT("dot.test."); err != ErrDNSTemperror {
+		t.Errorf("expected %v, got %v", ErrDNSTemperror, err)
+	}
+
+	for _, addrs := range [][]string{nil, {"127.0.0.1"}} {
+		if _, err := NewDoTResolver(addrs, nil); err == nil {
+			t.Errorf("%q: expected error", addrs)
+		}
+	}
+}
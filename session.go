@@ -0,0 +1,68 @@
+package spf
+
+import (
+	"context"
+	"net"
+)
+
+// SessionResult keeps results of both identities of an SMTP session, see
+// CheckSession.
+type SessionResult struct {
+	// HELO is the result of the HELO identity check. It's None if the HELO
+	// identity is an address literal or not a fully qualified domain name.
+	HELO    *Evaluation
+	HELOErr error
+
+	// Sender is the MAIL FROM identity, "postmaster@<helo>" for the null
+	// reverse-path. It's empty for the null reverse-path if the HELO
+	// identity is not a valid domain name.
+	Sender string
+	// MailFrom is the result of the MAIL FROM identity check. For the null
+	// reverse-path it's the same as HELO.
+	MailFrom    *Evaluation
+	MailFromErr error
+}
+
+// CheckSession checks both HELO and MAIL FROM identities of an SMTP session
+// as described in RFC 7208, section 2.4. mailFrom is the reverse-path as
+// received in the MAIL FROM command, e.g. "<user@example.com>" or "<>".
+//
+// The HELO identity is checked first. When the reverse-path is null, which is
+// the case of bounces, the MAIL FROM identity is "postmaster@<helo>" and its
+// result is the result of the HELO check.
+func CheckSession(ip net.IP, helo, mailFrom string, opts ...Option) *SessionResult {
+	return NewChecker(opts...).CheckSession(ip, helo, mailFrom)
+}
+
+// CheckSession checks both HELO and MAIL FROM identities of an SMTP session,
+// see CheckSession function for the details.
+func (c *Checker) CheckSession(ip net.IP, helo, mailFrom string) *SessionResult {
+	return c.CheckSessionContext(context.Background(), ip, helo, mailFrom)
+}
+
+// CheckSessionContext is CheckSession, which stops the evaluation with
+// Temperror results once ctx is done.
+func (c *Checker) CheckSessionContext(ctx context.Context, ip net.IP, helo, mailFrom string) *SessionResult {
+	s := &SessionResult{}
+
+	// sender is empty if helo is invalid
+	domain, sender, err := heloIdentity(helo)
+	if err != nil {
+		s.HELO, s.HELOErr = &Evaluation{Result: None, Domain: helo}, err
+	} else {
+		s.HELO, s.HELOErr = c.evaluate(ctx, ip, domain, sender, domain)
+	}
+
+	path, err := ParseReversePath(mailFrom)
+	switch {
+	case err != nil:
+		s.MailFrom, s.MailFromErr = &Evaluation{Result: None}, err
+	case path.IsNull():
+		s.Sender = sender
+		s.MailFrom, s.MailFromErr = s.HELO, s.HELOErr
+	default:
+		s.Sender = path.String()
+		s.MailFrom, s.MailFromErr = c.evaluate(ctx, ip, path.Domain, s.Sender, nonemptyString(domain, helo))
+	}
+	return s
+}
@@ -0,0 +1,66 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckSession(t *testing.T) {
+	dns.HandleFunc("session.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`mx.session.test. 0 IN TXT "v=spf1 ip4:10.0.0.1 -all"`,
+			`sender.session.test. 0 IN TXT "v=spf1 exists:%{h}.allowed.session.test -all"`,
+		},
+		dns.TypeA: {
+			"mx.session.test.allowed.session.test. 0 IN A 127.0.0.2",
+		},
+	}))
+	defer dns.HandleRemove("session.test.")
+
+	samples := []struct {
+		ip             net.IP
+		helo           string
+		mailFrom       string
+		heloResult     Result
+		sender         string
+		mailFromResult Result
+		err            error
+	}{
+		{net.IP{10, 0, 0, 1}, "mx.session.test", "<user@sender.session.test>",
+			Pass, "user@sender.session.test", Pass, nil},
+		{net.IP{10, 0, 0, 2}, "mx.session.test", "<user@sender.session.test>",
+			Fail, "user@sender.session.test", Pass, nil},
+		{net.IP{10, 0, 0, 1}, "other.session.test", "<user@sender.session.test>",
+			None, "user@sender.session.test", Fail, nil},
+		{net.IP{10, 0, 0, 1}, "mx.session.test", "<>",
+			Pass, "postmaster@mx.session.test", Pass, nil},
+		{net.IP{10, 0, 0, 2}, "mx.session.test", "<>",
+			Fail, "postmaster@mx.session.test", Fail, nil},
+		{net.IP{10, 0, 0, 1}, "mx.session.test", "<> SIZE=1000",
+			Pass, "postmaster@mx.session.test", Pass, nil},
+		{net.IP{10, 0, 0, 1}, "mx.session.test.", "<>",
+			Pass, "postmaster@mx.session.test", Pass, nil},
+		{net.IP{10, 0, 0, 1}, "[10.0.0.1]", "<>",
+			None, "", None, ErrInvalidDomain},
+		{net.IP{10, 0, 0, 1}, "mx.session.test", "<user>",
+			Pass, "", None, ErrInvalidReversePath},
+	}
+
+	c := NewChecker(WithResolver(testResolver))
+	for i, s := range samples {
+		r := c.CheckSessionContext(context.Background(), s.ip, s.helo, s.mailFrom)
+		if r.HELO.Result != s.heloResult || r.Sender != s.sender || r.MailFrom.Result != s.mailFromResult || r.MailFromErr != s.err {
+			t.Errorf("#%d want [%v %q %v %v], got [%v %q %v %v]", i,
+				s.heloResult, s.sender, s.mailFromResult, s.err,
+				r.HELO.Result, r.Sender, r.MailFrom.Result, r.MailFromErr)
+		}
+	}
+
+	r := CheckSession(net.IP{10, 0, 0, 2}, "mx.session.test", "<user@sender.session.test>", WithResolver(testResolver))
+	if r.HELO.Result != Fail || r.MailFrom.Result != Pass {
+		t.Errorf("CheckSession want [%v %v], got [%v %v]", Fail, Pass, r.HELO.Result, r.MailFrom.Result)
+	}
+}
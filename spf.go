@@ -1,21 +1,28 @@
 package spf
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Errors could be used for root couse analysis
 var (
-	ErrDNSTemperror      = errors.New("temporary DNS error")
-	ErrDNSPermerror      = errors.New("permanent DNS error")
-	ErrInvalidDomain     = errors.New("invalid domain name")
-	ErrDNSLimitExceeded  = errors.New("limit exceeded")
-	ErrSPFNotFound       = errors.New("SPF record not found")
-	errInvalidCIDRLength = errors.New("invalid CIDR length")
-	errTooManySPFRecords = errors.New("too many SPF records")
+	ErrDNSTemperror               = errors.New("temporary DNS error")
+	ErrDNSPermerror               = errors.New("permanent DNS error")
+	ErrInvalidDomain              = errors.New("invalid domain name")
+	ErrDNSLimitExceeded           = errors.New("limit exceeded")
+	ErrDNSVoidLookupLimitExceeded = errors.New("void lookup limit exceeded")
+	ErrSPFNotFound                = errors.New("SPF record not found")
+	ErrInvalidReversePath         = errors.New("invalid reverse-path")
+	ErrInvalidAuthResults         = errors.New("invalid Authentication-Results")
+	errNoReverseLookups           = errors.New("reverse lookups not supported")
+	errInvalidCIDRLength          = errors.New("invalid CIDR length")
+	errTooManySPFRecords          = errors.New("too many SPF records")
 )
 
 // IPMatcherFunc returns true if ip matches to implemented rules.
@@ -46,6 +53,39 @@ type Resolver interface {
 	MatchMX(string, IPMatcherFunc) (bool, error)
 }
 
+// PTRResolver is implemented by the Resolver which supports reverse lookups
+// needed by the "ptr" mechanism and the "p" macro. With a Resolver not
+// implementing it, "ptr" never matches and "p" expands to "unknown", as if
+// the lookups failed.
+type PTRResolver interface {
+	// LookupPTR performs a reverse lookup (PTR RR) of the given IP address.
+	// Each returned name is validated by an address lookup (A or AAAA) and
+	// only names resolving back to the IP address are returned. At most 10
+	// names from the reverse lookup are validated, the rest is ignored.
+	LookupPTR(net.IP) ([]string, error)
+}
+
+// lookupPTR calls LookupPTR of r if it implements PTRResolver.
+func lookupPTR(r Resolver, ip net.IP) ([]string, error) {
+	if pr, ok := r.(PTRResolver); ok {
+		return pr.LookupPTR(ip)
+	}
+	return nil, errNoReverseLookups
+}
+
+// ResolverContext provides context-aware abstraction for DNS layer.
+// Its methods work like Resolver's ones, but they should stop and return
+// an error as soon as the context is done.
+// Use AdaptResolver for Resolver which does not implement ResolverContext.
+type ResolverContext interface {
+	LookupTXTContext(context.Context, string) ([]string, error)
+	LookupTXTStrictContext(context.Context, string) ([]string, error)
+	ExistsContext(context.Context, string) (bool, error)
+	MatchIPContext(context.Context, string, IPMatcherFunc) (bool, error)
+	MatchMXContext(context.Context, string, IPMatcherFunc) (bool, error)
+	LookupPTRContext(context.Context, net.IP) ([]string, error)
+}
+
 // Result represents result of SPF evaluation as it defined by RFC7208
 // https://tools.ietf.org/html/rfc7208#section-2.6
 type Result int
@@ -107,8 +147,144 @@ func (r Result) String() string {
 	}
 }
 
+// MarshalText implements encoding.TextMarshaler, so the result is encoded
+// by its string form, e.g. in JSON.
+func (r Result) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (r *Result) UnmarshalText(text []byte) error {
+	for v := None; v <= Permerror; v++ {
+		if v.String() == string(text) {
+			*r = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown result: %q", text)
+}
+
+// Option sets an optional parameter of SPF evaluation
+type Option func(*config)
+
+// config keeps optional parameters of SPF evaluation
+type config struct {
+	lookupLimit     uint16
+	mxQueriesLimit  uint16
+	voidLookupLimit uint16
+	resolver        Resolver
+	receivingFQDN   string
+	helo            string
+	now             func() time.Time
+	explanation     bool
+}
+
+// newConfig returns config with default values updated by opts
+func newConfig(opts []Option) *config {
+	c := &config{
+		lookupLimit:     10,
+		mxQueriesLimit:  10,
+		voidLookupLimit: 2,
+		resolver:        &DNSResolver{},
+		receivingFQDN:   "unknown",
+		helo:            "unknown",
+		now:             time.Now,
+		explanation:     true,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithLookupLimit sets the limit of DNS lookups of a single evaluation,
+// which defaults to 10 (RFC 7208, section 4.6.4). The limit is enforced by
+// LimitedResolver, which passes fewer than limit lookups, e.g. 9 by default.
+// The lookup of the evaluated SPF record counts as a single lookup, as well
+// as each "include", "a", "mx", "ptr" and "exists" mechanism, "redirect"
+// modifier, and the lookups of the explanation and of the "p" macro.
+// Exceeding the limit produces Permerror, except for the explanation, which
+// is left empty then.
+// The option is ignored by CheckHostWithResolver, which relies on limits
+// enforced by provided Resolver.
+func WithLookupLimit(limit uint16) Option {
+	return func(c *config) {
+		c.lookupLimit = limit
+	}
+}
+
+// WithMXQueriesLimit sets the limit of address lookups done while evaluating
+// a single "mx" mechanism, which defaults to 10 (RFC 7208, section 4.6.4).
+// The option is ignored by CheckHostWithResolver, which relies on limits
+// enforced by provided Resolver.
+func WithMXQueriesLimit(limit uint16) Option {
+	return func(c *config) {
+		c.mxQueriesLimit = limit
+	}
+}
+
+// WithVoidLookupLimit sets the limit of void lookups of a single evaluation,
+// which defaults to 2 (RFC 7208, section 4.6.4).
+// The option is ignored by CheckHostWithResolver, which relies on limits
+// enforced by provided Resolver.
+func WithVoidLookupLimit(limit uint16) Option {
+	return func(c *config) {
+		c.voidLookupLimit = limit
+	}
+}
+
+// WithResolver sets the resolver used for DNS lookups, which defaults to
+// DNSResolver. The resolver is wrapped with LimitedResolver for each
+// evaluation, so it should not enforce limits by itself.
+// If r implements ResolverContext, the context of the evaluation is passed
+// to it.
+// The option is ignored by CheckHostWithResolver.
+func WithResolver(r Resolver) Option {
+	return func(c *config) {
+		c.resolver = r
+	}
+}
+
+// WithReceivingFQDN sets the domain name of the host performing the check.
+// It is used as a value of the "r" macro, which defaults to "unknown" as
+// RFC 7208, section 7.3 recommends.
+func WithReceivingFQDN(fqdn string) Option {
+	return func(c *config) {
+		c.receivingFQDN = fqdn
+	}
+}
+
+// WithHELO sets the HELO or EHLO domain of the SMTP session. It is used as a
+// value of the "h" macro, which defaults to "unknown".
+// CheckHELO sets it to the checked HELO identity.
+func WithHELO(helo string) Option {
+	return func(c *config) {
+		c.helo = helo
+	}
+}
+
+// WithClock sets the function returning current time. It is used as a
+// source of the "t" macro and defaults to time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(c *config) {
+		c.now = now
+	}
+}
+
+// WithExplanation sets whether the "exp" modifier is evaluated upon Fail
+// result, which is the default. Evaluation of the explanation costs an
+// additional DNS lookup, hence it may be disabled when explanations are not
+// used, e.g. when the result is not reported back to the SMTP client.
+func WithExplanation(evaluate bool) Option {
+	return func(c *config) {
+		c.explanation = evaluate
+	}
+}
+
 // CheckHost is a main entrypoint function evaluating e-mail with regard to
-// SPF and it utilizes DNSResolver as a resolver.
+// SPF and it utilizes DNSResolver as a resolver, unless WithResolver option
+// is used.
+// Use Checker to avoid processing the options on each call.
 // As per RFC 7208 it will accept 3 parameters:
 // <ip> - IP{4,6} address of the connected client
 // <domain> - domain portion of the MAIL FROM or HELO identity
@@ -119,8 +295,14 @@ func (r Result) String() string {
 //
 // CheckHost returns result of verification, explanations as result of "exp=",
 // and error as the reason for the encountered problem.
-func CheckHost(ip net.IP, domain, sender string) (Result, string, error) {
-	return CheckHostWithResolver(ip, domain, sender, NewLimitedResolver(&DNSResolver{}, 10, 10))
+func CheckHost(ip net.IP, domain, sender string, opts ...Option) (Result, string, error) {
+	return CheckHostContext(context.Background(), ip, domain, sender, opts...)
+}
+
+// CheckHostContext is CheckHost, which stops the evaluation with Temperror
+// result once ctx is done. In such case the returned error is ctx.Err().
+func CheckHostContext(ctx context.Context, ip net.IP, domain, sender string, opts ...Option) (Result, string, error) {
+	return NewChecker(opts...).CheckHostContext(ctx, ip, domain, sender)
 }
 
 // CheckHostWithResolver allows using custom Resolver.
@@ -128,7 +310,28 @@ func CheckHost(ip net.IP, domain, sender string) (Result, string, error) {
 //
 // The function returns result of verification, explanations as result of "exp=",
 // and error as the reason for the encountered problem.
-func CheckHostWithResolver(ip net.IP, domain, sender string, resolver Resolver) (Result, string, error) {
+// See EvaluateWithResolver for the detailed result.
+func CheckHostWithResolver(ip net.IP, domain, sender string, resolver Resolver, opts ...Option) (Result, string, error) {
+	e, err := evaluate(context.Background(), ip, domain, sender, AdaptResolver(resolver), newConfig(opts), nil)
+	return e.Result, e.Explanation, err
+}
+
+// CheckHostWithResolverContext is CheckHostWithResolver, which passes ctx to
+// each call of resolver and stops the evaluation with Temperror result once
+// ctx is done. In such case the returned error is ctx.Err().
+func CheckHostWithResolverContext(ctx context.Context, ip net.IP, domain, sender string, resolver ResolverContext, opts ...Option) (Result, string, error) {
+	e, err := evaluate(ctx, ip, domain, sender, resolver, newConfig(opts), nil)
+	return e.Result, e.Explanation, err
+}
+
+// checkHost implements check_host() function as described in RFC 7208,
+// section 4. It's also called recursively for "include" and "redirect"
+// terms, sharing resolver and config with the calling parser.
+// The matched term is recorded into m and the evaluation into trace, unless
+// they are nil.
+func checkHost(ip net.IP, domain, sender string, resolver Resolver, cfg *config, m *match, trace *Trace) (result Result, explanation string, err error) {
+	defer func() { trace.finish(result, explanation, err) }()
+
 	/*
 	* As per RFC 7208 Section 4.3:
 	* If the <domain> is malformed (e.g., label longer than 63
@@ -140,11 +343,12 @@ func CheckHostWithResolver(ip net.IP, domain, sender string, resolver Resolver)
 		return None, "", ErrInvalidDomain
 	}
 
+	trace.collect()
 	txts, err := resolver.LookupTXTStrict(NormalizeFQDN(domain))
 	switch err {
 	case nil:
 		// continue
-	case ErrDNSLimitExceeded:
+	case ErrDNSLimitExceeded, ErrDNSVoidLookupLimitExceeded:
 		return Permerror, "", err
 	case ErrDNSPermerror:
 		return None, "", err
@@ -163,7 +367,15 @@ func CheckHostWithResolver(ip net.IP, domain, sender string, resolver Resolver)
 		return None, "", ErrSPFNotFound
 	}
 
-	return newParser(sender, domain, ip, spf, resolver).parse()
+	if trace != nil {
+		trace.Record = spf
+	}
+
+	p := newParser(sender, domain, ip, spf, resolver)
+	p.cfg = cfg
+	p.match = m
+	p.trace = trace
+	return p.parse()
 }
 
 // Starting with the set of records that were returned by the lookup,
@@ -1,6 +1,9 @@
 package spf
 
-import "strconv"
+import (
+	"strconv"
+	"strings"
+)
 
 type tokenType int
 
@@ -24,8 +27,9 @@ const (
 
 	modifierBeg
 
-	tRedirect // redirect
-	tExp      // explanation
+	tRedirect        // redirect
+	tExp             // explanation
+	tUnknownModifier // name=value
 
 	modifierEnd
 
@@ -51,6 +55,8 @@ func (tok tokenType) String() string {
 		return "v"
 	case tAll:
 		return "all"
+	case tA:
+		return "a"
 	case tIP4:
 		return "ip4"
 	case tIP6:
@@ -67,15 +73,29 @@ func (tok tokenType) String() string {
 		return "exists"
 	case tExp:
 		return "exp"
+	case tUnknownModifier:
+		return "unknown-modifier"
+	case qPlus:
+		return "+"
+	case qMinus:
+		return "-"
+	case qTilde:
+		return "~"
+	case qQuestionMark:
+		return "?"
 	default:
 		return strconv.Itoa(int(tok))
 	}
 }
 
 func tokenTypeFromString(s string) tokenType {
-	switch s {
-	case "v":
+	if s == "v" {
+		// RFC 7208, section 4.5: the version section must be exactly "v=spf1"
 		return tVersion
+	}
+	// RFC 7208, section 12: mechanism and modifier names are
+	// case-insensitive
+	switch strings.ToLower(s) {
 	case "all":
 		return tAll
 	case "a":
@@ -133,6 +153,9 @@ func checkTokenSyntax(tkn *token, delimiter rune) bool {
 	if tkn.mechanism.isModifier() && delimiter != '=' {
 		return false
 	}
+	if (tkn.mechanism == tA || tkn.mechanism == tMX) && delimiter == '/' {
+		return true
+	}
 	if tkn.mechanism.isMechanism() && delimiter != ':' {
 		return false
 	}
@@ -146,5 +169,5 @@ func checkTokenSyntax(tkn *token, delimiter rune) bool {
 type token struct {
 	mechanism tokenType // all, include, a, mx, ptr, ip4, ip6, exists etc.
 	qualifier tokenType // +, -, ~, ?, defaults to +
-	value     string    // value for a mechanism
+	value     string    // value for a mechanism, name=value for unknown modifiers
 }
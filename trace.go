@@ -0,0 +1,328 @@
+package spf
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Trace is a detailed record of a single check_host() evaluation as returned
+// by Checker.Trace. Terms of "include" mechanism and "redirect" modifier keep
+// Trace of the recursive evaluation, so the whole evaluation forms a tree.
+//
+// Trace could be rendered as an indented text with String or as JSON with
+// encoding/json.
+type Trace struct {
+	Domain      string         `json:"domain"`
+	Depth       int            `json:"depth"`             // 0 for the top level evaluation
+	Record      string         `json:"record,omitempty"`  // evaluated SPF record
+	Lookups     []*TraceLookup `json:"lookups,omitempty"` // lookups done for the SPF record
+	Terms       []*TraceTerm   `json:"terms,omitempty"`   // evaluated terms, in order
+	Matched     string         `json:"matched,omitempty"` // term which determined the result
+	Result      Result         `json:"result"`
+	Explanation string         `json:"explanation,omitempty"`
+	Error       string         `json:"error,omitempty"`
+
+	tracer  *tracer
+	current *TraceTerm
+}
+
+// TraceTerm records evaluation of a single mechanism or modifier.
+type TraceTerm struct {
+	Qualifier string         `json:"qualifier,omitempty"` // empty for modifiers
+	Name      string         `json:"name"`
+	Value     string         `json:"value,omitempty"` // as written in the record, before macro expansion
+	Match     bool           `json:"match"`
+	Result    Result         `json:"result,omitempty"` // set only if the term matched
+	Error     string         `json:"error,omitempty"`
+	Lookups   []*TraceLookup `json:"lookups,omitempty"`
+	Trace     *Trace         `json:"trace,omitempty"` // recursive evaluation of include and redirect
+}
+
+// TraceLookup records a single Resolver call.
+// Answers of address lookups are limited to the addresses compared with the
+// checked IP, as the Resolver may stop once a matching address is found.
+type TraceLookup struct {
+	Type    string   `json:"type"` // TXT, A, A/AAAA, MX or PTR
+	Name    string   `json:"name"`
+	Answers []string `json:"answers,omitempty"`
+	Match   bool     `json:"match,omitempty"` // found record or matching address
+	Error   string   `json:"error,omitempty"`
+
+	ended bool // answers are not recorded once the call returned
+}
+
+// String returns term as it's written in the SPF record. Implicit "+"
+// qualifier is omitted.
+func (t *TraceTerm) String() string {
+	return termString(t.Qualifier, t.Name, t.Value)
+}
+
+// termString returns the term as it's written in the SPF record, qualifier
+// is empty for modifiers.
+func termString(qualifier, name, value string) string {
+	switch {
+	case qualifier == "" && value != "":
+		return name + "=" + value
+	case value == "":
+		return strings.TrimPrefix(qualifier, "+") + name
+	case strings.HasPrefix(value, "/"):
+		return strings.TrimPrefix(qualifier, "+") + name + value
+	default:
+		return strings.TrimPrefix(qualifier, "+") + name + ":" + value
+	}
+}
+
+// String renders the trace as indented text, one line per term and lookup.
+func (t *Trace) String() string {
+	var b bytes.Buffer
+	t.write(&b, "")
+	return b.String()
+}
+
+func (t *Trace) write(b *bytes.Buffer, indent string) {
+	fmt.Fprintf(b, "%scheck_host(%s) = %s", indent, t.Domain, t.Result)
+	if t.Matched != "" {
+		fmt.Fprintf(b, " (matched %q)", t.Matched)
+	}
+	if t.Error != "" {
+		fmt.Fprintf(b, " error: %s", t.Error)
+	}
+	b.WriteByte('\n')
+
+	indent += "  "
+	if t.Record != "" {
+		fmt.Fprintf(b, "%srecord: %q\n", indent, t.Record)
+	}
+	for _, l := range t.Lookups {
+		l.write(b, indent)
+	}
+	for _, term := range t.Terms {
+		fmt.Fprintf(b, "%s%s", indent, term)
+		switch {
+		case term.Match:
+			fmt.Fprintf(b, " => %s", term.Result)
+		case term.Qualifier != "":
+			b.WriteString(" => no match")
+		}
+		if term.Error != "" {
+			fmt.Fprintf(b, " error: %s", term.Error)
+		}
+		b.WriteByte('\n')
+		for _, l := range term.Lookups {
+			l.write(b, indent+"  ")
+		}
+		if term.Trace != nil {
+			term.Trace.write(b, indent+"  ")
+		}
+	}
+	if t.Explanation != "" {
+		fmt.Fprintf(b, "%sexplanation: %q\n", indent, t.Explanation)
+	}
+}
+
+func (l *TraceLookup) write(b *bytes.Buffer, indent string) {
+	fmt.Fprintf(b, "%s%s %s ->", indent, l.Type, l.Name)
+	for _, a := range l.Answers {
+		fmt.Fprintf(b, " %s", strconv.Quote(a))
+	}
+	if len(l.Answers) == 0 && l.Error == "" {
+		b.WriteString(" none")
+	}
+	if l.Match {
+		b.WriteString(" (match)")
+	}
+	if l.Error != "" {
+		fmt.Fprintf(b, " error: %s", l.Error)
+	}
+	b.WriteByte('\n')
+}
+
+// The methods below are used by the parser and they are no-op for nil Trace.
+// Lookups are recorded only if Trace has a tracer, see Checker.Trace.
+
+// collect starts recording lookups of the SPF record.
+func (t *Trace) collect() {
+	if t == nil {
+		return
+	}
+	t.current = nil
+	t.tracer.collect(&t.Lookups)
+}
+
+// term starts recording evaluation of t. Following lookups are recorded as
+// lookups of the term.
+func (t *Trace) term(tkn *token) *TraceTerm {
+	if t == nil {
+		return nil
+	}
+	term := &TraceTerm{Name: tkn.mechanism.String(), Value: tkn.value}
+	if tkn.mechanism.isMechanism() {
+		term.Qualifier = tkn.qualifier.String()
+	}
+	t.Terms = append(t.Terms, term)
+	t.current = term
+	t.tracer.collect(&term.Lookups)
+	return term
+}
+
+// done records outcome of the term evaluation.
+func (t *Trace) done(term *TraceTerm, matches bool, result Result, err error) {
+	if t == nil || term == nil {
+		return
+	}
+	term.Match = matches
+	if matches {
+		term.Result = result
+		t.Matched = term.String()
+	}
+	if err != nil {
+		term.Error = err.Error()
+	}
+}
+
+// nest returns Trace for recursive evaluation of domain, done by the term
+// being evaluated.
+func (t *Trace) nest(domain string) *Trace {
+	if t == nil {
+		return nil
+	}
+	n := &Trace{Domain: domain, Depth: t.Depth + 1, tracer: t.tracer}
+	if t.current != nil {
+		t.current.Trace = n
+	}
+	return n
+}
+
+// finish records result of the evaluation.
+func (t *Trace) finish(result Result, explanation string, err error) {
+	if t == nil {
+		return
+	}
+	t.Result = result
+	t.Explanation = explanation
+	if err != nil {
+		t.Error = err.Error()
+	}
+}
+
+// tracer collects lookups done by tracingResolver into the lookups of the
+// term being evaluated.
+type tracer struct {
+	mu      sync.Mutex
+	lookups *[]*TraceLookup
+}
+
+func (t *tracer) collect(lookups *[]*TraceLookup) {
+	if t == nil {
+		return // lookups are not traced
+	}
+	t.mu.Lock()
+	t.lookups = lookups
+	t.mu.Unlock()
+}
+
+func (t *tracer) start(typ, name string) *TraceLookup {
+	l := &TraceLookup{Type: typ, Name: name}
+	t.mu.Lock()
+	if t.lookups != nil {
+		*t.lookups = append(*t.lookups, l)
+	}
+	t.mu.Unlock()
+	return l
+}
+
+// answer records answer of l, unless the lookup has ended already, as the
+// matcher may be called by the resolver after the call returned, while the
+// trace is read.
+func (t *tracer) answer(l *TraceLookup, answer string) {
+	t.mu.Lock()
+	if !l.ended {
+		l.Answers = append(l.Answers, answer)
+	}
+	t.mu.Unlock()
+}
+
+func (t *tracer) end(l *TraceLookup, match bool, err error) {
+	t.mu.Lock()
+	l.ended = true
+	l.Match = match
+	if err != nil {
+		l.Error = err.Error()
+	}
+	t.mu.Unlock()
+}
+
+// tracingResolver records calls of underlying Resolver with tracer
+type tracingResolver struct {
+	resolver Resolver
+	tracer   *tracer
+}
+
+func (r *tracingResolver) lookupTXT(name string, lookup func(string) ([]string, error)) ([]string, error) {
+	l := r.tracer.start("TXT", name)
+	txts, err := lookup(name)
+	for _, txt := range txts {
+		r.tracer.answer(l, txt)
+	}
+	r.tracer.end(l, len(txts) > 0, err)
+	return txts, err
+}
+
+func (r *tracingResolver) matchIP(typ, name string, matcher IPMatcherFunc, match func(string, IPMatcherFunc) (bool, error)) (bool, error) {
+	l := r.tracer.start(typ, name)
+	found, err := match(name, func(ip net.IP) (bool, error) {
+		r.tracer.answer(l, ip.String())
+		return matcher(ip)
+	})
+	r.tracer.end(l, found, err)
+	return found, err
+}
+
+// LookupTXT returns the DNS TXT records for the given domain name.
+func (r *tracingResolver) LookupTXT(name string) ([]string, error) {
+	return r.lookupTXT(name, r.resolver.LookupTXT)
+}
+
+// LookupTXTStrict returns DNS TXT records for the given name, however it
+// will return ErrDNSPermerror upon returned NXDOMAIN (RCODE 3)
+func (r *tracingResolver) LookupTXTStrict(name string) ([]string, error) {
+	return r.lookupTXT(name, r.resolver.LookupTXTStrict)
+}
+
+// Exists is used for a DNS A RR lookup (even when the
+// connection type is IPv6).  If any A record is returned, this
+// mechanism matches.
+func (r *tracingResolver) Exists(name string) (bool, error) {
+	l := r.tracer.start("A", name)
+	found, err := r.resolver.Exists(name)
+	r.tracer.end(l, found, err)
+	return found, err
+}
+
+// MatchIP provides an address lookup, which should be done on the name
+// using the type of lookup (A or AAAA).
+func (r *tracingResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, error) {
+	return r.matchIP("A/AAAA", name, matcher, r.resolver.MatchIP)
+}
+
+// MatchMX is similar to MatchIP but first performs an MX lookup on the
+// name. Answers are addresses of the exchanges.
+func (r *tracingResolver) MatchMX(name string, matcher IPMatcherFunc) (bool, error) {
+	return r.matchIP("MX", name, matcher, r.resolver.MatchMX)
+}
+
+// LookupPTR performs a reverse lookup of the given IP address, returning
+// validated names only.
+func (r *tracingResolver) LookupPTR(ip net.IP) ([]string, error) {
+	l := r.tracer.start("PTR", ip.String())
+	names, err := lookupPTR(r.resolver, ip)
+	for _, name := range names {
+		r.tracer.answer(l, name)
+	}
+	r.tracer.end(l, len(names) > 0, err)
+	return names, err
+}
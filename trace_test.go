@@ -0,0 +1,145 @@
+package spf
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTrace(t *testing.T) {
+	dns.HandleFunc("trace.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`trace.test. 0 IN TXT "v=spf1 a:a.trace.test include:inc.trace.test redirect=red.trace.test"`,
+			`inc.trace.test. 0 IN TXT "v=spf1 ip4:10.0.0.2 ~all"`,
+			`red.trace.test. 0 IN TXT "v=spf1 exists:%{i}.trace.test -all"`,
+		},
+		dns.TypeA: {
+			"a.trace.test. 0 IN A 10.0.0.10",
+		},
+	}))
+	defer dns.HandleRemove("trace.test.")
+
+	c := NewChecker(WithResolver(testResolver), WithExplanation(false))
+	trace, err := c.Trace(context.Background(), net.IP{10, 0, 0, 1}, "trace.test", "trace.test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `check_host(trace.test) = fail (matched "redirect=red.trace.test")
+  record: "v=spf1 a:a.trace.test include:inc.trace.test redirect=red.trace.test"
+  TXT trace.test. -> "v=spf1 a:a.trace.test include:inc.trace.test redirect=red.trace.test" (match)
+  a:a.trace.test => no match
+    A/AAAA a.trace.test. -> "10.0.0.10"
+  include:inc.trace.test => no match
+    check_host(inc.trace.test) = softfail (matched "~all")
+      record: "v=spf1 ip4:10.0.0.2 ~all"
+      TXT inc.trace.test. -> "v=spf1 ip4:10.0.0.2 ~all" (match)
+      ip4:10.0.0.2 => no match
+      ~all => softfail
+  redirect=red.trace.test => fail
+    check_host(red.trace.test) = fail (matched "-all")
+      record: "v=spf1 exists:%{i}.trace.test -all"
+      TXT red.trace.test. -> "v=spf1 exists:%{i}.trace.test -all" (match)
+      exists:%{i}.trace.test => no match
+        A 10.0.0.1.trace.test. -> none
+      -all => fail
+`
+	if got := trace.String(); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	if trace.Result != Fail || trace.Terms[2].Trace.Depth != 1 {
+		t.Errorf("unexpected trace: %+v", trace)
+	}
+
+	b, err := json.Marshal(trace)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	var decoded Trace
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	clearTrace(trace)
+	if !reflect.DeepEqual(trace, &decoded) {
+		t.Errorf("JSON round trip failed:\n%s", b)
+	}
+}
+
+func clearTrace(t *Trace) {
+	t.tracer, t.current = nil, nil
+	for _, l := range t.Lookups {
+		l.ended = false
+	}
+	for _, term := range t.Terms {
+		for _, l := range term.Lookups {
+			l.ended = false
+		}
+		if term.Trace != nil {
+			clearTrace(term.Trace)
+		}
+	}
+}
+
+func TestTraceErrors(t *testing.T) {
+	dns.HandleFunc("trace.test.", zone(map[uint16][]string{
+		dns.TypeTXT: {
+			`trace.test. 0 IN TXT "v=spf1 a:a.trace.test a:b.trace.test -all"`,
+		},
+	}))
+	defer dns.HandleRemove("trace.test.")
+
+	c := NewChecker(WithResolver(testResolver), WithLookupLimit(3))
+	trace, err := c.Trace(context.Background(), net.IP{10, 0, 0, 1}, "trace.test", "trace.test")
+	if err != ErrDNSLimitExceeded {
+		t.Errorf("want %v, got %v", ErrDNSLimitExceeded, err)
+	}
+
+	want := `check_host(trace.test) = permerror (matched "a:b.trace.test") error: limit exceeded
+  record: "v=spf1 a:a.trace.test a:b.trace.test -all"
+  TXT trace.test. -> "v=spf1 a:a.trace.test a:b.trace.test -all" (match)
+  a:a.trace.test => no match
+    A/AAAA a.trace.test. -> none
+  a:b.trace.test => permerror error: limit exceeded
+    A/AAAA b.trace.test. -> error: limit exceeded
+`
+	if got := trace.String(); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+// lateResolver passes the matcher of MatchIP on, so it can be called after
+// MatchIP returned.
+type lateResolver struct {
+	Resolver
+	late chan IPMatcherFunc
+}
+
+func (r *lateResolver) MatchIP(name string, matcher IPMatcherFunc) (bool, error) {
+	_, _ = matcher(net.IP{10, 0, 0, 1})
+	r.late <- matcher
+	return false, nil
+}
+
+func TestTraceLateAnswers(t *testing.T) {
+	var lookups []*TraceLookup
+	tr := &tracer{}
+	tr.collect(&lookups)
+	late := &lateResolver{late: make(chan IPMatcherFunc, 1)}
+	r := &tracingResolver{resolver: late, tracer: tr}
+
+	if found, err := r.MatchIP("late.test.", func(net.IP) (bool, error) { return false, nil }); found || err != nil {
+		t.Fatalf("unexpected result: %v, %v", found, err)
+	}
+	// e.g. a goroutine of the resolver still comparing addresses
+	matcher := <-late.late
+	_, _ = matcher(net.IP{10, 0, 0, 2})
+
+	if len(lookups) != 1 || len(lookups[0].Answers) != 1 || lookups[0].Answers[0] != "10.0.0.1" {
+		t.Errorf("answer recorded after the lookup returned: %+v", lookups)
+	}
+}